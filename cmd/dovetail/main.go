@@ -2,19 +2,30 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"log/slog"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"runtime"
 	"syscall"
+	"time"
 
+	"github.com/jasonwu/dovetail/internal/admin"
 	"github.com/jasonwu/dovetail/internal/config"
 	"github.com/jasonwu/dovetail/internal/docker"
+	"github.com/jasonwu/dovetail/internal/errorpage"
+	"github.com/jasonwu/dovetail/internal/identity"
+	"github.com/jasonwu/dovetail/internal/oidc"
 	"github.com/jasonwu/dovetail/internal/service"
 	"github.com/jasonwu/dovetail/internal/version"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "maintenance" {
+		os.Exit(runMaintenance(os.Args[2:]))
+	}
+
 	logger := slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{
 		Level: slog.LevelInfo,
 	}))
@@ -38,18 +49,82 @@ func main() {
 		os.Exit(1)
 	}
 
+	errorPages, err := errorpage.New(cfg.ErrorPagesDir)
+	if err != nil {
+		logger.Error("failed to load error pages", "path", cfg.ErrorPagesDir, "error", err)
+		os.Exit(1)
+	}
+
 	watcher, err := docker.NewWatcher(logger)
 	if err != nil {
 		logger.Error("failed to create docker watcher", "error", err)
 		os.Exit(1)
 	}
 	defer watcher.Close()
+	watcher.SetHostAddress(cfg.HostAddress)
+	watcher.SetInstance(cfg.Instance)
+	if cfg.LabelPrefix != "" {
+		watcher.SetLabelPrefix(cfg.LabelPrefix)
+	}
 
 	manager := service.NewManager(cfg, logger)
+	manager.SetErrorPages(errorPages)
+
+	// Services load the signing key when they need it, but the OIDC
+	// provider can't start without it
+	var signer *identity.Signer
+	if cfg.OIDCHostname != "" {
+		signer, err = identity.LoadOrCreate(filepath.Join(cfg.StateDir, identity.KeyFile))
+		if err != nil {
+			logger.Error("failed to load identity signing key", "error", err)
+			os.Exit(1)
+		}
+		manager.SetIdentitySigner(signer)
+	}
+
+	var adminServer *admin.Server
+	if cfg.AdminAddr != "" {
+		adminServer = admin.New(cfg.AdminAddr, logger)
+		adminServer.Handle("GET "+identity.JWKSPath, manager.JWKSHandler())
+		// The admin server has no other authentication, so the maintenance
+		// API, which can take any service offline, needs a token unless
+		// only the host can reach it
+		switch {
+		case cfg.AdminToken != "":
+			adminServer.Handle("/services/{name}/maintenance", admin.RequireToken(cfg.AdminToken, manager.MaintenanceHandler()))
+		case admin.IsLoopback(cfg.AdminAddr):
+			adminServer.Handle("/services/{name}/maintenance", manager.MaintenanceHandler())
+		default:
+			logger.Warn("maintenance API disabled: the admin server is reachable beyond loopback, set DOVETAIL_ADMIN_TOKEN to enable it",
+				"addr", cfg.AdminAddr)
+		}
+		if err := adminServer.Start(); err != nil {
+			logger.Error("failed to start admin server", "error", err)
+			os.Exit(1)
+		}
+	}
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
+	var oidcServer *oidc.Server
+	if cfg.OIDCHostname != "" {
+		oidcServer, err = startOIDC(ctx, cfg, signer, errorPages, logger)
+		if err != nil {
+			logger.Error("failed to start OIDC provider", "error", err)
+			os.Exit(1)
+		}
+	}
+
+	if cfg.ServicesFile != "" {
+		services, err := config.LoadServices(cfg.ServicesFile)
+		if err != nil {
+			logger.Error("failed to load services file", "path", cfg.ServicesFile, "error", err)
+			os.Exit(1)
+		}
+		manager.StartServices(ctx, services)
+	}
+
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 
@@ -74,5 +149,47 @@ func main() {
 	logger.Info("shutting down services")
 	manager.Shutdown()
 
+	if oidcServer != nil {
+		shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 5*time.Second)
+		if err := oidcServer.Shutdown(shutdownCtx); err != nil {
+			logger.Error("failed to stop OIDC provider", "error", err)
+		}
+		shutdownCancel()
+	}
+
+	if adminServer != nil {
+		shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 5*time.Second)
+		if err := adminServer.Shutdown(shutdownCtx); err != nil {
+			logger.Error("failed to stop admin server", "error", err)
+		}
+		shutdownCancel()
+	}
+
 	logger.Info("dovetail stopped")
 }
+
+// startOIDC runs the OpenID Connect provider on its own tailnet node
+func startOIDC(ctx context.Context, cfg *config.Config, signer *identity.Signer, errorPages *errorpage.Renderer, logger *slog.Logger) (*oidc.Server, error) {
+	if signer == nil {
+		return nil, fmt.Errorf("no identity signing key is available")
+	}
+
+	clients, err := oidc.LoadClients(cfg.OIDCClientsFile)
+	if err != nil {
+		return nil, err
+	}
+
+	server := oidc.NewServer(oidc.ServerConfig{
+		Hostname:   cfg.OIDCHostname,
+		StateDir:   cfg.StateDir,
+		AuthKey:    cfg.AuthKey,
+		Clients:    clients,
+		Signer:     signer,
+		ErrorPages: errorPages,
+	}, logger)
+
+	if err := server.Start(ctx); err != nil {
+		return nil, err
+	}
+	return server, nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jasonwu/dovetail/internal/service"
+)
+
+const maintenanceUsage = `usage: dovetail maintenance [flags] <service> [on|off]
+
+Shows or changes a service's maintenance mode through the admin server of a
+running dovetail (DOVETAIL_ADMIN_ADDR), authenticating with
+DOVETAIL_ADMIN_TOKEN when it is set.
+
+Flags:
+`
+
+// runMaintenance implements the "maintenance" subcommand and returns the
+// process exit code
+func runMaintenance(args []string) int {
+	fs := flag.NewFlagSet("maintenance", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), maintenanceUsage)
+		fs.PrintDefaults()
+	}
+	admin := fs.String("admin", os.Getenv("DOVETAIL_ADMIN_ADDR"), "admin server address")
+	token := fs.String("token", os.Getenv("DOVETAIL_ADMIN_TOKEN"), "admin API token")
+	message := fs.String("message", "", "message shown on the maintenance page")
+	allow := fs.String("allow", "", "comma-separated logins, node names or tags that can still use the service")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	if fs.NArg() < 1 || fs.NArg() > 2 || *admin == "" {
+		fs.Usage()
+		return 2
+	}
+	name := fs.Arg(0)
+
+	endpoint := adminURL(*admin) + "/services/" + url.PathEscape(name) + "/maintenance"
+	req, err := http.NewRequest(http.MethodGet, endpoint, nil)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	if fs.NArg() == 2 {
+		state := service.MaintenanceState{Message: *message}
+		switch fs.Arg(1) {
+		case "on":
+			state.Enabled = true
+		case "off":
+		default:
+			fs.Usage()
+			return 2
+		}
+		for _, entry := range strings.Split(*allow, ",") {
+			if entry = strings.TrimSpace(entry); entry != "" {
+				state.Allow = append(state.Allow, entry)
+			}
+		}
+
+		body, _ := json.Marshal(state)
+		req, err = http.NewRequest(http.MethodPut, endpoint, bytes.NewReader(body))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	if *token != "" {
+		req.Header.Set("Authorization", "Bearer "+*token)
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		fmt.Fprintf(os.Stderr, "%s: %s", resp.Status, msg)
+		return 1
+	}
+
+	var state service.MaintenanceState
+	if err := json.NewDecoder(resp.Body).Decode(&state); err != nil {
+		fmt.Fprintln(os.Stderr, "invalid response:", err)
+		return 1
+	}
+
+	if !state.Enabled {
+		fmt.Printf("%s: serving normally\n", state.Service)
+		return 0
+	}
+	fmt.Printf("%s: in maintenance\n", state.Service)
+	if state.Message != "" {
+		fmt.Printf("  message: %s\n", state.Message)
+	}
+	if len(state.Allow) > 0 {
+		fmt.Printf("  allowed: %s\n", strings.Join(state.Allow, ", "))
+	}
+	return 0
+}
+
+// adminURL turns a listen address such as ":9090" into a base URL
+func adminURL(addr string) string {
+	if strings.Contains(addr, "://") {
+		return strings.TrimSuffix(addr, "/")
+	}
+	if strings.HasPrefix(addr, ":") {
+		addr = "127.0.0.1" + addr
+	}
+	return "http://" + addr
+}
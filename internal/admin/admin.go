@@ -0,0 +1,114 @@
+package admin
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/jasonwu/dovetail/internal/metrics"
+)
+
+// Server is the local HTTP server for operational endpoints such as
+// metrics. It listens on the host network, not the tailnet.
+type Server struct {
+	mux        *http.ServeMux
+	httpServer *http.Server
+	listener   net.Listener
+	logger     *slog.Logger
+	done       chan struct{}
+}
+
+func New(addr string, logger *slog.Logger) *Server {
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", metrics.Default.Handler())
+
+	return &Server{
+		mux: mux,
+		httpServer: &http.Server{
+			Addr:              addr,
+			Handler:           mux,
+			ReadHeaderTimeout: 10 * time.Second,
+		},
+		logger: logger.With("component", "admin"),
+		done:   make(chan struct{}),
+	}
+}
+
+// Handle registers an additional handler on the admin server
+func (s *Server) Handle(pattern string, handler http.Handler) {
+	s.mux.Handle(pattern, handler)
+}
+
+func (s *Server) Handler() http.Handler {
+	return s.mux
+}
+
+func (s *Server) Start() error {
+	ln, err := net.Listen("tcp", s.httpServer.Addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", s.httpServer.Addr, err)
+	}
+	s.listener = ln
+
+	go func() {
+		defer close(s.done)
+		if err := s.httpServer.Serve(ln); err != nil && err != http.ErrServerClosed {
+			s.logger.Error("admin server error", "error", err)
+		}
+	}()
+
+	s.logger.Info("admin server started", "addr", ln.Addr().String())
+	return nil
+}
+
+// Addr returns the address the server is listening on once started
+func (s *Server) Addr() string {
+	if s.listener == nil {
+		return s.httpServer.Addr
+	}
+	return s.listener.Addr().String()
+}
+
+func (s *Server) Shutdown(ctx context.Context) error {
+	if s.listener == nil {
+		return nil
+	}
+	if err := s.httpServer.Shutdown(ctx); err != nil {
+		return fmt.Errorf("failed to shut down admin server: %w", err)
+	}
+	<-s.done
+	return nil
+}
+
+// IsLoopback reports whether a listen address such as "127.0.0.1:9090"
+// only accepts connections from the host itself. Addresses without a host,
+// such as ":9090", listen on every interface.
+func IsLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil || host == "" {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// RequireToken rejects requests that don't carry
+// "Authorization: Bearer <token>" with 401
+func RequireToken(token string, next http.Handler) http.Handler {
+	want := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), want) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="dovetail"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -2,18 +2,96 @@ package config
 
 import (
 	"fmt"
+	"math"
 	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
 )
 
 const (
 	DefaultStateDir = "/var/lib/dovetail"
+
+	DefaultReadHeaderTimeout = 10 * time.Second
+	DefaultReadTimeout       = 30 * time.Second
+	DefaultWriteTimeout      = 30 * time.Second
+	DefaultIdleTimeout       = 120 * time.Second
+
+	DefaultWhoIsCacheTTL = 10 * time.Second
+
+	DefaultMaxHeaderBytes = 1 << 20
+
+	// MaxHeaderBytesLimit caps the request header limit. Headers are held
+	// in memory, so anything larger is a mistake.
+	MaxHeaderBytesLimit = 64 << 20
+
+	DefaultSecurityHeaders = "off"
 )
 
 type Config struct {
 	AuthKey  string
 	StateDir string
+
+	// AdminAddr is the listen address of the local admin server (metrics,
+	// the identity key set and the maintenance API). Empty disables it.
+	AdminAddr string
+
+	// AdminToken is the bearer token the maintenance API requires. Without
+	// it, the API is only served when AdminAddr is a loopback address.
+	AdminToken string
+
+	// ErrorPagesDir optionally holds "<status>.html" or "error.html"
+	// templates overriding the built-in error pages.
+	ErrorPagesDir string
+
+	// Default HTTP server timeouts for services. Zero means unlimited.
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+
+	// Default request size limits for services. Zero MaxBodySize means
+	// unlimited.
+	MaxBodySize    int64
+	MaxHeaderBytes int64
+
+	// WhoIsCacheTTL is how long caller identities are cached. Zero
+	// disables the cache.
+	WhoIsCacheTTL time.Duration
+
+	// SecurityHeaders is the default security header profile: off, basic
+	// or strict
+	SecurityHeaders string
+
+	// LegacyIdentityHeaders keeps the original X-Tailscale-Login and
+	// X-Tailscale-Tailnet values for services without a label override
+	LegacyIdentityHeaders bool
+
+	// OIDCHostname is the tailnet hostname of the built-in OpenID Connect
+	// provider. Empty disables it.
+	OIDCHostname string
+
+	// OIDCClientsFile is a JSON file registering the provider's clients
+	OIDCClientsFile string
+
+	// LabelPrefix replaces "dovetail" in container label names, and
+	// Instance limits dovetail to containers whose instance label matches.
+	// Both let several dovetails share a Docker host.
+	LabelPrefix string
+	Instance    string
+
+	// HostAddress is where host-networked containers and published ports
+	// are reached. Empty uses the gateway of Docker's bridge network.
+	HostAddress string
+
+	// ServicesFile is a JSON file of services that don't come from
+	// containers, such as redirects and static pages
+	ServicesFile string
 }
 
+var labelPrefix = regexp.MustCompile(`^[a-z0-9]([a-z0-9.-]*[a-z0-9])?$`)
+
 func Load() (*Config, error) {
 	authKey := os.Getenv("TS_AUTHKEY")
 	if authKey == "" {
@@ -25,8 +103,154 @@ func Load() (*Config, error) {
 		stateDir = DefaultStateDir
 	}
 
-	return &Config{
-		AuthKey:  authKey,
-		StateDir: stateDir,
-	}, nil
+	cfg := &Config{
+		AuthKey:    authKey,
+		StateDir:   stateDir,
+		AdminAddr:  os.Getenv("DOVETAIL_ADMIN_ADDR"),
+		AdminToken: os.Getenv("DOVETAIL_ADMIN_TOKEN"),
+
+		ErrorPagesDir: os.Getenv("DOVETAIL_ERROR_PAGES_DIR"),
+
+		SecurityHeaders: os.Getenv("DOVETAIL_SECURITY_HEADERS"),
+
+		OIDCHostname:    os.Getenv("DOVETAIL_OIDC_HOSTNAME"),
+		OIDCClientsFile: os.Getenv("DOVETAIL_OIDC_CLIENTS"),
+
+		LabelPrefix:  os.Getenv("DOVETAIL_LABEL_PREFIX"),
+		Instance:     os.Getenv("DOVETAIL_INSTANCE"),
+		HostAddress:  os.Getenv("DOVETAIL_HOST_ADDRESS"),
+		ServicesFile: os.Getenv("DOVETAIL_SERVICES_FILE"),
+	}
+
+	switch cfg.SecurityHeaders {
+	case "":
+		cfg.SecurityHeaders = DefaultSecurityHeaders
+	case "off", "basic", "strict":
+	default:
+		return nil, fmt.Errorf("invalid DOVETAIL_SECURITY_HEADERS %q: must be off, basic or strict", cfg.SecurityHeaders)
+	}
+
+	if cfg.LabelPrefix != "" && !labelPrefix.MatchString(cfg.LabelPrefix) {
+		return nil, fmt.Errorf("invalid DOVETAIL_LABEL_PREFIX %q: must be lowercase letters, digits, dots and dashes", cfg.LabelPrefix)
+	}
+
+	if cfg.OIDCHostname != "" && cfg.OIDCClientsFile == "" {
+		return nil, fmt.Errorf("DOVETAIL_OIDC_CLIENTS is required when DOVETAIL_OIDC_HOSTNAME is set")
+	}
+
+	var err error
+	if cfg.ReadHeaderTimeout, err = durationEnv("DOVETAIL_READ_HEADER_TIMEOUT", DefaultReadHeaderTimeout); err != nil {
+		return nil, err
+	}
+	if cfg.ReadTimeout, err = durationEnv("DOVETAIL_READ_TIMEOUT", DefaultReadTimeout); err != nil {
+		return nil, err
+	}
+	if cfg.WriteTimeout, err = durationEnv("DOVETAIL_WRITE_TIMEOUT", DefaultWriteTimeout); err != nil {
+		return nil, err
+	}
+	if cfg.IdleTimeout, err = durationEnv("DOVETAIL_IDLE_TIMEOUT", DefaultIdleTimeout); err != nil {
+		return nil, err
+	}
+	if cfg.WhoIsCacheTTL, err = durationEnv("DOVETAIL_WHOIS_CACHE_TTL", DefaultWhoIsCacheTTL); err != nil {
+		return nil, err
+	}
+	if cfg.MaxBodySize, err = sizeEnv("DOVETAIL_MAX_BODY_SIZE", 0); err != nil {
+		return nil, err
+	}
+	if cfg.MaxHeaderBytes, err = sizeEnv("DOVETAIL_MAX_HEADER_BYTES", DefaultMaxHeaderBytes); err != nil {
+		return nil, err
+	}
+	if cfg.MaxHeaderBytes > MaxHeaderBytesLimit {
+		return nil, fmt.Errorf("invalid DOVETAIL_MAX_HEADER_BYTES: must be at most %dMB", MaxHeaderBytesLimit>>20)
+	}
+	if cfg.LegacyIdentityHeaders, err = boolEnv("DOVETAIL_LEGACY_IDENTITY_HEADERS"); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// durationEnv reads a non-negative duration such as "90s" from the
+// environment. A bare "0" disables the timeout.
+func durationEnv(key string, def time.Duration) (time.Duration, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return def, nil
+	}
+
+	d, err := ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %w", key, err)
+	}
+	return d, nil
+}
+
+// sizeEnv reads a byte size such as "10MB" from the environment
+func sizeEnv(key string, def int64) (int64, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return def, nil
+	}
+
+	n, err := ParseSize(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %w", key, err)
+	}
+	return n, nil
+}
+
+// boolEnv reads an optional boolean such as "true" or "1" from the
+// environment
+func boolEnv(key string) (bool, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return false, nil
+	}
+
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s: %w", key, err)
+	}
+	return b, nil
+}
+
+// ParseDuration parses a non-negative duration, where "0" means unlimited
+func ParseDuration(value string) (time.Duration, error) {
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, err
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("duration %q must not be negative", value)
+	}
+	return d, nil
+}
+
+// ParseSize parses a byte size such as "512KB", "64MB" or "1GB". Units are
+// powers of 1024 and a bare number is bytes.
+func ParseSize(s string) (int64, error) {
+	value := strings.ToUpper(strings.TrimSpace(s))
+	multiplier := int64(1)
+	for _, unit := range []struct {
+		suffix     string
+		multiplier int64
+	}{
+		{"GIB", 1 << 30}, {"MIB", 1 << 20}, {"KIB", 1 << 10},
+		{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10},
+		{"G", 1 << 30}, {"M", 1 << 20}, {"K", 1 << 10}, {"B", 1},
+	} {
+		if n, ok := strings.CutSuffix(value, unit.suffix); ok {
+			value, multiplier = strings.TrimSpace(n), unit.multiplier
+			break
+		}
+	}
+
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	if n > math.MaxInt64/multiplier {
+		return 0, fmt.Errorf("invalid size %q: too large", s)
+	}
+	return n * multiplier, nil
 }
@@ -2,7 +2,9 @@ package config
 
 import (
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 )
 
 func TestLoad(t *testing.T) {
@@ -70,3 +72,305 @@ func TestLoad(t *testing.T) {
 		})
 	}
 }
+
+func TestLoad_AdminAddr(t *testing.T) {
+	t.Setenv("TS_AUTHKEY", "tskey-auth-xxx")
+	t.Setenv("DOVETAIL_ADMIN_ADDR", ":9090")
+	t.Setenv("DOVETAIL_ADMIN_TOKEN", "s3cret")
+
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if cfg.AdminAddr != ":9090" {
+		t.Errorf("AdminAddr = %q, want %q", cfg.AdminAddr, ":9090")
+	}
+	if cfg.AdminToken != "s3cret" {
+		t.Errorf("AdminToken = %q, want %q", cfg.AdminToken, "s3cret")
+	}
+}
+
+func TestLoad_Timeouts(t *testing.T) {
+	t.Run("defaults", func(t *testing.T) {
+		t.Setenv("TS_AUTHKEY", "tskey-auth-xxx")
+
+		cfg, err := Load()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if cfg.ReadHeaderTimeout != DefaultReadHeaderTimeout {
+			t.Errorf("ReadHeaderTimeout = %v, want %v", cfg.ReadHeaderTimeout, DefaultReadHeaderTimeout)
+		}
+		if cfg.ReadTimeout != DefaultReadTimeout {
+			t.Errorf("ReadTimeout = %v, want %v", cfg.ReadTimeout, DefaultReadTimeout)
+		}
+		if cfg.WriteTimeout != DefaultWriteTimeout {
+			t.Errorf("WriteTimeout = %v, want %v", cfg.WriteTimeout, DefaultWriteTimeout)
+		}
+		if cfg.IdleTimeout != DefaultIdleTimeout {
+			t.Errorf("IdleTimeout = %v, want %v", cfg.IdleTimeout, DefaultIdleTimeout)
+		}
+		if cfg.WhoIsCacheTTL != DefaultWhoIsCacheTTL {
+			t.Errorf("WhoIsCacheTTL = %v, want %v", cfg.WhoIsCacheTTL, DefaultWhoIsCacheTTL)
+		}
+	})
+
+	t.Run("overrides with zero meaning unlimited", func(t *testing.T) {
+		t.Setenv("TS_AUTHKEY", "tskey-auth-xxx")
+		t.Setenv("DOVETAIL_READ_TIMEOUT", "5m")
+		t.Setenv("DOVETAIL_WRITE_TIMEOUT", "0")
+		t.Setenv("DOVETAIL_WHOIS_CACHE_TTL", "0")
+
+		cfg, err := Load()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if cfg.ReadTimeout != 5*time.Minute {
+			t.Errorf("ReadTimeout = %v, want %v", cfg.ReadTimeout, 5*time.Minute)
+		}
+		if cfg.WriteTimeout != 0 {
+			t.Errorf("WriteTimeout = %v, want 0", cfg.WriteTimeout)
+		}
+		if cfg.WhoIsCacheTTL != 0 {
+			t.Errorf("WhoIsCacheTTL = %v, want 0", cfg.WhoIsCacheTTL)
+		}
+	})
+
+	t.Run("invalid duration", func(t *testing.T) {
+		t.Setenv("TS_AUTHKEY", "tskey-auth-xxx")
+		t.Setenv("DOVETAIL_IDLE_TIMEOUT", "forever")
+
+		if _, err := Load(); err == nil {
+			t.Error("expected error but got nil")
+		}
+	})
+
+	t.Run("negative duration", func(t *testing.T) {
+		t.Setenv("TS_AUTHKEY", "tskey-auth-xxx")
+		t.Setenv("DOVETAIL_READ_TIMEOUT", "-1s")
+
+		if _, err := Load(); err == nil {
+			t.Error("expected error but got nil")
+		}
+	})
+}
+
+func TestLoad_OIDC(t *testing.T) {
+	t.Run("hostname requires clients file", func(t *testing.T) {
+		t.Setenv("TS_AUTHKEY", "tskey-auth-xxx")
+		t.Setenv("DOVETAIL_OIDC_HOSTNAME", "idp")
+
+		if _, err := Load(); err == nil {
+			t.Error("expected error but got nil")
+		}
+	})
+
+	t.Run("enabled", func(t *testing.T) {
+		t.Setenv("TS_AUTHKEY", "tskey-auth-xxx")
+		t.Setenv("DOVETAIL_OIDC_HOSTNAME", "idp")
+		t.Setenv("DOVETAIL_OIDC_CLIENTS", "/etc/dovetail/oidc.json")
+
+		cfg, err := Load()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if cfg.OIDCHostname != "idp" || cfg.OIDCClientsFile != "/etc/dovetail/oidc.json" {
+			t.Errorf("unexpected OIDC config: %q %q", cfg.OIDCHostname, cfg.OIDCClientsFile)
+		}
+	})
+}
+
+func TestLoad_LegacyIdentityHeaders(t *testing.T) {
+	t.Setenv("TS_AUTHKEY", "tskey-auth-xxx")
+	t.Setenv("DOVETAIL_LEGACY_IDENTITY_HEADERS", "true")
+
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !cfg.LegacyIdentityHeaders {
+		t.Error("LegacyIdentityHeaders = false, want true")
+	}
+
+	t.Setenv("DOVETAIL_LEGACY_IDENTITY_HEADERS", "maybe")
+	if _, err := Load(); err == nil {
+		t.Error("expected error for invalid boolean")
+	}
+}
+
+func TestLoad_SecurityHeaders(t *testing.T) {
+	t.Setenv("TS_AUTHKEY", "tskey-auth-xxx")
+
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.SecurityHeaders != DefaultSecurityHeaders {
+		t.Errorf("SecurityHeaders = %q, want %q", cfg.SecurityHeaders, DefaultSecurityHeaders)
+	}
+
+	t.Setenv("DOVETAIL_SECURITY_HEADERS", "strict")
+	cfg, err = Load()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.SecurityHeaders != "strict" {
+		t.Errorf("SecurityHeaders = %q, want %q", cfg.SecurityHeaders, "strict")
+	}
+
+	t.Setenv("DOVETAIL_SECURITY_HEADERS", "paranoid")
+	if _, err := Load(); err == nil {
+		t.Error("expected error for unknown profile")
+	}
+}
+
+func TestLoad_LabelPrefix(t *testing.T) {
+	t.Setenv("TS_AUTHKEY", "tskey-auth-xxx")
+	t.Setenv("DOVETAIL_LABEL_PREFIX", "dovetail-work")
+	t.Setenv("DOVETAIL_INSTANCE", "work")
+
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.LabelPrefix != "dovetail-work" || cfg.Instance != "work" {
+		t.Errorf("LabelPrefix, Instance = %q, %q, want %q, %q", cfg.LabelPrefix, cfg.Instance, "dovetail-work", "work")
+	}
+
+	for _, prefix := range []string{"Work", "work.", "-work", "work_labels"} {
+		t.Setenv("DOVETAIL_LABEL_PREFIX", prefix)
+		if _, err := Load(); err == nil {
+			t.Errorf("expected error for prefix %q", prefix)
+		}
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    int64
+		wantErr bool
+	}{
+		{"0", 0, false},
+		{"512", 512, false},
+		{"512B", 512, false},
+		{"64KB", 64 << 10, false},
+		{"64mb", 64 << 20, false},
+		{"2 GiB", 2 << 30, false},
+		{"1G", 1 << 30, false},
+		{"", 0, true},
+		{"-1MB", 0, true},
+		{"1.5GB", 0, true},
+		{"lots", 0, true},
+		{"9999999999GB", 0, true},
+		{"8589934592GiB", 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := ParseSize(tt.value)
+			if tt.wantErr {
+				if err == nil {
+					t.Error("expected error but got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("ParseSize(%q) = %d, want %d", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoad_SizeLimits(t *testing.T) {
+	t.Setenv("TS_AUTHKEY", "tskey-auth-xxx")
+
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.MaxBodySize != 0 || cfg.MaxHeaderBytes != DefaultMaxHeaderBytes {
+		t.Errorf("defaults = %d, %d, want 0, %d", cfg.MaxBodySize, cfg.MaxHeaderBytes, DefaultMaxHeaderBytes)
+	}
+
+	t.Setenv("DOVETAIL_MAX_BODY_SIZE", "10MB")
+	t.Setenv("DOVETAIL_MAX_HEADER_BYTES", "64KB")
+	cfg, err = Load()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.MaxBodySize != 10<<20 || cfg.MaxHeaderBytes != 64<<10 {
+		t.Errorf("limits = %d, %d, want %d, %d", cfg.MaxBodySize, cfg.MaxHeaderBytes, 10<<20, 64<<10)
+	}
+
+	t.Setenv("DOVETAIL_MAX_HEADER_BYTES", "8GB")
+	if _, err := Load(); err == nil {
+		t.Error("expected error for a header limit above MaxHeaderBytesLimit")
+	}
+
+	t.Setenv("DOVETAIL_MAX_HEADER_BYTES", "")
+	t.Setenv("DOVETAIL_MAX_BODY_SIZE", "huge")
+	if _, err := Load(); err == nil {
+		t.Error("expected error for invalid size")
+	}
+}
+
+func TestLoadServices(t *testing.T) {
+	dir := t.TempDir()
+	write := func(content string) string {
+		path := filepath.Join(dir, "services.json")
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	services, err := LoadServices(write(`{"services": [
+		{"name": "nas", "target": "http://192.168.1.10:5000"},
+		{"name": "docs", "kind": "redirect", "redirect_to": "https://wiki.example.com", "preserve_path": true},
+		{"name": "status", "kind": "static", "root": "` + dir + `", "http": "redirect"},
+		{"name": "portainer", "socket": "/run/portainer.sock"}
+	]}`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(services) != 4 {
+		t.Fatalf("len(services) = %d, want 4", len(services))
+	}
+	if services[0].Kind != KindProxy || services[0].HTTP != "off" {
+		t.Errorf("nas = %+v, want proxy kind and http off", services[0])
+	}
+	if services[1].RedirectStatus != DefaultRedirectStatus || !services[1].PreservePath {
+		t.Errorf("docs = %+v, want default status and preserved path", services[1])
+	}
+	if services[2].HTTP != "redirect" {
+		t.Errorf("status HTTP = %q, want redirect", services[2].HTTP)
+	}
+	if services[3].Target != "http://localhost" {
+		t.Errorf("portainer Target = %q, want http://localhost", services[3].Target)
+	}
+
+	invalid := []string{
+		`{"services": [{"name": "Bad_Name", "target": "http://a"}]}`,
+		`{"services": [{"name": "a", "target": "http://a"}, {"name": "a", "target": "http://b"}]}`,
+		`{"services": [{"name": "a", "target": "ftp://a"}]}`,
+		`{"services": [{"name": "a", "kind": "redirect", "redirect_to": "/relative"}]}`,
+		`{"services": [{"name": "a", "kind": "redirect", "redirect_to": "https://a", "redirect_status": 200}]}`,
+		`{"services": [{"name": "a", "kind": "static", "root": "` + filepath.Join(dir, "missing") + `"}]}`,
+		`{"services": [{"name": "a", "kind": "lambda"}]}`,
+		`{"services": [{"name": "a", "socket": "relative.sock"}]}`,
+		`{"services": [{"name": "a", "target": "http://a", "http": "maybe"}]}`,
+		`not json`,
+	}
+	for _, content := range invalid {
+		if _, err := LoadServices(write(content)); err == nil {
+			t.Errorf("expected error for %s", content)
+		}
+	}
+}
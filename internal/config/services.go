@@ -0,0 +1,147 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+)
+
+// Kinds of statically configured services
+const (
+	KindProxy    = "proxy"
+	KindRedirect = "redirect"
+	KindStatic   = "static"
+)
+
+// DefaultRedirectStatus is used by redirect services without a status
+const DefaultRedirectStatus = http.StatusFound
+
+// StaticService is a service defined in the services file rather than by
+// container labels
+type StaticService struct {
+	Name string `json:"name"`
+
+	// Kind is KindProxy (the default), KindRedirect or KindStatic
+	Kind string `json:"kind,omitempty"`
+
+	// Target is the upstream URL of a proxy service, e.g.
+	// "http://192.168.1.10:5000"
+	Target string `json:"target,omitempty"`
+
+	// Socket is the path of a Unix socket a proxy service connects to
+	// instead of the target's address. Target then only sets the scheme
+	// and defaults to http.
+	Socket string `json:"socket,omitempty"`
+
+	// RedirectTo is where a redirect service sends clients, with
+	// RedirectStatus. PreservePath appends the request path and query.
+	RedirectTo     string `json:"redirect_to,omitempty"`
+	RedirectStatus int    `json:"redirect_status,omitempty"`
+	PreservePath   bool   `json:"preserve_path,omitempty"`
+
+	// Root is the directory or single file a static service serves
+	Root string `json:"root,omitempty"`
+
+	// HTTP is the plain HTTP listener mode: off, redirect or serve
+	HTTP string `json:"http,omitempty"`
+
+	// Funnel exposes the service to the public internet
+	Funnel bool `json:"funnel,omitempty"`
+}
+
+type servicesFile struct {
+	Services []StaticService `json:"services"`
+}
+
+var serviceName = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+// LoadServices reads service definitions from a JSON file of the form
+// {"services": [{"name": "docs", "kind": "redirect", "redirect_to": "..."}]}
+// and fills in defaults
+func LoadServices(path string) ([]StaticService, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read services file: %w", err)
+	}
+
+	var f servicesFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("failed to parse services file: %w", err)
+	}
+
+	seen := make(map[string]bool)
+	for i := range f.Services {
+		svc := &f.Services[i]
+		if !serviceName.MatchString(svc.Name) {
+			return nil, fmt.Errorf("service %q: name must be a valid hostname label", svc.Name)
+		}
+		if seen[svc.Name] {
+			return nil, fmt.Errorf("duplicate service %q", svc.Name)
+		}
+		seen[svc.Name] = true
+
+		if err := svc.validate(); err != nil {
+			return nil, fmt.Errorf("service %q: %w", svc.Name, err)
+		}
+	}
+
+	return f.Services, nil
+}
+
+func (s *StaticService) validate() error {
+	switch s.HTTP {
+	case "":
+		s.HTTP = "off"
+	case "off", "redirect", "serve":
+	default:
+		return fmt.Errorf("invalid http %q: must be off, redirect or serve", s.HTTP)
+	}
+
+	switch s.Kind {
+	case "", KindProxy:
+		s.Kind = KindProxy
+		if s.Socket != "" {
+			if !filepath.IsAbs(s.Socket) {
+				return fmt.Errorf("invalid socket %q: must be an absolute path", s.Socket)
+			}
+			if s.Target == "" {
+				s.Target = "http://localhost"
+			}
+		}
+		u, err := url.Parse(s.Target)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid target %q: must be an http or https URL", s.Target)
+		}
+
+	case KindRedirect:
+		u, err := url.Parse(s.RedirectTo)
+		if err != nil || !u.IsAbs() {
+			return fmt.Errorf("invalid redirect_to %q: must be an absolute URL", s.RedirectTo)
+		}
+		switch s.RedirectStatus {
+		case 0:
+			s.RedirectStatus = DefaultRedirectStatus
+		case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+			http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		default:
+			return fmt.Errorf("invalid redirect_status %d: must be 301, 302, 303, 307 or 308", s.RedirectStatus)
+		}
+
+	case KindStatic:
+		if s.Root == "" {
+			return fmt.Errorf("static services need a root")
+		}
+		if _, err := os.Stat(s.Root); err != nil {
+			return fmt.Errorf("invalid root: %w", err)
+		}
+
+	default:
+		return fmt.Errorf("invalid kind %q: must be proxy, redirect or static", s.Kind)
+	}
+
+	return nil
+}
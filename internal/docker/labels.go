@@ -0,0 +1,478 @@
+package docker
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jasonwu/dovetail/internal/config"
+)
+
+// parseUpstreamLabels reads the optional labels describing how to connect to
+// the container and stores them on cfg.
+func parseUpstreamLabels(labels map[string]string, cfg *ServiceConfig) error {
+	cfg.Scheme = "http"
+	if scheme, ok := labels[LabelScheme]; ok && scheme != "" {
+		scheme = strings.ToLower(scheme)
+		if scheme != "http" && scheme != "https" {
+			return invalidLabel(LabelScheme, "value %q: must be http or https", scheme)
+		}
+		cfg.Scheme = scheme
+	}
+
+	cfg.Protocol = "http"
+	if protocol, ok := labels[LabelProtocol]; ok && protocol != "" {
+		protocol = strings.ToLower(protocol)
+		switch protocol {
+		case "http", "h2c", "grpc":
+		default:
+			return invalidLabel(LabelProtocol, "value %q: must be http, h2c or grpc", protocol)
+		}
+		cfg.Protocol = protocol
+	}
+
+	skipVerify, err := parseBoolLabel(labels, LabelTLSInsecureSkipVerify)
+	if err != nil {
+		return err
+	}
+	cfg.TLSInsecureSkipVerify = skipVerify
+	cfg.TLSCAFile = labels[LabelTLSCAFile]
+	cfg.TLSServerName = labels[LabelTLSServerName]
+
+	preserveHost, err := parseBoolLabel(labels, LabelPreserveHost)
+	if err != nil {
+		return err
+	}
+	cfg.PreserveHost = preserveHost
+
+	compression, err := parseCompressLabel(labels)
+	if err != nil {
+		return err
+	}
+	cfg.Compression = compression
+
+	return nil
+}
+
+// parseCompressLabel reads the response compression setting, either a
+// boolean or a comma-separated list of encodings such as "br,gzip"
+func parseCompressLabel(labels map[string]string) ([]string, error) {
+	value := strings.ToLower(strings.TrimSpace(labels[LabelCompress]))
+	if value == "" {
+		return nil, nil
+	}
+
+	if enabled, err := strconv.ParseBool(value); err == nil {
+		if !enabled {
+			return nil, nil
+		}
+		return []string{"zstd", "br", "gzip"}, nil
+	}
+
+	var encodings []string
+	for _, enc := range strings.Split(value, ",") {
+		enc = strings.TrimSpace(enc)
+		switch enc {
+		case "zstd", "br", "gzip":
+		default:
+			return nil, invalidLabel(LabelCompress, "value %q: must be true, false or a list of zstd, br and gzip", value)
+		}
+		encodings = append(encodings, enc)
+	}
+	return encodings, nil
+}
+
+// parseCacheLabels reads the response cache switch and size limits
+func parseCacheLabels(labels map[string]string, cfg *ServiceConfig) error {
+	enabled, err := parseBoolLabel(labels, LabelCache)
+	if err != nil || !enabled {
+		return err
+	}
+	cfg.Cache = true
+
+	for key, size := range map[string]*int64{
+		LabelCacheMemory: &cfg.CacheMemory,
+		LabelCacheDisk:   &cfg.CacheDisk,
+	} {
+		value, ok := labels[key]
+		if !ok || value == "" {
+			continue
+		}
+		n, err := config.ParseSize(value)
+		if err != nil {
+			return invalidLabel(key, "value %q: expected a size such as 64MB", value)
+		}
+		*size = n
+	}
+	return nil
+}
+
+// parseMaintenanceLabels reads whether the service starts in maintenance
+// mode, its message and who may still use it
+func parseMaintenanceLabels(labels map[string]string, cfg *ServiceConfig) error {
+	maintenance, err := parseBoolLabel(labels, LabelMaintenance)
+	if err != nil {
+		return err
+	}
+	cfg.Maintenance = maintenance
+	cfg.MaintenanceMessage = labels[LabelMaintenanceMessage]
+
+	cfg.MaintenanceAllow = nil
+	for _, entry := range strings.Split(labels[LabelMaintenanceAllow], ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			cfg.MaintenanceAllow = append(cfg.MaintenanceAllow, entry)
+		}
+	}
+
+	return nil
+}
+
+// parseLimitLabels reads per-service request size limit overrides
+func parseLimitLabels(labels map[string]string, cfg *ServiceConfig) error {
+	limits := []struct {
+		label string
+		dst   **int64
+		max   int64
+	}{
+		{LabelMaxBodySize, &cfg.MaxBodySize, 0},
+		{LabelMaxHeaderBytes, &cfg.MaxHeaderBytes, config.MaxHeaderBytesLimit},
+	}
+
+	for _, l := range limits {
+		value, ok := labels[l.label]
+		if !ok || value == "" {
+			continue
+		}
+
+		n, err := config.ParseSize(value)
+		if err != nil {
+			return invalidLabel(l.label, "value %q: expected a size such as 10MB", value)
+		}
+		if l.max > 0 && n > l.max {
+			return invalidLabel(l.label, "value %q: must be at most %dMB", value, l.max>>20)
+		}
+		*l.dst = &n
+	}
+
+	return nil
+}
+
+// MaxRetryAttempts bounds dovetail.retry.attempts. More retries only
+// prolong the wait for a container that isn't coming back.
+const MaxRetryAttempts = 10
+
+// parseRetryLabels reads the upstream retry and circuit breaker settings
+func parseRetryLabels(labels map[string]string, cfg *ServiceConfig) error {
+	for key, dst := range map[string]*int{
+		LabelRetryAttempts:   &cfg.RetryAttempts,
+		LabelBreakerFailures: &cfg.BreakerFailures,
+	} {
+		value, ok := labels[key]
+		if !ok || value == "" {
+			continue
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return invalidLabel(key, "value %q: must be a non-negative integer", value)
+		}
+		if key == LabelRetryAttempts && n > MaxRetryAttempts {
+			return invalidLabel(key, "value %q: must be at most %d", value, MaxRetryAttempts)
+		}
+		*dst = n
+	}
+
+	for key, dst := range map[string]*time.Duration{
+		LabelRetryBackoff:    &cfg.RetryBackoff,
+		LabelBreakerCooldown: &cfg.BreakerCooldown,
+	} {
+		value, ok := labels[key]
+		if !ok || value == "" {
+			continue
+		}
+		d, err := config.ParseDuration(value)
+		if err != nil {
+			return invalidLabel(key, "value %q: %w", value, err)
+		}
+		*dst = d
+	}
+
+	if value, ok := labels[LabelRetryMaxBody]; ok && value != "" {
+		n, err := config.ParseSize(value)
+		if err != nil {
+			return invalidLabel(LabelRetryMaxBody, "value %q: expected a size such as 1MB", value)
+		}
+		cfg.RetryMaxBody = n
+	}
+
+	return nil
+}
+
+// parseListenerLabels reads labels controlling how the service is exposed
+// on the tailnet
+func parseListenerLabels(labels map[string]string, cfg *ServiceConfig) error {
+	cfg.HTTP = "off"
+	if mode, ok := labels[LabelHTTP]; ok && mode != "" {
+		mode = strings.ToLower(mode)
+		switch mode {
+		case "off", "redirect", "serve":
+		default:
+			return invalidLabel(LabelHTTP, "value %q: must be off, redirect or serve", mode)
+		}
+		cfg.HTTP = mode
+	}
+
+	funnel, err := parseBoolLabel(labels, LabelFunnel)
+	if err != nil {
+		return err
+	}
+	cfg.Funnel = funnel
+
+	cfg.FunnelPaths = nil
+	for _, p := range strings.Split(labels[LabelFunnelPaths], ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		if !strings.HasPrefix(p, "/") {
+			return invalidLabel(LabelFunnelPaths, "entry %q: must start with /", p)
+		}
+		cfg.FunnelPaths = append(cfg.FunnelPaths, p)
+	}
+
+	return nil
+}
+
+// parseIdentityLabels reads how the caller's identity is passed upstream
+func parseIdentityLabels(labels map[string]string, cfg *ServiceConfig) error {
+	jwt, err := parseBoolLabel(labels, LabelIdentityJWT)
+	if err != nil {
+		return err
+	}
+	cfg.IdentityJWT = jwt
+
+	if preset, ok := labels[LabelHeadersPreset]; ok && preset != "" {
+		preset = strings.ToLower(preset)
+		switch preset {
+		case "grafana", "authelia", "oauth2-proxy":
+		default:
+			return invalidLabel(LabelHeadersPreset, "value %q: must be grafana, authelia or oauth2-proxy", preset)
+		}
+		cfg.HeadersPreset = preset
+	}
+
+	cfg.HeadersLegacy = nil
+	if _, ok := labels[LabelHeadersLegacy]; ok {
+		legacy, err := parseBoolLabel(labels, LabelHeadersLegacy)
+		if err != nil {
+			return err
+		}
+		cfg.HeadersLegacy = &legacy
+	}
+
+	cfg.HeadersMap = nil
+	for key, field := range labels {
+		header, ok := strings.CutPrefix(key, LabelHeadersMapPrefix)
+		if !ok {
+			continue
+		}
+		if !validHeaderName(header) {
+			return invalidLabel(key, "header name %q", header)
+		}
+
+		field = strings.ToLower(strings.TrimSpace(field))
+		switch field {
+		case "login", "name", "email", "node", "tags":
+		default:
+			return invalidLabel(key, "value %q: must be login, name, email, node or tags", field)
+		}
+
+		if cfg.HeadersMap == nil {
+			cfg.HeadersMap = make(map[string]string)
+		}
+		cfg.HeadersMap[header] = field
+	}
+
+	return nil
+}
+
+// parseHeaderRuleLabels reads header edits such as
+// "dovetail.headers.response.set.Strict-Transport-Security=max-age=63072000"
+// and the security header profile
+func parseHeaderRuleLabels(labels map[string]string, cfg *ServiceConfig) error {
+	cfg.SecurityHeaders = ""
+	if profile, ok := labels[LabelHeadersSecurity]; ok && profile != "" {
+		profile = strings.ToLower(profile)
+		switch profile {
+		case "off", "basic", "strict":
+		default:
+			return invalidLabel(LabelHeadersSecurity, "value %q: must be off, basic or strict", profile)
+		}
+		cfg.SecurityHeaders = profile
+	}
+
+	cfg.RequestHeaders = HeaderRules{}
+	cfg.ResponseHeaders = HeaderRules{}
+	for key, value := range labels {
+		var rules *HeaderRules
+		rest, ok := strings.CutPrefix(key, LabelHeadersRequestPrefix)
+		if ok {
+			rules = &cfg.RequestHeaders
+		} else if rest, ok = strings.CutPrefix(key, LabelHeadersResponsePrefix); ok {
+			rules = &cfg.ResponseHeaders
+		} else {
+			continue
+		}
+
+		op, header, _ := strings.Cut(rest, ".")
+		if !validHeaderName(header) {
+			return invalidLabel(key, "header name %q", header)
+		}
+
+		switch op {
+		case "set":
+			if rules.Set == nil {
+				rules.Set = make(map[string]string)
+			}
+			rules.Set[header] = value
+		case "add":
+			if rules.Add == nil {
+				rules.Add = make(map[string]string)
+			}
+			rules.Add[header] = value
+		case "remove":
+			remove, err := parseBoolLabel(labels, key)
+			if err != nil {
+				return err
+			}
+			if remove {
+				rules.Remove = append(rules.Remove, header)
+			}
+		default:
+			return invalidLabel(key, "operation %q: must be set, add or remove", op)
+		}
+	}
+
+	return nil
+}
+
+// validHeaderName reports whether name is a non-empty HTTP token
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, r := range name {
+		if r > 0x7e || r <= ' ' || strings.ContainsRune(`"(),/:;<=>?@[\]{}`, r) {
+			return false
+		}
+	}
+	return true
+}
+
+// parseRateLimitLabels reads the per-identity rate limit, written as
+// "<requests>/<unit>" where unit is s, m or h (e.g. "100/m")
+func parseRateLimitLabels(labels map[string]string, cfg *ServiceConfig) error {
+	value, ok := labels[LabelRateLimit]
+	if !ok || value == "" {
+		return nil
+	}
+
+	countStr, unit, found := strings.Cut(value, "/")
+	count, err := strconv.Atoi(strings.TrimSpace(countStr))
+	if !found || err != nil || count <= 0 {
+		return invalidLabel(LabelRateLimit, "value %q: expected <requests>/<s|m|h>", value)
+	}
+
+	switch strings.TrimSpace(unit) {
+	case "s":
+		cfg.RateLimitPer = time.Second
+	case "m":
+		cfg.RateLimitPer = time.Minute
+	case "h":
+		cfg.RateLimitPer = time.Hour
+	default:
+		return invalidLabel(LabelRateLimit, "unit %q: must be s, m or h", unit)
+	}
+	cfg.RateLimitRequests = count
+
+	if burstStr, ok := labels[LabelRateLimitBurst]; ok && burstStr != "" {
+		burst, err := strconv.Atoi(burstStr)
+		if err != nil || burst <= 0 {
+			return invalidLabel(LabelRateLimitBurst, "value %q: must be a positive integer", burstStr)
+		}
+		cfg.RateLimitBurst = burst
+	}
+
+	cfg.RateLimitBy = "user"
+	if by, ok := labels[LabelRateLimitBy]; ok && by != "" {
+		by = strings.ToLower(by)
+		if by != "user" && by != "node" {
+			return invalidLabel(LabelRateLimitBy, "value %q: must be user or node", by)
+		}
+		cfg.RateLimitBy = by
+	}
+
+	return nil
+}
+
+// parseTimeoutLabels reads per-service HTTP server timeout overrides
+func parseTimeoutLabels(labels map[string]string, cfg *ServiceConfig) error {
+	timeouts := []struct {
+		label string
+		dst   **time.Duration
+	}{
+		{LabelTimeoutReadHeader, &cfg.ReadHeaderTimeout},
+		{LabelTimeoutRead, &cfg.ReadTimeout},
+		{LabelTimeoutWrite, &cfg.WriteTimeout},
+		{LabelTimeoutIdle, &cfg.IdleTimeout},
+	}
+
+	for _, t := range timeouts {
+		value, ok := labels[t.label]
+		if !ok || value == "" {
+			continue
+		}
+
+		d, err := config.ParseDuration(value)
+		if err != nil {
+			return invalidLabel(t.label, "value %q: %w", value, err)
+		}
+		*t.dst = &d
+	}
+
+	return nil
+}
+
+func parseBoolLabel(labels map[string]string, key string) (bool, error) {
+	value, ok := labels[key]
+	if !ok || value == "" {
+		return false, nil
+	}
+
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, invalidLabel(key, "value %q: %w", value, err)
+	}
+	return b, nil
+}
+
+// labelError is an invalid label. The label is named under the default
+// prefix; the watcher renames it under the configured one.
+type labelError struct {
+	label string
+	err   error
+}
+
+func (e *labelError) Error() string {
+	return fmt.Sprintf("invalid %s %v", e.label, e.err)
+}
+
+func (e *labelError) Unwrap() error {
+	return e.err
+}
+
+// invalidLabel reports a problem with a label, e.g.
+// invalidLabel(LabelHTTP, "value %q: must be off, redirect or serve", mode)
+func invalidLabel(label, format string, args ...any) error {
+	return &labelError{label: label, err: fmt.Errorf(format, args...)}
+}
@@ -0,0 +1,251 @@
+package docker
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/client"
+)
+
+// podmanAPI serves a Docker-compatible API from responses recorded from a
+// Podman engine in testdata/podman/<engine> (see the README there). Events
+// are streamed once, then the connection is held open like a real engine.
+func podmanAPI(t *testing.T, engine string) http.Handler {
+	dir := filepath.Join("testdata", "podman", engine)
+	data, err := os.ReadFile(filepath.Join(dir, "version.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v struct{ Version, ApiVersion string }
+	if err := json.Unmarshal(data, &v); err != nil {
+		t.Fatal(err)
+	}
+
+	version := regexp.MustCompile(`^/v[0-9.]+`)
+	routes := []struct {
+		pattern *regexp.Regexp
+		file    string
+	}{
+		{regexp.MustCompile(`^/version$`), "version.json"},
+		{regexp.MustCompile(`^/containers/json$`), "containers.json"},
+		{regexp.MustCompile(`^/containers/([0-9a-f]+)/json$`), "inspect-%s.json"},
+		{regexp.MustCompile(`^/networks/([a-z]+)$`), "network-%s.json"},
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Api-Version", v.ApiVersion)
+		w.Header().Set("Libpod-Api-Version", v.Version)
+		w.Header().Set("Server", "Libpod/"+v.Version+" (linux)")
+
+		path := version.ReplaceAllString(r.URL.Path, "")
+		switch path {
+		case "/_ping":
+			w.Write([]byte("OK"))
+			return
+		case "/events":
+			data, err := os.ReadFile(filepath.Join(dir, "events.json"))
+			if err != nil {
+				t.Errorf("read events: %v", err)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			scanner := bufio.NewScanner(bytes.NewReader(data))
+			for scanner.Scan() {
+				w.Write(append(scanner.Bytes(), '\n'))
+				w.(http.Flusher).Flush()
+			}
+			<-r.Context().Done()
+			return
+		}
+
+		for _, route := range routes {
+			m := route.pattern.FindStringSubmatch(path)
+			if m == nil {
+				continue
+			}
+			file := route.file
+			if len(m) > 1 {
+				file = fmt.Sprintf(file, m[1])
+			}
+			data, err := os.ReadFile(filepath.Join(dir, file))
+			if err != nil {
+				break
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(data)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, `{"cause":"no such container","message":"no container with name or ID %q found: no such container","response":404}`+"\n", path)
+	})
+}
+
+func TestWatcher_Podman(t *testing.T) {
+	type event struct {
+		typ     EventType
+		id      string // first 12 characters
+		name    string
+		target  string
+		network string
+	}
+	tests := []struct {
+		engine string
+		want   []event
+	}{
+		{
+			engine: "4.9.4-rootful",
+			want: []event{
+				// Running container on the podman network
+				{EventStart, "3b437fbbd938", "wiki", "10.88.0.4:3000", "podman"},
+				// Port from EXPOSE
+				{EventStart, "6ebb283d736d", "grafana", "10.88.0.6:3000", "podman"},
+				// Podman's died events, renamed to die for the compat API
+				{EventStop, "3b437fbbd938", "", "", ""},
+				{EventStop, "6ebb283d736d", "", "", ""},
+			},
+		},
+		{
+			engine: "4.9.4-rootless",
+			want: []event{
+				// slirp4netns containers have no network, so they're
+				// reached through their published port on the podman
+				// network's gateway
+				{EventStart, "c2ad905a8454", "whoami", "10.88.0.1:8080", NetworkPublished},
+				{EventStart, "9c1eeed802fb", "grafana", "10.88.0.1:3000", NetworkPublished},
+				{EventStop, "c2ad905a8454", "", "", ""},
+				{EventStop, "9c1eeed802fb", "", "", ""},
+			},
+		},
+		{
+			engine: "5.2.0-rootful",
+			want: []event{
+				{EventStart, "e8b2dde6d8f8", "wiki", "10.88.0.7:3000", "podman"},
+				{EventStart, "20cc1c35f2ab", "grafana", "10.88.0.9:3000", "podman"},
+				{EventStop, "e8b2dde6d8f8", "", "", ""},
+				{EventStop, "20cc1c35f2ab", "", "", ""},
+			},
+		},
+		{
+			engine: "5.2.0-rootless",
+			want: []event{
+				// Same for pasta, the rootless default since Podman 5
+				{EventStart, "a6e3c9fc7328", "whoami", "10.88.0.1:8080", NetworkPublished},
+				{EventStart, "1c9cfdcb685e", "grafana", "10.88.0.1:3000", NetworkPublished},
+				{EventStop, "a6e3c9fc7328", "", "", ""},
+				{EventStop, "1c9cfdcb685e", "", "", ""},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.engine, func(t *testing.T) {
+			// Serve on a Unix socket where rootless Podman listens, and
+			// find it the way NewWatcher does. t.TempDir paths can exceed
+			// the socket path length limit.
+			runtimeDir, err := os.MkdirTemp("", "dovetail")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(runtimeDir)
+			socket := filepath.Join(runtimeDir, "podman", "podman.sock")
+			if err := os.MkdirAll(filepath.Dir(socket), 0700); err != nil {
+				t.Fatal(err)
+			}
+			ln, err := net.Listen("unix", socket)
+			if err != nil {
+				t.Skipf("unix sockets unavailable: %v", err)
+			}
+			srv := httptest.NewUnstartedServer(podmanAPI(t, tt.engine))
+			srv.Listener = ln
+			srv.Start()
+			defer srv.Close()
+
+			host := findSocket(socketCandidates(runtimeDir)[1:])
+			if host != "unix://"+socket {
+				t.Fatalf("findSocket() = %q, want unix://%s", host, socket)
+			}
+			cli, err := client.NewClientWithOpts(client.WithHost(host), client.WithAPIVersionNegotiation())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			w := NewWatcherWithClient(cli, slog.Default())
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			events := w.Watch(ctx)
+
+			for i, want := range tt.want {
+				var event ContainerEvent
+				select {
+				case event = <-events:
+				case <-time.After(5 * time.Second):
+					t.Fatalf("event %d: timed out", i)
+				}
+
+				if event.Type != want.typ || event.ContainerID[:12] != want.id {
+					t.Fatalf("event %d = %v %s, want %v %s", i, event.Type, event.ContainerID[:12], want.typ, want.id)
+				}
+				if want.typ != EventStart {
+					continue
+				}
+				cfg := event.Config
+				if target := fmt.Sprintf("%s:%d", cfg.IP, cfg.Port); cfg.Name != want.name || target != want.target || cfg.Network != want.network {
+					t.Errorf("event %d config = %s at %s on %q, want %s at %s on %q", i, cfg.Name, target, cfg.Network, want.name, want.target, want.network)
+				}
+			}
+
+			// The redis container that was killed isn't managed by dovetail
+			select {
+			case event := <-events:
+				t.Errorf("unexpected event %v %s", event.Type, event.ContainerID[:12])
+			case <-time.After(100 * time.Millisecond):
+			}
+		})
+	}
+}
+
+func TestFindSocket(t *testing.T) {
+	dir, err := os.MkdirTemp("", "dovetail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	regular := filepath.Join(dir, "docker.sock")
+	if err := os.WriteFile(regular, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	socket := filepath.Join(dir, "podman.sock")
+	ln, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Skipf("unix sockets unavailable: %v", err)
+	}
+	defer ln.Close()
+
+	if got := findSocket([]string{filepath.Join(dir, "missing.sock"), regular, socket}); got != "unix://"+socket {
+		t.Errorf("findSocket() = %q, want unix://%s", got, socket)
+	}
+	if got := findSocket([]string{regular}); got != "" {
+		t.Errorf("findSocket() = %q, want empty for a regular file", got)
+	}
+
+	candidates := socketCandidates("/run/user/1000")
+	want := []string{"/var/run/docker.sock", "/run/user/1000/docker.sock", "/run/podman/podman.sock", "/run/user/1000/podman/podman.sock"}
+	if fmt.Sprint(candidates) != fmt.Sprint(want) {
+		t.Errorf("socketCandidates() = %v, want %v", candidates, want)
+	}
+}
@@ -0,0 +1,72 @@
+package docker
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/client"
+)
+
+// socketCandidates lists where Docker and Podman listen by default:
+// rootful Docker, rootless Docker, rootful Podman, then rootless Podman.
+// runtimeDir is the user's XDG_RUNTIME_DIR.
+func socketCandidates(runtimeDir string) []string {
+	return []string{
+		"/var/run/docker.sock",
+		filepath.Join(runtimeDir, "docker.sock"),
+		"/run/podman/podman.sock",
+		filepath.Join(runtimeDir, "podman", "podman.sock"),
+	}
+}
+
+// findSocket returns the first candidate that is a Unix socket, as a
+// DOCKER_HOST value, or empty when there is none
+func findSocket(candidates []string) string {
+	for _, path := range candidates {
+		if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+			return "unix://" + path
+		}
+	}
+	return ""
+}
+
+// discoverHost returns the engine address to connect to when DOCKER_HOST
+// isn't set
+func discoverHost() string {
+	runtimeDir := os.Getenv("XDG_RUNTIME_DIR")
+	if runtimeDir == "" {
+		runtimeDir = fmt.Sprintf("/run/user/%d", os.Getuid())
+	}
+	return findSocket(socketCandidates(runtimeDir))
+}
+
+// logEngine reports which container engine the client talks to. Podman
+// names itself in the version's components.
+func logEngine(cli *client.Client, logger *slog.Logger) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	version, err := cli.ServerVersion(ctx)
+	if err != nil {
+		logger.Warn("failed to reach container engine", "host", cli.DaemonHost(), "error", err)
+		return
+	}
+
+	engine := "docker"
+	for _, component := range version.Components {
+		if strings.Contains(strings.ToLower(component.Name), "podman") {
+			engine = "podman"
+		}
+	}
+	logger.Info("connected to container engine",
+		"host", cli.DaemonHost(),
+		"engine", engine,
+		"version", version.Version,
+		"api_version", version.APIVersion,
+	)
+}
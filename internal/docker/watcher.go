@@ -2,10 +2,17 @@ package docker
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
 	"sort"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
@@ -13,17 +20,88 @@ import (
 	"github.com/docker/docker/api/types/filters"
 	"github.com/docker/docker/api/types/network"
 	"github.com/docker/docker/client"
+	"github.com/docker/go-connections/nat"
 )
 
+// DefaultLabelPrefix is the prefix of the Label constants. Another prefix
+// can be configured with SetLabelPrefix.
+const DefaultLabelPrefix = "dovetail"
+
 const (
-	LabelName = "dovetail.name"
-	LabelPort = "dovetail.port"
+	LabelName     = "dovetail.name"
+	LabelPort     = "dovetail.port"
+	LabelScheme   = "dovetail.scheme"
+	LabelProtocol = "dovetail.protocol"
+	LabelHTTP     = "dovetail.http"
+
+	// LabelSocket is the path of a Unix socket to proxy to instead of the
+	// container's address and port
+	LabelSocket = "dovetail.socket"
+
+	// LabelPublished reaches the container through its published port on
+	// the Docker host instead of its network address
+	LabelPublished = "dovetail.published"
+
+	// LabelInstance assigns the container to the dovetail instance with
+	// the same name. Containers without it belong to the unnamed instance.
+	LabelInstance = "dovetail.instance"
+
+	LabelPreserveHost = "dovetail.preserve_host"
+	LabelCompress     = "dovetail.compress"
+
+	LabelCache       = "dovetail.cache"
+	LabelCacheMemory = "dovetail.cache.memory"
+	LabelCacheDisk   = "dovetail.cache.disk"
+
+	LabelMaintenance        = "dovetail.maintenance"
+	LabelMaintenanceMessage = "dovetail.maintenance.message"
+	LabelMaintenanceAllow   = "dovetail.maintenance.allow"
+
+	LabelFunnel      = "dovetail.funnel"
+	LabelFunnelPaths = "dovetail.funnel.paths"
+
+	LabelTLSInsecureSkipVerify = "dovetail.tls.insecure_skip_verify"
+	LabelTLSCAFile             = "dovetail.tls.ca_file"
+	LabelTLSServerName         = "dovetail.tls.server_name"
+
+	LabelTimeoutReadHeader = "dovetail.timeout.read_header"
+	LabelTimeoutRead       = "dovetail.timeout.read"
+	LabelTimeoutWrite      = "dovetail.timeout.write"
+	LabelTimeoutIdle       = "dovetail.timeout.idle"
+
+	LabelRetryAttempts   = "dovetail.retry.attempts"
+	LabelRetryBackoff    = "dovetail.retry.backoff"
+	LabelRetryMaxBody    = "dovetail.retry.max_body"
+	LabelBreakerFailures = "dovetail.breaker.failures"
+	LabelBreakerCooldown = "dovetail.breaker.cooldown"
+
+	LabelMaxBodySize    = "dovetail.max_body_size"
+	LabelMaxHeaderBytes = "dovetail.max_header_bytes"
+
+	LabelRateLimit      = "dovetail.ratelimit"
+	LabelRateLimitBurst = "dovetail.ratelimit.burst"
+	LabelRateLimitBy    = "dovetail.ratelimit.by"
+
+	LabelIdentityJWT = "dovetail.identity.jwt"
+
+	LabelHeadersPreset = "dovetail.headers.preset"
+	LabelHeadersLegacy = "dovetail.headers.legacy"
+	// LabelHeadersMapPrefix is followed by the header name, e.g.
+	// "dovetail.headers.map.Remote-User=login"
+	LabelHeadersMapPrefix = "dovetail.headers.map."
+
+	LabelHeadersSecurity = "dovetail.headers.security"
+	// Header rule labels are followed by set, add or remove and the header
+	// name, e.g. "dovetail.headers.response.remove.Server=true"
+	LabelHeadersRequestPrefix  = "dovetail.headers.request."
+	LabelHeadersResponsePrefix = "dovetail.headers.response."
 )
 
 // DockerClient abstracts the Docker client for testing
 type DockerClient interface {
 	ContainerList(ctx context.Context, options container.ListOptions) ([]types.Container, error)
 	ContainerInspect(ctx context.Context, containerID string) (types.ContainerJSON, error)
+	NetworkInspect(ctx context.Context, networkID string, options network.InspectOptions) (network.Inspect, error)
 	Events(ctx context.Context, options events.ListOptions) (<-chan events.Message, <-chan error)
 	Close() error
 }
@@ -51,6 +129,98 @@ type ServiceConfig struct {
 	Port    int
 	IP      string
 	Network string
+
+	// Socket is the path of a Unix socket the container serves HTTP on,
+	// as seen by dovetail. When set, Port and IP are unused.
+	Socket string
+
+	// Upstream connection settings
+	Scheme                string
+	Protocol              string
+	TLSInsecureSkipVerify bool
+	TLSCAFile             string
+	TLSServerName         string
+
+	// PreserveHost forwards the client's Host header unchanged
+	PreserveHost bool
+
+	// Compression lists the response encodings to use, in order of
+	// preference. Empty disables compression.
+	Compression []string
+
+	// Cache enables the response cache, bounded to CacheMemory bytes in
+	// memory and CacheDisk bytes on disk. Zero CacheMemory uses the
+	// default and zero CacheDisk keeps the cache in memory only.
+	Cache       bool
+	CacheMemory int64
+	CacheDisk   int64
+
+	// Maintenance starts the service in maintenance mode, showing
+	// MaintenanceMessage to everyone but the MaintenanceAllow users, nodes
+	// and tags
+	Maintenance        bool
+	MaintenanceMessage string
+	MaintenanceAllow   []string
+
+	// Retries of failed connections and the circuit breaker. Zero
+	// RetryAttempts and BreakerFailures disable them, and zero durations
+	// and sizes use the defaults.
+	RetryAttempts   int
+	RetryBackoff    time.Duration
+	RetryMaxBody    int64
+	BreakerFailures int
+	BreakerCooldown time.Duration
+
+	// HTTP is the plain HTTP listener mode: off, redirect or serve
+	HTTP string
+
+	// Funnel exposes the service publicly, optionally limited to FunnelPaths
+	Funnel      bool
+	FunnelPaths []string
+
+	// Per-identity rate limit of RateLimitRequests per RateLimitPer.
+	// Zero RateLimitRequests disables it.
+	RateLimitRequests int
+	RateLimitPer      time.Duration
+	RateLimitBurst    int
+	RateLimitBy       string
+
+	// IdentityJWT adds a signed identity assertion to proxied requests
+	IdentityJWT bool
+
+	// HeadersPreset names a set of identity headers for a known app, and
+	// HeadersMap adds or overrides header name to identity field mappings
+	HeadersPreset string
+	HeadersMap    map[string]string
+
+	// Request and response header edits, and the security header profile
+	// override. An empty SecurityHeaders means use the configured default.
+	RequestHeaders  HeaderRules
+	ResponseHeaders HeaderRules
+	SecurityHeaders string
+
+	// HeadersLegacy overrides whether the original identity header values
+	// are sent. Nil means use the configured default.
+	HeadersLegacy *bool
+
+	// Server timeout overrides. Nil means use the configured default and
+	// zero means unlimited.
+	ReadHeaderTimeout *time.Duration
+	ReadTimeout       *time.Duration
+	WriteTimeout      *time.Duration
+	IdleTimeout       *time.Duration
+
+	// Request size limit overrides. Nil means use the configured default
+	// and a zero MaxBodySize means unlimited.
+	MaxBodySize    *int64
+	MaxHeaderBytes *int64
+}
+
+// HeaderRules are the header edits configured for one direction
+type HeaderRules struct {
+	Set    map[string]string
+	Add    map[string]string
+	Remove []string
 }
 
 type ContainerEvent struct {
@@ -60,28 +230,99 @@ type ContainerEvent struct {
 }
 
 type Watcher struct {
-	client DockerClient
-	logger *slog.Logger
+	client      DockerClient
+	started     map[string]bool // IDs of containers reported as started
+	prefix      string
+	instance    string
+	hostAddress string
+	hostNetwork *bool // whether dovetail runs on the host network, once known
+	logger      *slog.Logger
 }
 
+// errOtherInstance is returned for containers managed by another dovetail
+var errOtherInstance = errors.New("container belongs to another dovetail instance")
+
+// NewWatcher connects to DOCKER_HOST, or else to the first Docker or
+// Podman socket found in the default locations
 func NewWatcher(logger *slog.Logger) (*Watcher, error) {
-	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	opts := []client.Opt{client.FromEnv, client.WithAPIVersionNegotiation()}
+	if os.Getenv(client.EnvOverrideHost) == "" {
+		if host := discoverHost(); host != "" {
+			opts = append(opts, client.WithHost(host))
+		}
+	}
+
+	cli, err := client.NewClientWithOpts(opts...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create docker client: %w", err)
 	}
+	logEngine(cli, logger)
 
 	return &Watcher{
-		client: cli,
-		logger: logger,
+		client:  cli,
+		started: make(map[string]bool),
+		prefix:  DefaultLabelPrefix,
+		logger:  logger,
 	}, nil
 }
 
 // NewWatcherWithClient creates a Watcher with a custom DockerClient (for testing)
 func NewWatcherWithClient(cli DockerClient, logger *slog.Logger) *Watcher {
 	return &Watcher{
-		client: cli,
-		logger: logger,
+		client:  cli,
+		started: make(map[string]bool),
+		prefix:  DefaultLabelPrefix,
+		logger:  logger,
+	}
+}
+
+// SetLabelPrefix makes the watcher read labels such as "<prefix>.name"
+// instead of "dovetail.name"
+func (w *Watcher) SetLabelPrefix(prefix string) {
+	w.prefix = prefix
+}
+
+// SetInstance limits the watcher to containers whose instance label has
+// this value. Empty means containers without the label.
+func (w *Watcher) SetInstance(instance string) {
+	w.instance = instance
+}
+
+// label returns the name of a Label constant under the configured prefix
+func (w *Watcher) label(key string) string {
+	return w.prefix + strings.TrimPrefix(key, DefaultLabelPrefix)
+}
+
+// labelErr renames the label of a labelError under the configured prefix
+func (w *Watcher) labelErr(err error) error {
+	var le *labelError
+	if errors.As(err, &le) {
+		le.label = w.label(le.label)
 	}
+	return err
+}
+
+// labels returns the labels under the configured prefix, renamed to the
+// default prefix so they can be looked up with the Label constants
+func (w *Watcher) labels(labels map[string]string) map[string]string {
+	if w.prefix == DefaultLabelPrefix {
+		return labels
+	}
+
+	renamed := make(map[string]string)
+	for key, value := range labels {
+		if rest, ok := strings.CutPrefix(key, w.prefix+"."); ok {
+			renamed[DefaultLabelPrefix+"."+rest] = value
+		}
+	}
+	return renamed
+}
+
+// SetHostAddress sets the address of the Docker host, used to reach
+// host-networked containers and published ports. Empty uses the gateway of
+// Docker's default bridge network.
+func (w *Watcher) SetHostAddress(addr string) {
+	w.hostAddress = addr
 }
 
 func (w *Watcher) Close() error {
@@ -107,7 +348,7 @@ func (w *Watcher) Watch(ctx context.Context) <-chan ContainerEvent {
 func (w *Watcher) scanRunningContainers(ctx context.Context, events chan<- ContainerEvent) {
 	containers, err := w.client.ContainerList(ctx, container.ListOptions{
 		Filters: filters.NewArgs(
-			filters.Arg("label", LabelName),
+			filters.Arg("label", w.label(LabelName)),
 			filters.Arg("status", "running"),
 		),
 	})
@@ -118,10 +359,14 @@ func (w *Watcher) scanRunningContainers(ctx context.Context, events chan<- Conta
 
 	for _, c := range containers {
 		cfg, err := w.inspectContainer(ctx, c.ID)
+		if errors.Is(err, errOtherInstance) {
+			continue
+		}
 		if err != nil {
 			w.logger.Warn("failed to inspect container", "id", c.ID[:12], "error", err)
 			continue
 		}
+		w.started[c.ID] = true
 
 		events <- ContainerEvent{
 			Type:        EventStart,
@@ -157,26 +402,33 @@ func (w *Watcher) watchEvents(ctx context.Context, eventsChan chan<- ContainerEv
 }
 
 func (w *Watcher) handleEvent(ctx context.Context, msg events.Message, eventsChan chan<- ContainerEvent) {
+	id := msg.Actor.ID
+
 	switch msg.Action {
 	case "start":
-		cfg, err := w.inspectContainer(ctx, msg.Actor.ID)
+		cfg, err := w.inspectContainer(ctx, id)
 		if err != nil {
 			// Container might not have dovetail labels, which is fine
 			return
 		}
+		w.started[id] = true
 		eventsChan <- ContainerEvent{
 			Type:        EventStart,
-			ContainerID: msg.Actor.ID,
+			ContainerID: id,
 			Config:      cfg,
 		}
 
 	case "stop", "die":
-		// For stop/die events, we don't need the full config
-		// Just check if it had our label (from the event attributes)
-		if _, ok := msg.Actor.Attributes[LabelName]; ok {
+		// For stop/die events, we don't need the full config. Check if
+		// it's a container we started, or had our labels (from the event
+		// attributes, which don't always carry them).
+		labels := w.labels(msg.Actor.Attributes)
+		_, labelled := labels[LabelName]
+		if w.started[id] || (labelled && labels[LabelInstance] == w.instance) {
+			delete(w.started, id)
 			eventsChan <- ContainerEvent{
 				Type:        EventStop,
-				ContainerID: msg.Actor.ID,
+				ContainerID: id,
 			}
 		}
 	}
@@ -188,42 +440,288 @@ func (w *Watcher) inspectContainer(ctx context.Context, id string) (*ServiceConf
 		return nil, fmt.Errorf("failed to inspect container: %w", err)
 	}
 
+	labels := w.labels(info.Config.Labels)
+
 	// Check for required labels
-	name, ok := info.Config.Labels[LabelName]
+	name, ok := labels[LabelName]
 	if !ok || name == "" {
-		return nil, fmt.Errorf("container missing %s label", LabelName)
+		return nil, fmt.Errorf("container missing %s label", w.label(LabelName))
 	}
 
-	portStr, ok := info.Config.Labels[LabelPort]
-	if !ok || portStr == "" {
-		return nil, fmt.Errorf("container missing %s label", LabelPort)
+	if instance := labels[LabelInstance]; instance != w.instance {
+		return nil, errOtherInstance
 	}
 
-	port, err := strconv.Atoi(portStr)
-	if err != nil {
-		return nil, fmt.Errorf("invalid port value %q: %w", portStr, err)
+	cfg := &ServiceConfig{Name: name}
+
+	if socket := labels[LabelSocket]; socket != "" {
+		if !filepath.IsAbs(socket) {
+			return nil, fmt.Errorf("invalid %s value %q: must be an absolute path", w.label(LabelSocket), socket)
+		}
+		cfg.Socket = socket
+	} else {
+		https := strings.EqualFold(labels[LabelScheme], "https")
+		port, err := w.containerPort(id, labels, info.Config.ExposedPorts, https)
+		if err != nil {
+			return nil, err
+		}
+
+		published, err := parseBoolLabel(labels, LabelPublished)
+		if err != nil {
+			return nil, w.labelErr(err)
+		}
+
+		cfg.IP, cfg.Network, cfg.Port, err = w.containerAddress(ctx, info, port, published)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	// Get container IP
-	ip, network, err := w.getContainerIP(info.NetworkSettings.Networks)
-	if err != nil {
-		return nil, err
+	if err := parseUpstreamLabels(labels, cfg); err != nil {
+		return nil, w.labelErr(err)
+	}
+
+	if err := parseCacheLabels(labels, cfg); err != nil {
+		return nil, w.labelErr(err)
+	}
+
+	if err := parseMaintenanceLabels(labels, cfg); err != nil {
+		return nil, w.labelErr(err)
+	}
+
+	if err := parseLimitLabels(labels, cfg); err != nil {
+		return nil, w.labelErr(err)
+	}
+
+	if err := parseRetryLabels(labels, cfg); err != nil {
+		return nil, w.labelErr(err)
+	}
+
+	if err := parseTimeoutLabels(labels, cfg); err != nil {
+		return nil, w.labelErr(err)
+	}
+
+	if err := parseListenerLabels(labels, cfg); err != nil {
+		return nil, w.labelErr(err)
+	}
+
+	if err := parseRateLimitLabels(labels, cfg); err != nil {
+		return nil, w.labelErr(err)
+	}
+
+	if err := parseIdentityLabels(labels, cfg); err != nil {
+		return nil, w.labelErr(err)
+	}
+
+	if err := parseHeaderRuleLabels(labels, cfg); err != nil {
+		return nil, w.labelErr(err)
 	}
 
 	w.logger.Info("discovered container",
 		"id", id[:12],
 		"name", name,
-		"port", port,
-		"ip", ip,
-		"network", network,
+		"port", cfg.Port,
+		"ip", cfg.IP,
+		"network", cfg.Network,
+		"socket", cfg.Socket,
+		"scheme", cfg.Scheme,
+		"protocol", cfg.Protocol,
 	)
 
-	return &ServiceConfig{
-		Name:    name,
-		Port:    port,
-		IP:      ip,
-		Network: network,
-	}, nil
+	return cfg, nil
+}
+
+// PreferredPorts decide between several exposed ports when dovetail.port
+// is missing. Earlier entries win.
+var PreferredPorts = []int{80, 8080, 8000, 3000, 5000}
+
+// errHTTPSPortsOnly is returned when the image only exposes httpsPorts
+// and the scheme is http
+var errHTTPSPortsOnly = errors.New("container only exposes HTTPS ports")
+
+// httpsPorts are only picked from the exposed ports when dovetail.scheme
+// is https, and are then preferred over PreferredPorts
+var httpsPorts = []int{443, 8443}
+
+// containerPort reads dovetail.port, falling back to the ports exposed by
+// the image. https reports whether dovetail.scheme is https.
+func (w *Watcher) containerPort(id string, labels map[string]string, ports nat.PortSet, https bool) (int, error) {
+	if portStr := labels[LabelPort]; portStr != "" {
+		port, err := strconv.Atoi(portStr)
+		if err != nil {
+			return 0, fmt.Errorf("invalid %s value %q: %w", w.label(LabelPort), portStr, err)
+		}
+		return port, nil
+	}
+
+	port, exposed, err := exposedPort(ports, https)
+	if errors.Is(err, errHTTPSPortsOnly) {
+		return 0, fmt.Errorf("%w: set the %s label to https", err, w.label(LabelScheme))
+	}
+	if err != nil {
+		return 0, fmt.Errorf("%w: set the %s label", err, w.label(LabelPort))
+	}
+	w.logger.Info("no port label, using exposed port", "id", id[:12], "port", port, "exposed", exposed)
+	return port, nil
+}
+
+// exposedPort picks the port to proxy from the image's EXPOSE list: the
+// only TCP port, or the first of several found in PreferredPorts. HTTPS
+// ports are left out unless https is set, in which case they come first.
+// It also returns the exposed TCP ports it considered.
+func exposedPort(ports nat.PortSet, https bool) (int, []int, error) {
+	var exposed, skipped []int
+	for p := range ports {
+		if p.Proto() != "tcp" {
+			continue
+		}
+		if !https && slices.Contains(httpsPorts, p.Int()) {
+			skipped = append(skipped, p.Int())
+			continue
+		}
+		exposed = append(exposed, p.Int())
+	}
+	sort.Ints(exposed)
+	sort.Ints(skipped)
+
+	switch len(exposed) {
+	case 0:
+		if len(skipped) > 0 {
+			return 0, nil, fmt.Errorf("%w %v", errHTTPSPortsOnly, skipped)
+		}
+		return 0, nil, errors.New("container exposes no TCP port")
+	case 1:
+		return exposed[0], exposed, nil
+	}
+
+	preferred := PreferredPorts
+	if https {
+		preferred = append(slices.Clip(httpsPorts), PreferredPorts...)
+	}
+	for _, preferred := range preferred {
+		if slices.Contains(exposed, preferred) {
+			return preferred, exposed, nil
+		}
+	}
+	return 0, nil, fmt.Errorf("container exposes several ports %v", exposed)
+}
+
+// Pseudo network names for containers reached through the Docker host
+const (
+	NetworkHost      = "host"
+	NetworkPublished = "published"
+)
+
+// containerAddress picks where to reach the container's port: its address
+// on a Docker network, or the Docker host for host-networked containers and
+// published ports. Containers without a network address fall back to their
+// published port.
+func (w *Watcher) containerAddress(ctx context.Context, info types.ContainerJSON, port int, published bool) (string, string, int, error) {
+	if info.ContainerJSONBase != nil && info.HostConfig != nil && info.HostConfig.NetworkMode.IsHost() {
+		host, err := w.hostAddr(ctx)
+		if err != nil {
+			return "", "", 0, err
+		}
+		return host, NetworkHost, port, nil
+	}
+
+	if info.NetworkSettings == nil {
+		return "", "", 0, fmt.Errorf("container has no networks")
+	}
+
+	hostIP, hostPort, ok := publishedPort(info.NetworkSettings.Ports, port)
+	if !published {
+		ip, netName, err := w.getContainerIP(info.NetworkSettings.Networks)
+		if err == nil || !ok {
+			return ip, netName, port, err
+		}
+	}
+	if !ok {
+		return "", "", 0, fmt.Errorf("port %d/tcp is not published", port)
+	}
+
+	if ip := net.ParseIP(hostIP); ip != nil && ip.IsLoopback() {
+		// docker-proxy only accepts connections to a loopback binding on
+		// loopback, so the host address won't do
+		if !w.reachesHostLoopback(ctx) {
+			return "", "", 0, fmt.Errorf("port %d/tcp is only published on %s, which dovetail can't reach from a bridged network: run dovetail on the host network or publish the port on another address", port, hostIP)
+		}
+	}
+
+	if hostIP == "" {
+		var err error
+		if hostIP, err = w.hostAddr(ctx); err != nil {
+			return "", "", 0, err
+		}
+	}
+	return hostIP, NetworkPublished, hostPort, nil
+}
+
+// publishedPort returns the host address and port the container port is
+// published on. The address is empty for ports bound to all interfaces.
+func publishedPort(ports nat.PortMap, port int) (string, int, bool) {
+	for _, binding := range ports[nat.Port(fmt.Sprintf("%d/tcp", port))] {
+		hostPort, err := strconv.Atoi(binding.HostPort)
+		if err != nil || hostPort == 0 {
+			continue
+		}
+		switch binding.HostIP {
+		case "", "0.0.0.0", "::":
+			return "", hostPort, true
+		}
+		return binding.HostIP, hostPort, true
+	}
+	return "", 0, false
+}
+
+// reachesHostLoopback reports whether dovetail can connect to ports the
+// host publishes on loopback: when the configured host address is a
+// loopback address, or dovetail's container shares the host's network
+// stack
+func (w *Watcher) reachesHostLoopback(ctx context.Context) bool {
+	if ip := net.ParseIP(w.hostAddress); ip != nil && ip.IsLoopback() {
+		return true
+	}
+
+	if w.hostNetwork == nil {
+		// Docker and Podman set a container's hostname to its ID. If no
+		// container has ours, dovetail may run on the host, or in a
+		// container with a custom hostname, so assume it's bridged.
+		hostname, _ := os.Hostname()
+		self, err := w.client.ContainerInspect(ctx, hostname)
+		if err != nil {
+			w.logger.Warn("can't find dovetail's own container, assuming a bridged network: set DOVETAIL_HOST_ADDRESS=127.0.0.1 when running on the host network",
+				"hostname", hostname, "error", err)
+		}
+		onHost := err == nil && self.ContainerJSONBase != nil && self.HostConfig != nil && self.HostConfig.NetworkMode.IsHost()
+		w.hostNetwork = &onHost
+	}
+	return *w.hostNetwork
+}
+
+// hostAddr returns the address of the Docker host: the configured host
+// address, or the gateway of Docker's default bridge network
+func (w *Watcher) hostAddr(ctx context.Context) (string, error) {
+	if w.hostAddress != "" {
+		return w.hostAddress, nil
+	}
+
+	// Podman calls its default network "podman"
+	var err error
+	for _, name := range []string{"bridge", "podman"} {
+		var bridge network.Inspect
+		bridge, err = w.client.NetworkInspect(ctx, name, network.InspectOptions{})
+		if err != nil {
+			continue
+		}
+		for _, cfg := range bridge.IPAM.Config {
+			if cfg.Gateway != "" {
+				return cfg.Gateway, nil
+			}
+		}
+		err = fmt.Errorf("%s network has no gateway", name)
+	}
+	return "", fmt.Errorf("failed to find docker host address: %w", err)
 }
 
 func (w *Watcher) getContainerIP(networks map[string]*network.EndpointSettings) (string, string, error) {
@@ -4,12 +4,16 @@ import (
 	"context"
 	"errors"
 	"log/slog"
+	"os"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/api/types/events"
 	"github.com/docker/docker/api/types/network"
+	"github.com/docker/go-connections/nat"
 )
 
 // mockDockerClient implements DockerClient for testing
@@ -18,6 +22,8 @@ type mockDockerClient struct {
 	containerJSON   types.ContainerJSON
 	listErr         error
 	inspectErr      error
+	inspectErrs     map[string]error
+	bridgeGateway   string
 	eventsChan      chan events.Message
 	eventsErrChan   chan error
 }
@@ -33,9 +39,22 @@ func (m *mockDockerClient) ContainerInspect(ctx context.Context, containerID str
 	if m.inspectErr != nil {
 		return types.ContainerJSON{}, m.inspectErr
 	}
+	if err := m.inspectErrs[containerID]; err != nil {
+		return types.ContainerJSON{}, err
+	}
 	return m.containerJSON, nil
 }
 
+func (m *mockDockerClient) NetworkInspect(ctx context.Context, networkID string, options network.InspectOptions) (network.Inspect, error) {
+	if networkID != "bridge" || m.bridgeGateway == "" {
+		return network.Inspect{}, errors.New("network not found")
+	}
+	return network.Inspect{
+		Name: networkID,
+		IPAM: network.IPAM{Config: []network.IPAMConfig{{Subnet: "172.17.0.0/16", Gateway: m.bridgeGateway}}},
+	}, nil
+}
+
 func (m *mockDockerClient) Events(ctx context.Context, options events.ListOptions) (<-chan events.Message, <-chan error) {
 	return m.eventsChan, m.eventsErrChan
 }
@@ -63,6 +82,184 @@ func TestEventType_String(t *testing.T) {
 	}
 }
 
+func TestInspectContainer_HostAddress(t *testing.T) {
+	logger := slog.Default()
+
+	hostMode := &types.ContainerJSONBase{HostConfig: &container.HostConfig{NetworkMode: "host"}}
+	bridged := &types.NetworkSettings{
+		Networks: map[string]*network.EndpointSettings{"bridge": {IPAddress: "172.17.0.5"}},
+	}
+	bridged.Ports = nat.PortMap{"8123/tcp": {{HostIP: "0.0.0.0", HostPort: "18123"}, {HostIP: "::", HostPort: "18123"}}}
+	unattached := &types.NetworkSettings{}
+	unattached.Ports = nat.PortMap{"8123/tcp": {{HostIP: "0.0.0.0", HostPort: "18123"}}}
+	loopback := &types.NetworkSettings{}
+	loopback.Ports = nat.PortMap{"8123/tcp": {{HostIP: "127.0.0.1", HostPort: "18123"}}}
+	loopback6 := &types.NetworkSettings{}
+	loopback6.Ports = nat.PortMap{"8123/tcp": {{HostIP: "::1", HostPort: "18123"}}}
+	lan := &types.NetworkSettings{}
+	lan.Ports = nat.PortMap{"8123/tcp": {{HostIP: "192.168.1.20", HostPort: "18123"}}}
+
+	tests := []struct {
+		name        string
+		base        *types.ContainerJSONBase
+		settings    *types.NetworkSettings
+		published   string
+		hostAddress string
+		hostNetwork bool
+		gateway     string
+		wantIP      string
+		wantPort    int
+		wantNetwork string
+		wantErr     bool
+	}{
+		{name: "host network uses bridge gateway", base: hostMode, gateway: "172.17.0.1", wantIP: "172.17.0.1", wantPort: 8123, wantNetwork: NetworkHost},
+		{name: "host network uses configured address", base: hostMode, hostAddress: "192.168.1.20", gateway: "172.17.0.1", wantIP: "192.168.1.20", wantPort: 8123, wantNetwork: NetworkHost},
+		{name: "host network without gateway", base: hostMode, wantErr: true},
+		{name: "network address preferred", settings: bridged, gateway: "172.17.0.1", wantIP: "172.17.0.5", wantPort: 8123, wantNetwork: "bridge"},
+		{name: "published label", settings: bridged, published: "true", gateway: "172.17.0.1", wantIP: "172.17.0.1", wantPort: 18123, wantNetwork: NetworkPublished},
+		{name: "published fallback without network", settings: unattached, gateway: "172.17.0.1", wantIP: "172.17.0.1", wantPort: 18123, wantNetwork: NetworkPublished},
+		{name: "published on specific address", settings: lan, published: "true", wantIP: "192.168.1.20", wantPort: 18123, wantNetwork: NetworkPublished},
+		{name: "published on loopback from host network", settings: loopback, published: "true", hostNetwork: true, gateway: "172.17.0.1", wantIP: "127.0.0.1", wantPort: 18123, wantNetwork: NetworkPublished},
+		{name: "published on loopback with loopback host address", settings: loopback6, published: "true", hostAddress: "127.0.0.1", wantIP: "::1", wantPort: 18123, wantNetwork: NetworkPublished},
+		{name: "published on loopback from bridged network", settings: loopback, published: "true", gateway: "172.17.0.1", wantErr: true},
+		{name: "published on IPv6 loopback from bridged network", settings: loopback6, published: "true", hostAddress: "192.168.1.20", wantErr: true},
+		{name: "port not published", settings: &types.NetworkSettings{}, published: "true", gateway: "172.17.0.1", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			labels := map[string]string{LabelName: "homeassistant", LabelPort: "8123"}
+			if tt.published != "" {
+				labels[LabelPublished] = tt.published
+			}
+			mock := &mockDockerClient{
+				containerJSON: types.ContainerJSON{
+					ContainerJSONBase: tt.base,
+					Config:            &container.Config{Labels: labels},
+					NetworkSettings:   tt.settings,
+				},
+				bridgeGateway: tt.gateway,
+			}
+			w := NewWatcherWithClient(mock, logger)
+			w.SetHostAddress(tt.hostAddress)
+			w.hostNetwork = &tt.hostNetwork
+
+			cfg, err := w.inspectContainer(context.Background(), "test-container-id")
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("expected error, got config %+v", cfg)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if cfg.IP != tt.wantIP || cfg.Port != tt.wantPort || cfg.Network != tt.wantNetwork {
+				t.Errorf("target = %s:%d on %q, want %s:%d on %q", cfg.IP, cfg.Port, cfg.Network, tt.wantIP, tt.wantPort, tt.wantNetwork)
+			}
+		})
+	}
+}
+
+func TestReachesHostLoopback(t *testing.T) {
+	logger := slog.Default()
+	self := func(mode container.NetworkMode) types.ContainerJSON {
+		return types.ContainerJSON{ContainerJSONBase: &types.ContainerJSONBase{HostConfig: &container.HostConfig{NetworkMode: mode}}}
+	}
+
+	tests := []struct {
+		name        string
+		mock        *mockDockerClient
+		hostAddress string
+		want        bool
+	}{
+		{"bridged container", &mockDockerClient{containerJSON: self("bridge")}, "", false},
+		{"host-networked container", &mockDockerClient{containerJSON: self("host")}, "", true},
+		{"own container not found", &mockDockerClient{inspectErr: errors.New("no such container")}, "", false},
+		{"own container not found with loopback host address", &mockDockerClient{inspectErr: errors.New("no such container")}, "127.0.0.1", true},
+		{"loopback host address", &mockDockerClient{containerJSON: self("bridge")}, "127.0.0.1", true},
+		{"other host address", &mockDockerClient{containerJSON: self("bridge")}, "192.168.1.20", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := NewWatcherWithClient(tt.mock, logger)
+			w.SetHostAddress(tt.hostAddress)
+			if got := w.reachesHostLoopback(context.Background()); got != tt.want {
+				t.Errorf("reachesHostLoopback() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInspectContainer_CustomHostname(t *testing.T) {
+	// A bridged dovetail container with a custom hostname can't find
+	// itself, and mustn't be taken for a host-networked one
+	hostname, _ := os.Hostname()
+	settings := &types.NetworkSettings{}
+	settings.Ports = nat.PortMap{"8123/tcp": {{HostIP: "127.0.0.1", HostPort: "18123"}}}
+	mock := &mockDockerClient{
+		containerJSON: types.ContainerJSON{
+			ContainerJSONBase: &types.ContainerJSONBase{HostConfig: &container.HostConfig{NetworkMode: "bridge"}},
+			Config:            &container.Config{Labels: map[string]string{LabelName: "homeassistant", LabelPort: "8123", LabelPublished: "true"}},
+			NetworkSettings:   settings,
+		},
+		inspectErrs:   map[string]error{hostname: errors.New("no such container")},
+		bridgeGateway: "172.17.0.1",
+	}
+	w := NewWatcherWithClient(mock, slog.Default())
+
+	if cfg, err := w.inspectContainer(context.Background(), "test-container-id"); err == nil {
+		t.Errorf("expected error for a loopback-published port, got target %s:%d", cfg.IP, cfg.Port)
+	}
+	if w.hostNetwork == nil || *w.hostNetwork {
+		t.Error("expected dovetail to be treated as bridged")
+	}
+}
+
+func TestExposedPort(t *testing.T) {
+	tests := []struct {
+		name    string
+		ports   nat.PortSet
+		https   bool
+		want    int
+		wantErr bool
+	}{
+		{name: "none", ports: nil, wantErr: true},
+		{name: "udp only", ports: nat.PortSet{"53/udp": {}}, wantErr: true},
+		{name: "single tcp", ports: nat.PortSet{"2283/tcp": {}}, want: 2283},
+		{name: "tcp beside udp", ports: nat.PortSet{"32400/tcp": {}, "1900/udp": {}}, want: 32400},
+		{name: "preferred", ports: nat.PortSet{"443/tcp": {}, "80/tcp": {}, "9000/tcp": {}}, want: 80},
+		{name: "preference order", ports: nat.PortSet{"3000/tcp": {}, "8080/tcp": {}}, want: 8080},
+		{name: "ambiguous", ports: nat.PortSet{"9000/tcp": {}, "9001/tcp": {}}, wantErr: true},
+		{name: "https ports not picked", ports: nat.PortSet{"443/tcp": {}, "8443/tcp": {}}, wantErr: true},
+		{name: "single https port not picked", ports: nat.PortSet{"443/tcp": {}}, wantErr: true},
+		{name: "https port beside http", ports: nat.PortSet{"443/tcp": {}, "9000/tcp": {}}, want: 9000},
+		{name: "single https port with https scheme", ports: nat.PortSet{"443/tcp": {}}, https: true, want: 443},
+		{name: "https ports preferred with https scheme", ports: nat.PortSet{"80/tcp": {}, "8443/tcp": {}}, https: true, want: 8443},
+		{name: "other port with https scheme", ports: nat.PortSet{"9443/tcp": {}}, https: true, want: 9443},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, _, err := exposedPort(tt.ports, tt.https)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("expected error, got port %d", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("exposedPort() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
 func TestGetContainerIP(t *testing.T) {
 	logger := slog.Default()
 	w := NewWatcherWithClient(&mockDockerClient{}, logger)
@@ -247,8 +444,229 @@ func TestInspectContainer(t *testing.T) {
 				Port:    8080,
 				IP:      "172.17.0.2",
 				Network: "bridge",
+				Scheme:  "http",
 			},
 		},
+		{
+			name: "https upstream with tls labels",
+			containerJSON: types.ContainerJSON{
+				Config: &container.Config{
+					Labels: map[string]string{
+						LabelName:                  "proxmox",
+						LabelPort:                  "8006",
+						LabelScheme:                "HTTPS",
+						LabelTLSInsecureSkipVerify: "true",
+						LabelTLSServerName:         "pve.local",
+					},
+				},
+				NetworkSettings: &types.NetworkSettings{
+					Networks: map[string]*network.EndpointSettings{
+						"bridge": {IPAddress: "172.17.0.2"},
+					},
+				},
+			},
+			wantConfig: &ServiceConfig{
+				Name:                  "proxmox",
+				Port:                  8006,
+				IP:                    "172.17.0.2",
+				Network:               "bridge",
+				Scheme:                "https",
+				TLSInsecureSkipVerify: true,
+				TLSServerName:         "pve.local",
+			},
+		},
+		{
+			name: "port from EXPOSE",
+			containerJSON: types.ContainerJSON{
+				Config: &container.Config{
+					Labels: map[string]string{
+						LabelName: "immich",
+					},
+					ExposedPorts: nat.PortSet{"2283/tcp": {}},
+				},
+				NetworkSettings: &types.NetworkSettings{
+					Networks: map[string]*network.EndpointSettings{
+						"bridge": {IPAddress: "172.17.0.2"},
+					},
+				},
+			},
+			wantConfig: &ServiceConfig{
+				Name:    "immich",
+				Port:    2283,
+				IP:      "172.17.0.2",
+				Network: "bridge",
+				Scheme:  "http",
+			},
+		},
+		{
+			name: "https port from EXPOSE with scheme https",
+			containerJSON: types.ContainerJSON{
+				Config: &container.Config{
+					Labels: map[string]string{
+						LabelName:   "unifi",
+						LabelScheme: "https",
+					},
+					ExposedPorts: nat.PortSet{"443/tcp": {}},
+				},
+				NetworkSettings: &types.NetworkSettings{
+					Networks: map[string]*network.EndpointSettings{
+						"bridge": {IPAddress: "172.17.0.4"},
+					},
+				},
+			},
+			wantConfig: &ServiceConfig{
+				Name:    "unifi",
+				Port:    443,
+				IP:      "172.17.0.4",
+				Network: "bridge",
+				Scheme:  "https",
+			},
+		},
+		{
+			name: "https port from EXPOSE without scheme",
+			containerJSON: types.ContainerJSON{
+				Config: &container.Config{
+					Labels: map[string]string{
+						LabelName: "unifi",
+					},
+					ExposedPorts: nat.PortSet{"443/tcp": {}},
+				},
+				NetworkSettings: &types.NetworkSettings{
+					Networks: map[string]*network.EndpointSettings{
+						"bridge": {IPAddress: "172.17.0.4"},
+					},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "unix socket without port or network",
+			containerJSON: types.ContainerJSON{
+				Config: &container.Config{
+					Labels: map[string]string{
+						LabelName:   "portainer",
+						LabelSocket: "/run/sockets/portainer.sock",
+					},
+				},
+				NetworkSettings: &types.NetworkSettings{
+					Networks: map[string]*network.EndpointSettings{},
+				},
+			},
+			wantConfig: &ServiceConfig{
+				Name:   "portainer",
+				Socket: "/run/sockets/portainer.sock",
+				Scheme: "http",
+			},
+		},
+		{
+			name: "relative socket path",
+			containerJSON: types.ContainerJSON{
+				Config: &container.Config{
+					Labels: map[string]string{
+						LabelName:   "portainer",
+						LabelSocket: "portainer.sock",
+					},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid scheme",
+			containerJSON: types.ContainerJSON{
+				Config: &container.Config{
+					Labels: map[string]string{
+						LabelName:   "myservice",
+						LabelPort:   "8080",
+						LabelScheme: "ftp",
+					},
+				},
+				NetworkSettings: &types.NetworkSettings{
+					Networks: map[string]*network.EndpointSettings{
+						"bridge": {IPAddress: "172.17.0.2"},
+					},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "grpc protocol",
+			containerJSON: types.ContainerJSON{
+				Config: &container.Config{
+					Labels: map[string]string{
+						LabelName:     "grpcservice",
+						LabelPort:     "50051",
+						LabelProtocol: "grpc",
+					},
+				},
+				NetworkSettings: &types.NetworkSettings{
+					Networks: map[string]*network.EndpointSettings{
+						"bridge": {IPAddress: "172.17.0.2"},
+					},
+				},
+			},
+			wantConfig: &ServiceConfig{
+				Name:     "grpcservice",
+				Port:     50051,
+				IP:       "172.17.0.2",
+				Network:  "bridge",
+				Scheme:   "http",
+				Protocol: "grpc",
+			},
+		},
+		{
+			name: "invalid protocol",
+			containerJSON: types.ContainerJSON{
+				Config: &container.Config{
+					Labels: map[string]string{
+						LabelName:     "myservice",
+						LabelPort:     "8080",
+						LabelProtocol: "quic",
+					},
+				},
+				NetworkSettings: &types.NetworkSettings{
+					Networks: map[string]*network.EndpointSettings{
+						"bridge": {IPAddress: "172.17.0.2"},
+					},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid timeout label",
+			containerJSON: types.ContainerJSON{
+				Config: &container.Config{
+					Labels: map[string]string{
+						LabelName:         "myservice",
+						LabelPort:         "8080",
+						LabelTimeoutWrite: "soon",
+					},
+				},
+				NetworkSettings: &types.NetworkSettings{
+					Networks: map[string]*network.EndpointSettings{
+						"bridge": {IPAddress: "172.17.0.2"},
+					},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid insecure_skip_verify value",
+			containerJSON: types.ContainerJSON{
+				Config: &container.Config{
+					Labels: map[string]string{
+						LabelName:                  "myservice",
+						LabelPort:                  "8080",
+						LabelTLSInsecureSkipVerify: "maybe",
+					},
+				},
+				NetworkSettings: &types.NetworkSettings{
+					Networks: map[string]*network.EndpointSettings{
+						"bridge": {IPAddress: "172.17.0.2"},
+					},
+				},
+			},
+			wantErr: true,
+		},
 	}
 
 	for _, tt := range tests {
@@ -284,6 +702,18 @@ func TestInspectContainer(t *testing.T) {
 			if cfg.Network != tt.wantConfig.Network {
 				t.Errorf("Network = %q, want %q", cfg.Network, tt.wantConfig.Network)
 			}
+			if cfg.Scheme != tt.wantConfig.Scheme {
+				t.Errorf("Scheme = %q, want %q", cfg.Scheme, tt.wantConfig.Scheme)
+			}
+			if tt.wantConfig.Protocol != "" && cfg.Protocol != tt.wantConfig.Protocol {
+				t.Errorf("Protocol = %q, want %q", cfg.Protocol, tt.wantConfig.Protocol)
+			}
+			if cfg.TLSInsecureSkipVerify != tt.wantConfig.TLSInsecureSkipVerify {
+				t.Errorf("TLSInsecureSkipVerify = %v, want %v", cfg.TLSInsecureSkipVerify, tt.wantConfig.TLSInsecureSkipVerify)
+			}
+			if cfg.TLSServerName != tt.wantConfig.TLSServerName {
+				t.Errorf("TLSServerName = %q, want %q", cfg.TLSServerName, tt.wantConfig.TLSServerName)
+			}
 		})
 	}
 }
@@ -521,6 +951,151 @@ func TestHandleEvent(t *testing.T) {
 	})
 }
 
+func TestWatcher_LabelPrefixAndInstance(t *testing.T) {
+	logger := slog.Default()
+	networks := &types.NetworkSettings{
+		Networks: map[string]*network.EndpointSettings{
+			"bridge": {IPAddress: "172.17.0.2"},
+		},
+	}
+
+	tests := []struct {
+		name     string
+		prefix   string
+		instance string
+		labels   map[string]string
+		wantName string
+		wantErr  bool
+	}{
+		{
+			name:     "default prefix",
+			labels:   map[string]string{"dovetail.name": "wiki", "dovetail.port": "80"},
+			wantName: "wiki",
+		},
+		{
+			name:     "custom prefix",
+			prefix:   "work",
+			labels:   map[string]string{"work.name": "wiki", "work.port": "80", "work.http": "redirect", "dovetail.name": "personal-wiki"},
+			wantName: "wiki",
+		},
+		{
+			name:    "custom prefix ignores default labels",
+			prefix:  "work",
+			labels:  map[string]string{"dovetail.name": "wiki", "dovetail.port": "80"},
+			wantErr: true,
+		},
+		{
+			name:     "matching instance",
+			instance: "work",
+			labels:   map[string]string{"dovetail.name": "wiki", "dovetail.port": "80", "dovetail.instance": "work"},
+			wantName: "wiki",
+		},
+		{
+			name:     "other instance",
+			instance: "work",
+			labels:   map[string]string{"dovetail.name": "wiki", "dovetail.port": "80", "dovetail.instance": "home"},
+			wantErr:  true,
+		},
+		{
+			name:     "unassigned container with named instance",
+			instance: "work",
+			labels:   map[string]string{"dovetail.name": "wiki", "dovetail.port": "80"},
+			wantErr:  true,
+		},
+		{
+			name:    "assigned container with unnamed instance",
+			labels:  map[string]string{"dovetail.name": "wiki", "dovetail.port": "80", "dovetail.instance": "work"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := &mockDockerClient{
+				containerJSON: types.ContainerJSON{
+					Config:          &container.Config{Labels: tt.labels},
+					NetworkSettings: networks,
+				},
+			}
+			w := NewWatcherWithClient(mock, logger)
+			if tt.prefix != "" {
+				w.SetLabelPrefix(tt.prefix)
+			}
+			w.SetInstance(tt.instance)
+
+			cfg, err := w.inspectContainer(context.Background(), "test-container-id")
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("expected error, got config %+v", cfg)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if cfg.Name != tt.wantName {
+				t.Errorf("Name = %q, want %q", cfg.Name, tt.wantName)
+			}
+			if tt.prefix == "work" && cfg.HTTP != "redirect" {
+				t.Errorf("HTTP = %q, want prefixed label to apply", cfg.HTTP)
+			}
+		})
+	}
+
+	t.Run("errors name prefixed labels", func(t *testing.T) {
+		for _, tt := range []struct {
+			labels map[string]string
+			want   string
+		}{
+			{map[string]string{"work.name": "wiki", "work.port": "80", "work.http": "sometimes"}, "invalid work.http value"},
+			{map[string]string{"work.name": "wiki", "work.port": "80", "work.headers.map.X-User": "shoe size"}, "invalid work.headers.map.X-User value"},
+			{map[string]string{"work.name": "wiki", "work.port": "80", "work.published": "maybe"}, "invalid work.published value"},
+			{map[string]string{"work.name": "wiki", "work.port": "eighty"}, "invalid work.port value"},
+			{map[string]string{"work.name": "wiki", "work.socket": "app.sock"}, "invalid work.socket value"},
+			{map[string]string{"work.name": "wiki"}, "set the work.port label"},
+		} {
+			mock := &mockDockerClient{
+				containerJSON: types.ContainerJSON{
+					Config:          &container.Config{Labels: tt.labels},
+					NetworkSettings: networks,
+				},
+			}
+			w := NewWatcherWithClient(mock, logger)
+			w.SetLabelPrefix("work")
+
+			_, err := w.inspectContainer(context.Background(), "test-container-id")
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("error for %v = %v, want it to contain %q", tt.labels, err, tt.want)
+			}
+		}
+	})
+
+	t.Run("stop events", func(t *testing.T) {
+		w := NewWatcherWithClient(&mockDockerClient{}, logger)
+		w.SetLabelPrefix("work")
+		w.SetInstance("laptop")
+
+		for _, tt := range []struct {
+			attrs map[string]string
+			want  bool
+		}{
+			{map[string]string{"work.name": "wiki", "work.instance": "laptop"}, true},
+			{map[string]string{"work.name": "wiki", "work.instance": "server"}, false},
+			{map[string]string{"work.name": "wiki"}, false},
+			{map[string]string{"dovetail.name": "wiki"}, false},
+		} {
+			eventsChan := make(chan ContainerEvent, 1)
+			w.handleEvent(context.Background(), events.Message{
+				Action: "die",
+				Actor:  events.Actor{ID: "container123", Attributes: tt.attrs},
+			}, eventsChan)
+			if got := len(eventsChan) == 1; got != tt.want {
+				t.Errorf("stop event for %v sent = %v, want %v", tt.attrs, got, tt.want)
+			}
+		}
+	})
+}
+
 func TestNewWatcherWithClient(t *testing.T) {
 	logger := slog.Default()
 	mock := &mockDockerClient{}
@@ -537,3 +1112,445 @@ func TestNewWatcherWithClient(t *testing.T) {
 		t.Error("logger not set correctly")
 	}
 }
+
+func TestParseTimeoutLabels(t *testing.T) {
+	cfg := &ServiceConfig{}
+	err := parseTimeoutLabels(map[string]string{
+		LabelTimeoutRead:  "10m",
+		LabelTimeoutWrite: "0",
+	}, cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if cfg.ReadTimeout == nil || *cfg.ReadTimeout != 10*time.Minute {
+		t.Errorf("ReadTimeout = %v, want 10m", cfg.ReadTimeout)
+	}
+	if cfg.WriteTimeout == nil || *cfg.WriteTimeout != 0 {
+		t.Errorf("WriteTimeout = %v, want 0", cfg.WriteTimeout)
+	}
+	if cfg.ReadHeaderTimeout != nil {
+		t.Errorf("ReadHeaderTimeout = %v, want nil (unset)", *cfg.ReadHeaderTimeout)
+	}
+	if cfg.IdleTimeout != nil {
+		t.Errorf("IdleTimeout = %v, want nil (unset)", *cfg.IdleTimeout)
+	}
+}
+
+func TestParseListenerLabels(t *testing.T) {
+	tests := []struct {
+		name     string
+		labels   map[string]string
+		wantHTTP string
+		wantErr  bool
+	}{
+		{"default off", map[string]string{}, "off", false},
+		{"redirect", map[string]string{LabelHTTP: "redirect"}, "redirect", false},
+		{"serve uppercase", map[string]string{LabelHTTP: "SERVE"}, "serve", false},
+		{"invalid", map[string]string{LabelHTTP: "yes"}, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &ServiceConfig{}
+			err := parseListenerLabels(tt.labels, cfg)
+
+			if tt.wantErr {
+				if err == nil {
+					t.Error("expected error but got nil")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if cfg.HTTP != tt.wantHTTP {
+				t.Errorf("HTTP = %q, want %q", cfg.HTTP, tt.wantHTTP)
+			}
+		})
+	}
+}
+
+func TestParseListenerLabels_Funnel(t *testing.T) {
+	t.Run("funnel with paths", func(t *testing.T) {
+		cfg := &ServiceConfig{}
+		err := parseListenerLabels(map[string]string{
+			LabelFunnel:      "true",
+			LabelFunnelPaths: "/share, /api/webhook,",
+		}, cfg)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if !cfg.Funnel {
+			t.Error("Funnel = false, want true")
+		}
+		if len(cfg.FunnelPaths) != 2 || cfg.FunnelPaths[0] != "/share" || cfg.FunnelPaths[1] != "/api/webhook" {
+			t.Errorf("FunnelPaths = %v, want [/share /api/webhook]", cfg.FunnelPaths)
+		}
+	})
+
+	t.Run("relative path rejected", func(t *testing.T) {
+		cfg := &ServiceConfig{}
+		err := parseListenerLabels(map[string]string{
+			LabelFunnel:      "true",
+			LabelFunnelPaths: "share",
+		}, cfg)
+		if err == nil {
+			t.Error("expected error but got nil")
+		}
+	})
+
+	t.Run("invalid funnel value", func(t *testing.T) {
+		cfg := &ServiceConfig{}
+		if err := parseListenerLabels(map[string]string{LabelFunnel: "public"}, cfg); err == nil {
+			t.Error("expected error but got nil")
+		}
+	})
+}
+
+func TestParseRateLimitLabels(t *testing.T) {
+	tests := []struct {
+		name      string
+		labels    map[string]string
+		wantReqs  int
+		wantPer   time.Duration
+		wantBurst int
+		wantBy    string
+		wantErr   bool
+	}{
+		{"unset", map[string]string{}, 0, 0, 0, "", false},
+		{"per minute", map[string]string{LabelRateLimit: "100/m"}, 100, time.Minute, 0, "user", false},
+		{"burst and node", map[string]string{
+			LabelRateLimit:      "10/s",
+			LabelRateLimitBurst: "20",
+			LabelRateLimitBy:    "node",
+		}, 10, time.Second, 20, "node", false},
+		{"missing unit", map[string]string{LabelRateLimit: "100"}, 0, 0, 0, "", true},
+		{"bad unit", map[string]string{LabelRateLimit: "100/d"}, 0, 0, 0, "", true},
+		{"zero requests", map[string]string{LabelRateLimit: "0/m"}, 0, 0, 0, "", true},
+		{"bad burst", map[string]string{LabelRateLimit: "1/m", LabelRateLimitBurst: "-1"}, 0, 0, 0, "", true},
+		{"bad key", map[string]string{LabelRateLimit: "1/m", LabelRateLimitBy: "ip"}, 0, 0, 0, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &ServiceConfig{}
+			err := parseRateLimitLabels(tt.labels, cfg)
+
+			if tt.wantErr {
+				if err == nil {
+					t.Error("expected error but got nil")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if cfg.RateLimitRequests != tt.wantReqs {
+				t.Errorf("RateLimitRequests = %d, want %d", cfg.RateLimitRequests, tt.wantReqs)
+			}
+			if cfg.RateLimitPer != tt.wantPer {
+				t.Errorf("RateLimitPer = %v, want %v", cfg.RateLimitPer, tt.wantPer)
+			}
+			if cfg.RateLimitBurst != tt.wantBurst {
+				t.Errorf("RateLimitBurst = %d, want %d", cfg.RateLimitBurst, tt.wantBurst)
+			}
+			if cfg.RateLimitBy != tt.wantBy {
+				t.Errorf("RateLimitBy = %q, want %q", cfg.RateLimitBy, tt.wantBy)
+			}
+		})
+	}
+}
+
+func TestParseIdentityLabels(t *testing.T) {
+	tests := []struct {
+		name    string
+		labels  map[string]string
+		wantJWT bool
+		wantErr bool
+	}{
+		{"default off", map[string]string{}, false, false},
+		{"enabled", map[string]string{LabelIdentityJWT: "true"}, true, false},
+		{"invalid", map[string]string{LabelIdentityJWT: "sometimes"}, false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &ServiceConfig{}
+			err := parseIdentityLabels(tt.labels, cfg)
+
+			if tt.wantErr {
+				if err == nil {
+					t.Error("expected error but got nil")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if cfg.IdentityJWT != tt.wantJWT {
+				t.Errorf("IdentityJWT = %v, want %v", cfg.IdentityJWT, tt.wantJWT)
+			}
+		})
+	}
+}
+
+func TestParseIdentityLabels_Headers(t *testing.T) {
+	t.Run("preset and mappings", func(t *testing.T) {
+		cfg := &ServiceConfig{}
+		err := parseIdentityLabels(map[string]string{
+			LabelHeadersPreset:                   "Grafana",
+			LabelHeadersMapPrefix + "Remote-User": "login",
+			LabelHeadersMapPrefix + "X-Groups":    " Tags ",
+		}, cfg)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if cfg.HeadersPreset != "grafana" {
+			t.Errorf("HeadersPreset = %q, want %q", cfg.HeadersPreset, "grafana")
+		}
+		if cfg.HeadersMap["Remote-User"] != "login" || cfg.HeadersMap["X-Groups"] != "tags" {
+			t.Errorf("HeadersMap = %v", cfg.HeadersMap)
+		}
+		if cfg.HeadersLegacy != nil {
+			t.Errorf("HeadersLegacy = %v, want nil without the label", *cfg.HeadersLegacy)
+		}
+	})
+
+	t.Run("legacy override", func(t *testing.T) {
+		cfg := &ServiceConfig{}
+		if err := parseIdentityLabels(map[string]string{LabelHeadersLegacy: "false"}, cfg); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if cfg.HeadersLegacy == nil || *cfg.HeadersLegacy {
+			t.Errorf("HeadersLegacy = %v, want false", cfg.HeadersLegacy)
+		}
+	})
+
+	invalid := []map[string]string{
+		{LabelHeadersPreset: "keycloak"},
+		{LabelHeadersMapPrefix + "Remote-User": "password"},
+		{LabelHeadersMapPrefix + "Bad Header": "login"},
+		{LabelHeadersMapPrefix: "login"},
+		{LabelHeadersLegacy: "sometimes"},
+	}
+	for _, labels := range invalid {
+		if err := parseIdentityLabels(labels, &ServiceConfig{}); err == nil {
+			t.Errorf("expected error for %v", labels)
+		}
+	}
+}
+
+func TestParseUpstreamLabels_PreserveHost(t *testing.T) {
+	cfg := &ServiceConfig{}
+	if err := parseUpstreamLabels(map[string]string{LabelPreserveHost: "true"}, cfg); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !cfg.PreserveHost {
+		t.Error("PreserveHost = false, want true")
+	}
+
+	if err := parseUpstreamLabels(map[string]string{LabelPreserveHost: "yes please"}, &ServiceConfig{}); err == nil {
+		t.Error("expected error for invalid boolean")
+	}
+}
+
+func TestParseHeaderRuleLabels(t *testing.T) {
+	cfg := &ServiceConfig{}
+	err := parseHeaderRuleLabels(map[string]string{
+		LabelHeadersSecurity: "Strict",
+		LabelHeadersRequestPrefix + "set.X-Foo":                       "bar",
+		LabelHeadersResponsePrefix + "add.Access-Control-Allow-Origin": "*",
+		LabelHeadersResponsePrefix + "remove.Server":                  "true",
+		LabelHeadersResponsePrefix + "remove.X-Powered-By":            "false",
+	}, cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if cfg.SecurityHeaders != "strict" {
+		t.Errorf("SecurityHeaders = %q, want %q", cfg.SecurityHeaders, "strict")
+	}
+	if cfg.RequestHeaders.Set["X-Foo"] != "bar" {
+		t.Errorf("RequestHeaders.Set = %v", cfg.RequestHeaders.Set)
+	}
+	if cfg.ResponseHeaders.Add["Access-Control-Allow-Origin"] != "*" {
+		t.Errorf("ResponseHeaders.Add = %v", cfg.ResponseHeaders.Add)
+	}
+	if len(cfg.ResponseHeaders.Remove) != 1 || cfg.ResponseHeaders.Remove[0] != "Server" {
+		t.Errorf("ResponseHeaders.Remove = %v, want [Server]", cfg.ResponseHeaders.Remove)
+	}
+
+	invalid := []map[string]string{
+		{LabelHeadersSecurity: "paranoid"},
+		{LabelHeadersRequestPrefix + "replace.X-Foo": "bar"},
+		{LabelHeadersResponsePrefix + "set.": "bar"},
+		{LabelHeadersResponsePrefix + "remove.Server": "please"},
+	}
+	for _, labels := range invalid {
+		if err := parseHeaderRuleLabels(labels, &ServiceConfig{}); err == nil {
+			t.Errorf("expected error for %v", labels)
+		}
+	}
+}
+
+func TestParseCompressLabel(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    []string
+		wantErr bool
+	}{
+		{"", nil, false},
+		{"false", nil, false},
+		{"true", []string{"zstd", "br", "gzip"}, false},
+		{"GZIP, br", []string{"gzip", "br"}, false},
+		{"deflate", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := parseCompressLabel(map[string]string{LabelCompress: tt.value})
+			if tt.wantErr {
+				if err == nil {
+					t.Error("expected error but got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("encodings = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseCacheLabels(t *testing.T) {
+	tests := []struct {
+		name       string
+		labels     map[string]string
+		wantCache  bool
+		wantMemory int64
+		wantDisk   int64
+		wantErr    bool
+	}{
+		{"unset", map[string]string{}, false, 0, 0, false},
+		{"enabled", map[string]string{LabelCache: "true"}, true, 0, 0, false},
+		{"sizes", map[string]string{LabelCache: "true", LabelCacheMemory: "16MB", LabelCacheDisk: "1GB"}, true, 16 << 20, 1 << 30, false},
+		{"sizes ignored when disabled", map[string]string{LabelCache: "false", LabelCacheMemory: "16MB"}, false, 0, 0, false},
+		{"bad switch", map[string]string{LabelCache: "maybe"}, false, 0, 0, true},
+		{"bad size", map[string]string{LabelCache: "true", LabelCacheDisk: "lots"}, false, 0, 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &ServiceConfig{}
+			err := parseCacheLabels(tt.labels, cfg)
+
+			if tt.wantErr {
+				if err == nil {
+					t.Error("expected error but got nil")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if cfg.Cache != tt.wantCache {
+				t.Errorf("Cache = %v, want %v", cfg.Cache, tt.wantCache)
+			}
+			if cfg.CacheMemory != tt.wantMemory {
+				t.Errorf("CacheMemory = %d, want %d", cfg.CacheMemory, tt.wantMemory)
+			}
+			if cfg.CacheDisk != tt.wantDisk {
+				t.Errorf("CacheDisk = %d, want %d", cfg.CacheDisk, tt.wantDisk)
+			}
+		})
+	}
+}
+
+func TestParseRetryLabels(t *testing.T) {
+	cfg := &ServiceConfig{}
+	err := parseRetryLabels(map[string]string{
+		LabelRetryAttempts:   "3",
+		LabelRetryBackoff:    "250ms",
+		LabelRetryMaxBody:    "64KB",
+		LabelBreakerFailures: "5",
+		LabelBreakerCooldown: "1m",
+	}, cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.RetryAttempts != 3 || cfg.RetryBackoff != 250*time.Millisecond || cfg.RetryMaxBody != 64<<10 {
+		t.Errorf("retry = %d, %v, %d", cfg.RetryAttempts, cfg.RetryBackoff, cfg.RetryMaxBody)
+	}
+	if cfg.BreakerFailures != 5 || cfg.BreakerCooldown != time.Minute {
+		t.Errorf("breaker = %d, %v", cfg.BreakerFailures, cfg.BreakerCooldown)
+	}
+
+	invalid := []map[string]string{
+		{LabelRetryAttempts: "-1"},
+		{LabelRetryAttempts: "many"},
+		{LabelRetryAttempts: "64"},
+		{LabelRetryBackoff: "soon"},
+		{LabelRetryMaxBody: "big"},
+		{LabelBreakerFailures: "1.5"},
+		{LabelBreakerCooldown: "-1s"},
+	}
+	for _, labels := range invalid {
+		if err := parseRetryLabels(labels, &ServiceConfig{}); err == nil {
+			t.Errorf("expected error for %v", labels)
+		}
+	}
+}
+
+func TestParseLimitLabels(t *testing.T) {
+	cfg := &ServiceConfig{}
+	err := parseLimitLabels(map[string]string{LabelMaxBodySize: "100MB"}, cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if cfg.MaxBodySize == nil || *cfg.MaxBodySize != 100<<20 {
+		t.Errorf("MaxBodySize = %v, want 100MB", cfg.MaxBodySize)
+	}
+	if cfg.MaxHeaderBytes != nil {
+		t.Errorf("MaxHeaderBytes = %v, want nil (unset)", *cfg.MaxHeaderBytes)
+	}
+
+	if err := parseLimitLabels(map[string]string{LabelMaxHeaderBytes: "-1"}, &ServiceConfig{}); err == nil {
+		t.Error("expected error for negative size")
+	}
+	if err := parseLimitLabels(map[string]string{LabelMaxHeaderBytes: "8GB"}, &ServiceConfig{}); err == nil {
+		t.Error("expected error for a header limit above the maximum")
+	}
+}
+
+func TestParseMaintenanceLabels(t *testing.T) {
+	cfg := &ServiceConfig{}
+	err := parseMaintenanceLabels(map[string]string{
+		LabelMaintenance:        "true",
+		LabelMaintenanceMessage: "Back at 10:00 UTC",
+		LabelMaintenanceAllow:   "alice@example.com, tag:ops,",
+	}, cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !cfg.Maintenance || cfg.MaintenanceMessage != "Back at 10:00 UTC" {
+		t.Errorf("Maintenance = %v, %q", cfg.Maintenance, cfg.MaintenanceMessage)
+	}
+	if got := strings.Join(cfg.MaintenanceAllow, "|"); got != "alice@example.com|tag:ops" {
+		t.Errorf("MaintenanceAllow = %q", got)
+	}
+
+	if err := parseMaintenanceLabels(map[string]string{LabelMaintenance: "soon"}, &ServiceConfig{}); err == nil {
+		t.Error("expected error for invalid boolean")
+	}
+}
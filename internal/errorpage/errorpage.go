@@ -0,0 +1,198 @@
+package errorpage
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//go:embed templates/error.html
+var templates embed.FS
+
+// Page describes an error response
+type Page struct {
+	Status  int
+	Service string
+	// Title and Message override the default heading and explanation for
+	// Status
+	Title   string
+	Message string
+	// Template names an optional "<template>.html" override, used in
+	// preference to the status templates
+	Template string
+}
+
+// data is what templates are rendered with
+type data struct {
+	Status  int
+	Title   string
+	Message string
+	Service string
+	Time    time.Time
+	Retry   bool
+}
+
+// Renderer writes error responses as HTML pages or JSON. Templates named
+// "<status>.html" or "error.html" in the override directory replace the
+// built-in page; other names are used for pages that ask for them, such
+// as "maintenance.html".
+type Renderer struct {
+	fallback  *template.Template
+	overrides map[int]*template.Template
+	named     map[string]*template.Template
+	now       func() time.Time
+}
+
+// Default returns a Renderer using only the built-in template
+func Default() *Renderer {
+	return &Renderer{
+		fallback:  template.Must(template.ParseFS(templates, "templates/error.html")),
+		overrides: make(map[int]*template.Template),
+		named:     make(map[string]*template.Template),
+		now:       time.Now,
+	}
+}
+
+// New loads template overrides from dir. An empty dir uses the built-in
+// template only.
+func New(dir string) (*Renderer, error) {
+	r := Default()
+	if dir == "" {
+		return r, nil
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read error pages directory: %w", err)
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || filepath.Ext(name) != ".html" {
+			continue
+		}
+
+		tmpl, err := template.ParseFiles(filepath.Join(dir, name))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse error page %s: %w", name, err)
+		}
+
+		base := strings.TrimSuffix(name, ".html")
+		if base == "error" {
+			r.fallback = tmpl
+			continue
+		}
+
+		status, err := strconv.Atoi(base)
+		if err != nil {
+			r.named[base] = tmpl
+			continue
+		}
+		if http.StatusText(status) == "" {
+			continue
+		}
+		r.overrides[status] = tmpl
+	}
+
+	return r, nil
+}
+
+// Render writes page to w, as JSON when the client asks for it
+func (r *Renderer) Render(w http.ResponseWriter, req *http.Request, page Page) {
+	d := data{
+		Status:  page.Status,
+		Title:   page.Title,
+		Message: page.Message,
+		Service: page.Service,
+		Time:    r.now(),
+		Retry:   retryable(page.Status),
+	}
+	if d.Title == "" {
+		d.Title = http.StatusText(page.Status)
+	}
+	if d.Message == "" {
+		d.Message = defaultMessage(page.Status)
+	}
+
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Set("Cache-Control", "no-store")
+	h.Set("X-Content-Type-Options", "nosniff")
+
+	if wantsJSON(req) {
+		h.Set("Content-Type", "application/json")
+		w.WriteHeader(page.Status)
+		json.NewEncoder(w).Encode(map[string]any{
+			"status":  d.Status,
+			"error":   d.Title,
+			"message": d.Message,
+			"service": d.Service,
+			"time":    d.Time.UTC().Format(time.RFC3339),
+		})
+		return
+	}
+
+	tmpl := r.fallback
+	if t, ok := r.named[page.Template]; ok {
+		tmpl = t
+	} else if t, ok := r.overrides[page.Status]; ok {
+		tmpl = t
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, d); err != nil {
+		h.Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(page.Status)
+		fmt.Fprintf(w, "%d %s\n", d.Status, d.Title)
+		return
+	}
+
+	h.Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(page.Status)
+	w.Write(buf.Bytes())
+}
+
+func wantsJSON(req *http.Request) bool {
+	for _, part := range strings.Split(req.Header.Get("Accept"), ",") {
+		mediaType := strings.TrimSpace(strings.SplitN(part, ";", 2)[0])
+		if mediaType == "application/json" || strings.HasSuffix(mediaType, "+json") {
+			return true
+		}
+	}
+	return false
+}
+
+func retryable(status int) bool {
+	switch status {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+func defaultMessage(status int) string {
+	switch status {
+	case http.StatusBadGateway:
+		return "The service could not be reached. Its container may be stopped or restarting."
+	case http.StatusServiceUnavailable:
+		return "The service is temporarily unavailable."
+	case http.StatusGatewayTimeout:
+		return "The service took too long to respond."
+	case http.StatusForbidden:
+		return "You don't have access to this page."
+	case http.StatusRequestEntityTooLarge:
+		return "The request is larger than this service accepts."
+	case http.StatusTooManyRequests:
+		return "You're sending too many requests. Slow down and try again shortly."
+	default:
+		return http.StatusText(status) + "."
+	}
+}
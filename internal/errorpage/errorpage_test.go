@@ -0,0 +1,142 @@
+package errorpage
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRender_HTML(t *testing.T) {
+	r := Default()
+	r.now = func() time.Time { return time.Date(2025, 12, 25, 21, 0, 0, 0, time.UTC) }
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Accept", "text/html,application/xhtml+xml")
+	w := httptest.NewRecorder()
+
+	r.Render(w, req, Page{Status: http.StatusBadGateway, Service: "immich"})
+
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("StatusCode = %d, want %d", w.Code, http.StatusBadGateway)
+	}
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/html") {
+		t.Errorf("Content-Type = %q, want text/html", ct)
+	}
+
+	body := w.Body.String()
+	for _, want := range []string{"502", "Bad Gateway", "immich", "2025-12-25 21:00:00", "Try again"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("body missing %q", want)
+		}
+	}
+}
+
+func TestRender_NoRetryHintForForbidden(t *testing.T) {
+	r := Default()
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	w := httptest.NewRecorder()
+
+	r.Render(w, req, Page{Status: http.StatusForbidden, Message: "Nope."})
+
+	body := w.Body.String()
+	if !strings.Contains(body, "Nope.") {
+		t.Error("body missing custom message")
+	}
+	if strings.Contains(body, "Try again") {
+		t.Error("body should not contain retry hint for 403")
+	}
+}
+
+func TestRender_JSON(t *testing.T) {
+	r := Default()
+
+	req := httptest.NewRequest(http.MethodGet, "/api/assets", nil)
+	req.Header.Set("Accept", "application/json, text/plain;q=0.9")
+	w := httptest.NewRecorder()
+
+	r.Render(w, req, Page{Status: http.StatusGatewayTimeout, Service: "immich"})
+
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type = %q, want application/json", ct)
+	}
+
+	var body map[string]any
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("invalid JSON: %v", err)
+	}
+	if body["status"] != float64(http.StatusGatewayTimeout) {
+		t.Errorf("status = %v, want %d", body["status"], http.StatusGatewayTimeout)
+	}
+	if body["error"] != "Gateway Timeout" {
+		t.Errorf("error = %v, want %q", body["error"], "Gateway Timeout")
+	}
+	if body["service"] != "immich" {
+		t.Errorf("service = %v, want %q", body["service"], "immich")
+	}
+}
+
+func TestNew_Overrides(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "503.html"), []byte("custom 503 for {{.Service}}"), 0644)
+	os.WriteFile(filepath.Join(dir, "error.html"), []byte("generic {{.Status}}"), 0644)
+	os.WriteFile(filepath.Join(dir, "maintenance.html"), []byte("{{.Title}}: {{.Message}}"), 0644)
+	os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("ignored"), 0644)
+
+	r, err := New(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		status int
+		want   string
+	}{
+		{http.StatusServiceUnavailable, "custom 503 for web"},
+		{http.StatusBadGateway, "generic 502"},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		w := httptest.NewRecorder()
+		r.Render(w, req, Page{Status: tt.status, Service: "web"})
+
+		if got := w.Body.String(); got != tt.want {
+			t.Errorf("status %d body = %q, want %q", tt.status, got, tt.want)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	w := httptest.NewRecorder()
+	r.Render(w, req, Page{Status: http.StatusServiceUnavailable, Template: "maintenance", Title: "Upgrading", Message: "Back at 10:00."})
+	if got, want := w.Body.String(), "Upgrading: Back at 10:00."; got != want {
+		t.Errorf("named template body = %q, want %q", got, want)
+	}
+}
+
+func TestNew_Errors(t *testing.T) {
+	if _, err := New(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("expected error for missing directory")
+	}
+
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "502.html"), []byte("{{.Broken"), 0644)
+	if _, err := New(dir); err == nil {
+		t.Error("expected error for invalid template")
+	}
+}
+
+func TestNew_EmptyDir(t *testing.T) {
+	r, err := New("")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if r == nil {
+		t.Fatal("expected non-nil renderer")
+	}
+}
@@ -0,0 +1,306 @@
+package identity
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// DefaultTTL is how long a signed identity assertion stays valid. Tokens
+// are minted per request, so this only needs to cover clock skew and the
+// time the backend takes to verify it.
+const DefaultTTL = 60 * time.Second
+
+// Issuer is the "iss" claim of every assertion
+const Issuer = "dovetail"
+
+// KeyFile is the signing key's file name within the state directory
+const KeyFile = "identity-key.pem"
+
+// JWKSPath is where the admin server publishes the key set
+const JWKSPath = "/.well-known/jwks.json"
+
+// ServiceJWKSPath is where each service that signs assertions publishes
+// the key set on its own node. It's reserved rather than JWKSPath so it
+// doesn't hide the app's own key set.
+const ServiceJWKSPath = "/.well-known/dovetail/jwks.json"
+
+// Claims is the payload of an identity assertion. Audience is the service
+// name, so a token captured by one backend can't be replayed to another.
+type Claims struct {
+	Issuer    string `json:"iss"`
+	Subject   string `json:"sub"`
+	Audience  string `json:"aud"`
+	IssuedAt  int64  `json:"iat"`
+	NotBefore int64  `json:"nbf"`
+	Expiry    int64  `json:"exp"`
+
+	Login string   `json:"login,omitempty"`
+	Name  string   `json:"name,omitempty"`
+	Node  string   `json:"node,omitempty"`
+	Tags  []string `json:"tags,omitempty"`
+
+	// Capabilities are the peer capabilities granted to the caller by the
+	// tailnet policy, keyed by capability name.
+	Capabilities map[string][]json.RawMessage `json:"capabilities,omitempty"`
+}
+
+// Email returns a tailnet login name if it's an email address, or "" if
+// it isn't. Logins through GitHub or a passkey look like "alice@github"
+// or "alice@passkey", whose domain isn't a mail domain.
+func Email(login string) string {
+	local, domain, ok := strings.Cut(login, "@")
+	if !ok || local == "" || strings.Contains(domain, "@") {
+		return ""
+	}
+	if !strings.Contains(domain, ".") || strings.HasPrefix(domain, ".") || strings.HasSuffix(domain, ".") {
+		return ""
+	}
+	return login
+}
+
+// Signer mints ES256 JWTs with a P-256 key persisted on disk
+type Signer struct {
+	key   *ecdsa.PrivateKey
+	keyID string
+	ttl   time.Duration
+	now   func() time.Time
+}
+
+// LoadOrCreate reads the signing key at path, generating and saving a new
+// one if it doesn't exist yet. Keeping the key across restarts means
+// backends that cache the JWKS keep verifying tokens.
+func LoadOrCreate(path string) (*Signer, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return create(path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read identity key: %w", err)
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in identity key %s", path)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse identity key: %w", err)
+	}
+	key, ok := parsed.(*ecdsa.PrivateKey)
+	if !ok || key.Curve != elliptic.P256() {
+		return nil, fmt.Errorf("identity key %s is not a P-256 ECDSA key", path)
+	}
+
+	return newSigner(key), nil
+}
+
+func create(path string) (*Signer, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate identity key: %w", err)
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode identity key: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create identity key directory: %w", err)
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		return nil, fmt.Errorf("failed to write identity key: %w", err)
+	}
+
+	return newSigner(key), nil
+}
+
+func newSigner(key *ecdsa.PrivateKey) *Signer {
+	return &Signer{
+		key:   key,
+		keyID: thumbprint(&key.PublicKey),
+		ttl:   DefaultTTL,
+		now:   time.Now,
+	}
+}
+
+// KeyID returns the "kid" of the signing key, its RFC 7638 thumbprint
+func (s *Signer) KeyID() string {
+	return s.keyID
+}
+
+// Sign fills in the registered time claims and returns the compact JWT
+func (s *Signer) Sign(claims Claims) (string, error) {
+	now := s.now()
+	claims.Issuer = Issuer
+	claims.IssuedAt = now.Unix()
+	claims.NotBefore = now.Unix()
+	claims.Expiry = now.Add(s.ttl).Unix()
+	return s.SignClaims(claims)
+}
+
+// SignClaims returns a compact JWT for an arbitrary claims value, which
+// must set its own registered claims. It lets other token issuers, such as
+// the OIDC provider, share the key published in the JWKS.
+func (s *Signer) SignClaims(claims any) (string, error) {
+	header, err := json.Marshal(map[string]string{
+		"alg": "ES256",
+		"typ": "JWT",
+		"kid": s.keyID,
+	})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode claims: %w", err)
+	}
+
+	signingInput := b64(header) + "." + b64(payload)
+	digest := sha256.Sum256([]byte(signingInput))
+
+	r, sig, err := ecdsa.Sign(rand.Reader, s.key, digest[:])
+	if err != nil {
+		return "", fmt.Errorf("failed to sign claims: %w", err)
+	}
+
+	// JWS uses the fixed-width r||s encoding rather than ASN.1
+	raw := make([]byte, 64)
+	r.FillBytes(raw[:32])
+	sig.FillBytes(raw[32:])
+
+	return signingInput + "." + b64(raw), nil
+}
+
+// Verify checks a token's signature and time claims and returns its claims
+func (s *Signer) Verify(token string) (*Claims, error) {
+	var claims Claims
+	if err := s.VerifyClaims(token, &claims); err != nil {
+		return nil, err
+	}
+
+	now := s.now().Unix()
+	if now >= claims.Expiry {
+		return nil, errors.New("token has expired")
+	}
+	if now < claims.NotBefore {
+		return nil, errors.New("token is not valid yet")
+	}
+	return &claims, nil
+}
+
+// VerifyClaims checks a token's signature and decodes its payload into
+// claims. Time-based claims are left to the caller.
+func (s *Signer) VerifyClaims(token string, claims any) error {
+	return verify(&s.key.PublicKey, token, claims)
+}
+
+// jwk is the public half of the signing key in RFC 7517 form
+type jwk struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	Kid string `json:"kid,omitempty"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+}
+
+func publicJWK(pub *ecdsa.PublicKey) jwk {
+	x := make([]byte, 32)
+	y := make([]byte, 32)
+	pub.X.FillBytes(x)
+	pub.Y.FillBytes(y)
+	return jwk{Kty: "EC", Crv: "P-256", X: b64(x), Y: b64(y)}
+}
+
+// JWKS returns the JSON Web Key Set backends use to verify assertions
+func (s *Signer) JWKS() []byte {
+	key := publicJWK(&s.key.PublicKey)
+	key.Kid = s.keyID
+	key.Use = "sig"
+	key.Alg = "ES256"
+
+	data, _ := json.Marshal(map[string][]jwk{"keys": {key}})
+	return data
+}
+
+// JWKSHandler serves the key set
+func (s *Signer) JWKSHandler() http.Handler {
+	jwks := s.JWKS()
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/jwk-set+json")
+		w.Header().Set("Cache-Control", "public, max-age=300")
+		w.Write(jwks)
+	})
+}
+
+// thumbprint computes the RFC 7638 JWK thumbprint, which hashes the
+// required members in lexicographic order
+func thumbprint(pub *ecdsa.PublicKey) string {
+	k := publicJWK(pub)
+	canonical := fmt.Sprintf(`{"crv":%q,"kty":%q,"x":%q,"y":%q}`, k.Crv, k.Kty, k.X, k.Y)
+	sum := sha256.Sum256([]byte(canonical))
+	return b64(sum[:])
+}
+
+func verify(pub *ecdsa.PublicKey, token string, claims any) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return errors.New("malformed token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return fmt.Errorf("invalid header: %w", err)
+	}
+	if header.Alg != "ES256" {
+		return fmt.Errorf("unexpected algorithm %q", header.Alg)
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || len(sig) != 64 {
+		return errors.New("invalid signature encoding")
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	r := new(big.Int).SetBytes(sig[:32])
+	sv := new(big.Int).SetBytes(sig[32:])
+	if !ecdsa.Verify(pub, digest[:], r, sv) {
+		return errors.New("signature verification failed")
+	}
+
+	if err := decodeSegment(parts[1], claims); err != nil {
+		return fmt.Errorf("invalid claims: %w", err)
+	}
+	return nil
+}
+
+func decodeSegment(seg string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func b64(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
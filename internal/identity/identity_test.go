@@ -0,0 +1,133 @@
+package identity
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadOrCreate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state", KeyFile)
+
+	first, err := LoadOrCreate(path)
+	if err != nil {
+		t.Fatalf("unexpected error creating key: %v", err)
+	}
+
+	second, err := LoadOrCreate(path)
+	if err != nil {
+		t.Fatalf("unexpected error loading key: %v", err)
+	}
+
+	if first.KeyID() != second.KeyID() {
+		t.Errorf("KeyID changed across loads: %q != %q", first.KeyID(), second.KeyID())
+	}
+}
+
+func TestSignAndVerify(t *testing.T) {
+	s, err := LoadOrCreate(filepath.Join(t.TempDir(), KeyFile))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	now := time.Unix(1700000000, 0)
+	s.now = func() time.Time { return now }
+
+	token, err := s.Sign(Claims{
+		Subject:      "alice@example.com",
+		Audience:     "grafana",
+		Login:        "alice@example.com",
+		Tags:         []string{"tag:admin"},
+		Capabilities: map[string][]json.RawMessage{"example.com/cap/admin": {json.RawMessage(`{"level":1}`)}},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error signing: %v", err)
+	}
+
+	claims, err := s.Verify(token)
+	if err != nil {
+		t.Fatalf("unexpected error verifying: %v", err)
+	}
+	if claims.Issuer != Issuer || claims.Audience != "grafana" || claims.Subject != "alice@example.com" {
+		t.Errorf("unexpected claims: %+v", claims)
+	}
+	if claims.Expiry != now.Add(DefaultTTL).Unix() {
+		t.Errorf("Expiry = %d, want %d", claims.Expiry, now.Add(DefaultTTL).Unix())
+	}
+	if len(claims.Tags) != 1 || claims.Tags[0] != "tag:admin" {
+		t.Errorf("Tags = %v, want [tag:admin]", claims.Tags)
+	}
+	if got := string(claims.Capabilities["example.com/cap/admin"][0]); got != `{"level":1}` {
+		t.Errorf("capability value = %s", got)
+	}
+
+	t.Run("tampered payload", func(t *testing.T) {
+		parts := strings.Split(token, ".")
+		forged, _ := json.Marshal(Claims{Subject: "mallory@example.com", Expiry: now.Add(time.Hour).Unix()})
+		parts[1] = b64(forged)
+		if _, err := s.Verify(strings.Join(parts, ".")); err == nil {
+			t.Error("expected tampered token to fail verification")
+		}
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		now = now.Add(DefaultTTL)
+		if _, err := s.Verify(token); err == nil {
+			t.Error("expected expired token to fail verification")
+		}
+	})
+}
+
+func TestJWKSHandler(t *testing.T) {
+	s, err := LoadOrCreate(filepath.Join(t.TempDir(), KeyFile))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	s.JWKSHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, JWKSPath, nil))
+
+	if ct := w.Header().Get("Content-Type"); ct != "application/jwk-set+json" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &set); err != nil {
+		t.Fatalf("invalid JWKS: %v", err)
+	}
+	if len(set.Keys) != 1 {
+		t.Fatalf("got %d keys, want 1", len(set.Keys))
+	}
+
+	key := set.Keys[0]
+	if key.Kty != "EC" || key.Crv != "P-256" || key.Alg != "ES256" || key.Kid != s.KeyID() {
+		t.Errorf("unexpected key: %+v", key)
+	}
+}
+
+func TestEmail(t *testing.T) {
+	tests := []struct {
+		login string
+		want  string
+	}{
+		{"alice@example.com", "alice@example.com"},
+		{"alice@github", ""},
+		{"alice@passkey", ""},
+		{"alice", ""},
+		{"@example.com", ""},
+		{"alice@example.com.", ""},
+		{"alice@.com", ""},
+		{"alice@bob@example.com", ""},
+	}
+
+	for _, tt := range tests {
+		if got := Email(tt.login); got != tt.want {
+			t.Errorf("Email(%q) = %q, want %q", tt.login, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Registry holds a set of metrics and renders them in the Prometheus text
+// exposition format.
+type Registry struct {
+	mu      sync.Mutex
+	metrics []*Vec
+}
+
+// Default is the registry used by the package-level constructors
+var Default = NewRegistry()
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+type kind string
+
+const (
+	kindCounter kind = "counter"
+	kindGauge   kind = "gauge"
+)
+
+// Vec is a family of counters or gauges partitioned by label values
+type Vec struct {
+	name   string
+	help   string
+	kind   kind
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]*sample
+}
+
+type sample struct {
+	labelValues []string
+	value       float64
+}
+
+// NewCounterVec registers a counter with the Default registry
+func NewCounterVec(name, help string, labels ...string) *Vec {
+	return Default.NewCounterVec(name, help, labels...)
+}
+
+// NewGaugeVec registers a gauge with the Default registry
+func NewGaugeVec(name, help string, labels ...string) *Vec {
+	return Default.NewGaugeVec(name, help, labels...)
+}
+
+func (r *Registry) NewCounterVec(name, help string, labels ...string) *Vec {
+	return r.register(name, help, kindCounter, labels)
+}
+
+func (r *Registry) NewGaugeVec(name, help string, labels ...string) *Vec {
+	return r.register(name, help, kindGauge, labels)
+}
+
+func (r *Registry) register(name, help string, k kind, labels []string) *Vec {
+	v := &Vec{
+		name:   name,
+		help:   help,
+		kind:   k,
+		labels: labels,
+		values: make(map[string]*sample),
+	}
+
+	r.mu.Lock()
+	r.metrics = append(r.metrics, v)
+	r.mu.Unlock()
+
+	return v
+}
+
+// Inc adds one to the sample identified by labelValues
+func (v *Vec) Inc(labelValues ...string) {
+	v.Add(1, labelValues...)
+}
+
+// Add adds delta to the sample identified by labelValues
+func (v *Vec) Add(delta float64, labelValues ...string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.get(labelValues).value += delta
+}
+
+// Set replaces the sample identified by labelValues. It is intended for gauges.
+func (v *Vec) Set(value float64, labelValues ...string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.get(labelValues).value = value
+}
+
+// Delete removes the sample identified by labelValues
+func (v *Vec) Delete(labelValues ...string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	delete(v.values, strings.Join(labelValues, "\xff"))
+}
+
+// Value returns the current value of the sample identified by labelValues
+func (v *Vec) Value(labelValues ...string) float64 {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if s, ok := v.values[strings.Join(labelValues, "\xff")]; ok {
+		return s.value
+	}
+	return 0
+}
+
+func (v *Vec) get(labelValues []string) *sample {
+	if len(labelValues) != len(v.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", v.name, len(v.labels), len(labelValues)))
+	}
+
+	key := strings.Join(labelValues, "\xff")
+	s, ok := v.values[key]
+	if !ok {
+		s = &sample{labelValues: append([]string(nil), labelValues...)}
+		v.values[key] = s
+	}
+	return s
+}
+
+func (v *Vec) write(w io.Writer) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n", v.name, v.help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", v.name, v.kind)
+
+	keys := make([]string, 0, len(v.values))
+	for key := range v.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		s := v.values[key]
+		fmt.Fprintf(w, "%s%s %s\n", v.name, formatLabels(v.labels, s.labelValues), strconv.FormatFloat(s.value, 'g', -1, 64))
+	}
+}
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = fmt.Sprintf("%s=%q", name, values[i])
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// Write renders every registered metric in the Prometheus text format
+func (r *Registry) Write(w io.Writer) {
+	r.mu.Lock()
+	metrics := append([]*Vec(nil), r.metrics...)
+	r.mu.Unlock()
+
+	sort.Slice(metrics, func(i, j int) bool { return metrics[i].name < metrics[j].name })
+	for _, v := range metrics {
+		v.write(w)
+	}
+}
+
+// Handler serves the registry in the Prometheus text format
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		r.Write(w)
+	})
+}
@@ -0,0 +1,83 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCounterVec(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounterVec("test_requests_total", "Total requests.", "service", "code")
+
+	c.Inc("web", "200")
+	c.Inc("web", "200")
+	c.Add(3, "web", "502")
+
+	if got := c.Value("web", "200"); got != 2 {
+		t.Errorf("Value(web, 200) = %v, want 2", got)
+	}
+	if got := c.Value("web", "502"); got != 3 {
+		t.Errorf("Value(web, 502) = %v, want 3", got)
+	}
+	if got := c.Value("other", "200"); got != 0 {
+		t.Errorf("Value(other, 200) = %v, want 0", got)
+	}
+}
+
+func TestGaugeVec(t *testing.T) {
+	r := NewRegistry()
+	g := r.NewGaugeVec("test_exposed", "Exposed services.", "service")
+
+	g.Set(1, "web")
+	if got := g.Value("web"); got != 1 {
+		t.Errorf("Value(web) = %v, want 1", got)
+	}
+
+	g.Delete("web")
+	if got := g.Value("web"); got != 0 {
+		t.Errorf("Value(web) after Delete = %v, want 0", got)
+	}
+}
+
+func TestLabelCountMismatchPanics(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounterVec("test_total", "Test.", "service")
+
+	defer func() {
+		if recover() == nil {
+			t.Error("expected panic for wrong number of label values")
+		}
+	}()
+	c.Inc("a", "b")
+}
+
+func TestHandler(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounterVec("test_requests_total", "Total requests.", "service")
+	g := r.NewGaugeVec("test_up", "Whether the service is up.")
+
+	c.Inc("web")
+	g.Set(1)
+
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	w := httptest.NewRecorder()
+	r.Handler().ServeHTTP(w, req)
+
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Errorf("Content-Type = %q, want text/plain", ct)
+	}
+
+	body := w.Body.String()
+	for _, want := range []string{
+		"# TYPE test_requests_total counter",
+		`test_requests_total{service="web"} 1`,
+		"# TYPE test_up gauge",
+		"test_up 1",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("body missing %q:\n%s", want, body)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package oidc
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"slices"
+)
+
+// Client is an application registered with the provider
+type Client struct {
+	ID string `json:"id"`
+
+	// Secret authenticates confidential clients at the token endpoint.
+	// Public clients leave it empty and must use PKCE instead.
+	Secret string `json:"secret,omitempty"`
+
+	RedirectURIs []string `json:"redirect_uris"`
+}
+
+type clientsFile struct {
+	Clients []Client `json:"clients"`
+}
+
+// LoadClients reads client registrations from a JSON file of the form
+// {"clients": [{"id": "...", "secret": "...", "redirect_uris": ["..."]}]}
+func LoadClients(path string) ([]Client, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read OIDC clients file: %w", err)
+	}
+
+	var f clientsFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("failed to parse OIDC clients file: %w", err)
+	}
+
+	seen := make(map[string]bool)
+	for _, c := range f.Clients {
+		if c.ID == "" {
+			return nil, fmt.Errorf("OIDC client is missing an id")
+		}
+		if seen[c.ID] {
+			return nil, fmt.Errorf("duplicate OIDC client %q", c.ID)
+		}
+		seen[c.ID] = true
+
+		if len(c.RedirectURIs) == 0 {
+			return nil, fmt.Errorf("OIDC client %q has no redirect_uris", c.ID)
+		}
+		for _, uri := range c.RedirectURIs {
+			u, err := url.Parse(uri)
+			if err != nil || !u.IsAbs() || u.Fragment != "" {
+				return nil, fmt.Errorf("OIDC client %q has invalid redirect URI %q", c.ID, uri)
+			}
+		}
+	}
+
+	return f.Clients, nil
+}
+
+// allowsRedirect reports whether uri exactly matches a registered redirect
+func (c *Client) allowsRedirect(uri string) bool {
+	return slices.Contains(c.RedirectURIs, uri)
+}
+
+// public reports whether the client has no secret and so relies on PKCE
+func (c *Client) public() bool {
+	return c.Secret == ""
+}
+
+func (c *Client) checkSecret(secret string) bool {
+	return subtle.ConstantTimeCompare([]byte(c.Secret), []byte(secret)) == 1
+}
@@ -0,0 +1,428 @@
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jasonwu/dovetail/internal/errorpage"
+	"github.com/jasonwu/dovetail/internal/identity"
+	"tailscale.com/client/tailscale/apitype"
+)
+
+const (
+	// codeTTL is how long an authorization code can be redeemed
+	codeTTL = time.Minute
+
+	// tokenTTL is the lifetime of ID and access tokens
+	tokenTTL = time.Hour
+)
+
+// LocalClient is the WhoIs lookup used to authenticate callers
+type LocalClient interface {
+	WhoIs(ctx context.Context, remoteAddr string) (*apitype.WhoIsResponse, error)
+}
+
+// profile is the authenticated user an authorization was granted for
+type profile struct {
+	Subject string
+	Name    string
+	Login   string
+	Email   string
+	Picture string
+}
+
+type authCode struct {
+	clientID      string
+	redirectURI   string
+	nonce         string
+	scope         string
+	codeChallenge string
+	user          profile
+	authTime      time.Time
+	expires       time.Time
+}
+
+type accessToken struct {
+	clientID string
+	user     profile
+	scope    string
+	expires  time.Time
+}
+
+// Provider is a minimal OpenID Connect provider supporting the
+// authorization code flow. Users are authenticated by their tailnet
+// identity, so there is no login form or password.
+type Provider struct {
+	issuer      string
+	clients     map[string]*Client
+	signer      *identity.Signer
+	localClient LocalClient
+	errorPages  *errorpage.Renderer
+	logger      *slog.Logger
+	mux         *http.ServeMux
+	now         func() time.Time
+
+	mu     sync.Mutex
+	codes  map[string]*authCode
+	tokens map[string]*accessToken
+}
+
+// NewProvider creates a provider for issuer, the https URL it is served at
+func NewProvider(issuer string, clients []Client, signer *identity.Signer, localClient LocalClient, errorPages *errorpage.Renderer, logger *slog.Logger) *Provider {
+	if errorPages == nil {
+		errorPages = errorpage.Default()
+	}
+
+	p := &Provider{
+		issuer:      strings.TrimSuffix(issuer, "/"),
+		clients:     make(map[string]*Client, len(clients)),
+		signer:      signer,
+		localClient: localClient,
+		errorPages:  errorPages,
+		logger:      logger,
+		mux:         http.NewServeMux(),
+		now:         time.Now,
+		codes:       make(map[string]*authCode),
+		tokens:      make(map[string]*accessToken),
+	}
+	for i := range clients {
+		p.clients[clients[i].ID] = &clients[i]
+	}
+
+	p.mux.HandleFunc("GET /.well-known/openid-configuration", p.handleDiscovery)
+	p.mux.Handle("GET /jwks", signer.JWKSHandler())
+	p.mux.HandleFunc("GET /authorize", p.handleAuthorize)
+	p.mux.HandleFunc("POST /authorize", p.handleAuthorize)
+	p.mux.HandleFunc("POST /token", p.handleToken)
+	p.mux.HandleFunc("GET /userinfo", p.handleUserInfo)
+	p.mux.HandleFunc("POST /userinfo", p.handleUserInfo)
+
+	return p
+}
+
+func (p *Provider) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.mux.ServeHTTP(w, r)
+}
+
+func (p *Provider) handleDiscovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{
+		"issuer":                                p.issuer,
+		"authorization_endpoint":                p.issuer + "/authorize",
+		"token_endpoint":                        p.issuer + "/token",
+		"userinfo_endpoint":                     p.issuer + "/userinfo",
+		"jwks_uri":                              p.issuer + "/jwks",
+		"response_types_supported":              []string{"code"},
+		"grant_types_supported":                 []string{"authorization_code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"ES256"},
+		"scopes_supported":                      []string{"openid", "profile", "email"},
+		"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post", "none"},
+		"code_challenge_methods_supported":      []string{"S256"},
+		"claims_supported": []string{
+			"sub", "iss", "aud", "exp", "iat", "auth_time", "nonce",
+			"name", "preferred_username", "email", "picture",
+		},
+	})
+}
+
+func (p *Provider) handleAuthorize(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		p.renderError(w, r, http.StatusBadRequest, "The sign-in request is malformed.")
+		return
+	}
+
+	// Until the client and redirect URI are known to be valid, errors are
+	// shown to the user rather than redirected, per RFC 6749 section 4.1.2.1
+	client, ok := p.clients[r.Form.Get("client_id")]
+	if !ok {
+		p.renderError(w, r, http.StatusBadRequest, "The application requesting sign-in is not registered.")
+		return
+	}
+	redirectURI := r.Form.Get("redirect_uri")
+	if !client.allowsRedirect(redirectURI) {
+		p.renderError(w, r, http.StatusBadRequest, "The application's redirect URI is not registered.")
+		return
+	}
+
+	state := r.Form.Get("state")
+	redirectError := func(code, description string) {
+		redirectWith(w, r, redirectURI, url.Values{
+			"error":             {code},
+			"error_description": {description},
+			"state":             {state},
+		})
+	}
+
+	if r.Form.Get("response_type") != "code" {
+		redirectError("unsupported_response_type", "only the authorization code flow is supported")
+		return
+	}
+	scope := r.Form.Get("scope")
+	if !slices.Contains(strings.Fields(scope), "openid") {
+		redirectError("invalid_scope", "the openid scope is required")
+		return
+	}
+
+	challenge := r.Form.Get("code_challenge")
+	if method := r.Form.Get("code_challenge_method"); challenge != "" && method != "S256" {
+		redirectError("invalid_request", "code_challenge_method must be S256")
+		return
+	}
+	if challenge == "" && client.public() {
+		redirectError("invalid_request", "public clients must use PKCE")
+		return
+	}
+
+	user, ok := p.authenticate(r)
+	if !ok {
+		p.renderError(w, r, http.StatusForbidden, "Sign-in requires a personal tailnet device. Tagged devices and public visitors can't sign in.")
+		return
+	}
+
+	code := randomToken()
+	now := p.now()
+
+	p.mu.Lock()
+	p.sweep(now)
+	p.codes[code] = &authCode{
+		clientID:      client.ID,
+		redirectURI:   redirectURI,
+		nonce:         r.Form.Get("nonce"),
+		scope:         scope,
+		codeChallenge: challenge,
+		user:          user,
+		authTime:      now,
+		expires:       now.Add(codeTTL),
+	}
+	p.mu.Unlock()
+
+	p.logger.Info("oidc authorization granted", "client", client.ID, "user", user.Login)
+
+	redirectWith(w, r, redirectURI, url.Values{
+		"code":  {code},
+		"state": {state},
+	})
+}
+
+// authenticate identifies the caller from their tailnet connection
+func (p *Provider) authenticate(r *http.Request) (profile, bool) {
+	if p.localClient == nil {
+		return profile{}, false
+	}
+
+	whois, err := p.localClient.WhoIs(r.Context(), r.RemoteAddr)
+	if err != nil {
+		p.logger.Debug("failed to get whois info", "remote", r.RemoteAddr, "error", err)
+		return profile{}, false
+	}
+	if whois.UserProfile == nil || (whois.Node != nil && whois.Node.IsTagged()) {
+		return profile{}, false
+	}
+
+	// The user ID, unlike the login name, survives renames and changes of
+	// identity provider, and is never reused
+	return profile{
+		Subject: strconv.FormatInt(int64(whois.UserProfile.ID), 10),
+		Name:    whois.UserProfile.DisplayName,
+		Login:   whois.UserProfile.LoginName,
+		Email:   identity.Email(whois.UserProfile.LoginName),
+		Picture: whois.UserProfile.ProfilePicURL,
+	}, true
+}
+
+func (p *Provider) handleToken(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		tokenError(w, http.StatusBadRequest, "invalid_request", "malformed request body")
+		return
+	}
+
+	clientID, secret, hasBasic := r.BasicAuth()
+	if !hasBasic {
+		clientID = r.PostForm.Get("client_id")
+		secret = r.PostForm.Get("client_secret")
+	}
+	client, ok := p.clients[clientID]
+	if !ok || (!client.public() && !client.checkSecret(secret)) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="dovetail"`)
+		tokenError(w, http.StatusUnauthorized, "invalid_client", "client authentication failed")
+		return
+	}
+
+	if r.PostForm.Get("grant_type") != "authorization_code" {
+		tokenError(w, http.StatusBadRequest, "unsupported_grant_type", "only authorization_code is supported")
+		return
+	}
+
+	// Codes are single use, so remove it whether or not the exchange succeeds
+	p.mu.Lock()
+	code, ok := p.codes[r.PostForm.Get("code")]
+	delete(p.codes, r.PostForm.Get("code"))
+	p.mu.Unlock()
+
+	now := p.now()
+	if !ok || now.After(code.expires) || code.clientID != client.ID || code.redirectURI != r.PostForm.Get("redirect_uri") {
+		tokenError(w, http.StatusBadRequest, "invalid_grant", "the authorization code is invalid or expired")
+		return
+	}
+	if code.codeChallenge != "" && !verifyPKCE(code.codeChallenge, r.PostForm.Get("code_verifier")) {
+		tokenError(w, http.StatusBadRequest, "invalid_grant", "code_verifier does not match the code challenge")
+		return
+	}
+
+	idToken, err := p.signer.SignClaims(p.idTokenClaims(client.ID, code, now))
+	if err != nil {
+		p.logger.Error("failed to sign ID token", "client", client.ID, "error", err)
+		tokenError(w, http.StatusInternalServerError, "server_error", "failed to issue token")
+		return
+	}
+
+	access := randomToken()
+	p.mu.Lock()
+	p.tokens[access] = &accessToken{
+		clientID: client.ID,
+		user:     code.user,
+		scope:    code.scope,
+		expires:  now.Add(tokenTTL),
+	}
+	p.mu.Unlock()
+
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, map[string]any{
+		"access_token": access,
+		"token_type":   "Bearer",
+		"expires_in":   int(tokenTTL.Seconds()),
+		"id_token":     idToken,
+		"scope":        code.scope,
+	})
+}
+
+func (p *Provider) idTokenClaims(clientID string, code *authCode, now time.Time) map[string]any {
+	claims := map[string]any{
+		"iss":       p.issuer,
+		"sub":       code.user.Subject,
+		"aud":       clientID,
+		"iat":       now.Unix(),
+		"exp":       now.Add(tokenTTL).Unix(),
+		"auth_time": code.authTime.Unix(),
+	}
+	if code.nonce != "" {
+		claims["nonce"] = code.nonce
+	}
+	for k, v := range userClaims(code.user, code.scope) {
+		claims[k] = v
+	}
+	return claims
+}
+
+// userClaims returns the standard claims released for the granted scopes
+func userClaims(user profile, scope string) map[string]any {
+	scopes := strings.Fields(scope)
+	claims := map[string]any{"sub": user.Subject}
+
+	if slices.Contains(scopes, "profile") {
+		claims["name"] = user.Name
+		claims["preferred_username"] = user.Login
+		if user.Picture != "" {
+			claims["picture"] = user.Picture
+		}
+	}
+	if slices.Contains(scopes, "email") && user.Email != "" {
+		// dovetail can't tell whether the identity provider verified the
+		// address, so email_verified is left out
+		claims["email"] = user.Email
+	}
+	return claims
+}
+
+func (p *Provider) handleUserInfo(w http.ResponseWriter, r *http.Request) {
+	auth := r.Header.Get("Authorization")
+	token, ok := strings.CutPrefix(auth, "Bearer ")
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="dovetail"`)
+		tokenError(w, http.StatusUnauthorized, "invalid_token", "missing bearer token")
+		return
+	}
+
+	p.mu.Lock()
+	grant, ok := p.tokens[token]
+	p.mu.Unlock()
+
+	if !ok || p.now().After(grant.expires) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="dovetail", error="invalid_token"`)
+		tokenError(w, http.StatusUnauthorized, "invalid_token", "the access token is invalid or expired")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, userClaims(grant.user, grant.scope))
+}
+
+// sweep drops expired codes and tokens. The caller must hold p.mu.
+func (p *Provider) sweep(now time.Time) {
+	for k, c := range p.codes {
+		if now.After(c.expires) {
+			delete(p.codes, k)
+		}
+	}
+	for k, t := range p.tokens {
+		if now.After(t.expires) {
+			delete(p.tokens, k)
+		}
+	}
+}
+
+func (p *Provider) renderError(w http.ResponseWriter, r *http.Request, status int, message string) {
+	p.errorPages.Render(w, r, errorpage.Page{
+		Status:  status,
+		Service: "sign-in",
+		Message: message,
+	})
+}
+
+func verifyPKCE(challenge, verifier string) bool {
+	if verifier == "" {
+		return false
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:]) == challenge
+}
+
+func redirectWith(w http.ResponseWriter, r *http.Request, redirectURI string, params url.Values) {
+	u, _ := url.Parse(redirectURI)
+	q := u.Query()
+	for k, v := range params {
+		if len(v) > 0 && v[0] != "" {
+			q[k] = v
+		}
+	}
+	u.RawQuery = q.Encode()
+	http.Redirect(w, r, u.String(), http.StatusFound)
+}
+
+func tokenError(w http.ResponseWriter, status int, code, description string) {
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, status, map[string]string{
+		"error":             code,
+		"error_description": description,
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func randomToken() string {
+	return rand.Text()
+}
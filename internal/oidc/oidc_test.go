@@ -0,0 +1,392 @@
+package oidc
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jasonwu/dovetail/internal/identity"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
+)
+
+const (
+	testIssuer   = "https://idp.example.ts.net"
+	testRedirect = "https://grafana.example.ts.net/login/generic_oauth"
+)
+
+type mockLocalClient struct {
+	whoisResponse *apitype.WhoIsResponse
+	whoisErr      error
+}
+
+func (m *mockLocalClient) WhoIs(ctx context.Context, remoteAddr string) (*apitype.WhoIsResponse, error) {
+	if m.whoisErr != nil {
+		return nil, m.whoisErr
+	}
+	return m.whoisResponse, nil
+}
+
+func newTestProvider(t *testing.T, lc LocalClient) (*Provider, *identity.Signer) {
+	t.Helper()
+
+	signer, err := identity.LoadOrCreate(filepath.Join(t.TempDir(), identity.KeyFile))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	clients := []Client{
+		{ID: "grafana", Secret: "s3cret", RedirectURIs: []string{testRedirect}},
+		{ID: "cli", RedirectURIs: []string{"http://127.0.0.1:8085/callback"}},
+	}
+	return NewProvider(testIssuer, clients, signer, lc, nil, slog.Default()), signer
+}
+
+func aliceClient() *mockLocalClient {
+	return &mockLocalClient{
+		whoisResponse: &apitype.WhoIsResponse{
+			UserProfile: &tailcfg.UserProfile{
+				ID:            12345,
+				LoginName:     "alice@example.com",
+				DisplayName:   "Alice Smith",
+				ProfilePicURL: "https://example.com/alice.png",
+			},
+			Node: &tailcfg.Node{ComputedName: "alice-laptop"},
+		},
+	}
+}
+
+// authorize runs the authorization request and returns the redirect
+func authorize(t *testing.T, p *Provider, params url.Values) *url.URL {
+	t.Helper()
+
+	req := httptest.NewRequest(http.MethodGet, testIssuer+"/authorize?"+params.Encode(), nil)
+	req.RemoteAddr = "100.100.100.1:12345"
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, req)
+
+	if w.Code != http.StatusFound {
+		t.Fatalf("authorize StatusCode = %d, want %d: %s", w.Code, http.StatusFound, w.Body.String())
+	}
+	loc, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatalf("invalid redirect: %v", err)
+	}
+	return loc
+}
+
+func exchange(p *Provider, form url.Values, user, pass string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, testIssuer+"/token", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if user != "" {
+		req.SetBasicAuth(user, pass)
+	}
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, req)
+	return w
+}
+
+func TestDiscovery(t *testing.T) {
+	p, _ := newTestProvider(t, aliceClient())
+
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest(http.MethodGet, testIssuer+"/.well-known/openid-configuration", nil))
+
+	var doc map[string]any
+	if err := json.Unmarshal(w.Body.Bytes(), &doc); err != nil {
+		t.Fatalf("invalid discovery document: %v", err)
+	}
+	if doc["issuer"] != testIssuer {
+		t.Errorf("issuer = %v, want %q", doc["issuer"], testIssuer)
+	}
+	if doc["jwks_uri"] != testIssuer+"/jwks" {
+		t.Errorf("jwks_uri = %v", doc["jwks_uri"])
+	}
+}
+
+func TestAuthorizationCodeFlow(t *testing.T) {
+	p, signer := newTestProvider(t, aliceClient())
+
+	loc := authorize(t, p, url.Values{
+		"client_id":     {"grafana"},
+		"redirect_uri":  {testRedirect},
+		"response_type": {"code"},
+		"scope":         {"openid profile email"},
+		"state":         {"xyz"},
+		"nonce":         {"n-0S6"},
+	})
+	if got := loc.Query().Get("state"); got != "xyz" {
+		t.Errorf("state = %q, want %q", got, "xyz")
+	}
+	code := loc.Query().Get("code")
+	if code == "" {
+		t.Fatalf("no code in redirect %s", loc)
+	}
+
+	form := url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {code},
+		"redirect_uri": {testRedirect},
+	}
+
+	if w := exchange(p, form, "grafana", "wrong"); w.Code != http.StatusUnauthorized {
+		t.Fatalf("wrong secret StatusCode = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+
+	w := exchange(p, form, "grafana", "s3cret")
+	if w.Code != http.StatusOK {
+		t.Fatalf("token StatusCode = %d, want %d: %s", w.Code, http.StatusOK, w.Body.String())
+	}
+
+	var resp struct {
+		AccessToken string `json:"access_token"`
+		IDToken     string `json:"id_token"`
+		TokenType   string `json:"token_type"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("invalid token response: %v", err)
+	}
+
+	var claims map[string]any
+	if err := signer.VerifyClaims(resp.IDToken, &claims); err != nil {
+		t.Fatalf("invalid ID token: %v", err)
+	}
+	want := map[string]any{
+		"iss":                testIssuer,
+		"aud":                "grafana",
+		"sub":                "12345",
+		"nonce":              "n-0S6",
+		"name":               "Alice Smith",
+		"preferred_username": "alice@example.com",
+		"email":              "alice@example.com",
+		"picture":            "https://example.com/alice.png",
+	}
+	for k, v := range want {
+		if claims[k] != v {
+			t.Errorf("claim %s = %v, want %v", k, claims[k], v)
+		}
+	}
+	if v, ok := claims["email_verified"]; ok {
+		t.Errorf("claim email_verified = %v, want none", v)
+	}
+
+	// Codes can only be redeemed once
+	if w := exchange(p, form, "grafana", "s3cret"); w.Code != http.StatusBadRequest {
+		t.Errorf("reused code StatusCode = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, testIssuer+"/userinfo", nil)
+	req.Header.Set("Authorization", "Bearer "+resp.AccessToken)
+	uw := httptest.NewRecorder()
+	p.ServeHTTP(uw, req)
+
+	var info map[string]any
+	if err := json.Unmarshal(uw.Body.Bytes(), &info); err != nil {
+		t.Fatalf("invalid userinfo response: %v", err)
+	}
+	if info["email"] != "alice@example.com" || info["name"] != "Alice Smith" {
+		t.Errorf("unexpected userinfo: %v", info)
+	}
+}
+
+func TestAuthorizationCodeFlow_PKCE(t *testing.T) {
+	p, _ := newTestProvider(t, aliceClient())
+
+	verifier := "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	sum := sha256.Sum256([]byte(verifier))
+	challenge := base64.RawURLEncoding.EncodeToString(sum[:])
+
+	params := url.Values{
+		"client_id":     {"cli"},
+		"redirect_uri":  {"http://127.0.0.1:8085/callback"},
+		"response_type": {"code"},
+		"scope":         {"openid"},
+	}
+
+	// Public clients must use PKCE
+	loc := authorize(t, p, params)
+	if got := loc.Query().Get("error"); got != "invalid_request" {
+		t.Errorf("error = %q, want %q", got, "invalid_request")
+	}
+
+	params.Set("code_challenge", challenge)
+	params.Set("code_challenge_method", "S256")
+	code := authorize(t, p, params).Query().Get("code")
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"client_id":     {"cli"},
+		"code":          {code},
+		"redirect_uri":  {"http://127.0.0.1:8085/callback"},
+		"code_verifier": {"not-the-verifier"},
+	}
+	if w := exchange(p, form, "", ""); w.Code != http.StatusBadRequest {
+		t.Fatalf("wrong verifier StatusCode = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+
+	code = authorize(t, p, params).Query().Get("code")
+	form.Set("code", code)
+	form.Set("code_verifier", verifier)
+	if w := exchange(p, form, "", ""); w.Code != http.StatusOK {
+		t.Fatalf("token StatusCode = %d, want %d: %s", w.Code, http.StatusOK, w.Body.String())
+	}
+}
+
+func TestUserInfo_Scope(t *testing.T) {
+	p, _ := newTestProvider(t, aliceClient())
+
+	loc := authorize(t, p, url.Values{
+		"client_id":     {"grafana"},
+		"redirect_uri":  {testRedirect},
+		"response_type": {"code"},
+		"scope":         {"openid"},
+	})
+	w := exchange(p, url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {loc.Query().Get("code")},
+		"redirect_uri": {testRedirect},
+	}, "grafana", "s3cret")
+	if w.Code != http.StatusOK {
+		t.Fatalf("token StatusCode = %d, want %d: %s", w.Code, http.StatusOK, w.Body.String())
+	}
+	var resp struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("invalid token response: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, testIssuer+"/userinfo", nil)
+	req.Header.Set("Authorization", "Bearer "+resp.AccessToken)
+	uw := httptest.NewRecorder()
+	p.ServeHTTP(uw, req)
+
+	var info map[string]any
+	if err := json.Unmarshal(uw.Body.Bytes(), &info); err != nil {
+		t.Fatalf("invalid userinfo response: %v", err)
+	}
+	if len(info) != 1 || info["sub"] != "12345" {
+		t.Errorf("userinfo = %v, want only sub for an openid-only token", info)
+	}
+}
+
+func TestUserClaims_NonEmailLogin(t *testing.T) {
+	p, _ := newTestProvider(t, &mockLocalClient{
+		whoisResponse: &apitype.WhoIsResponse{
+			UserProfile: &tailcfg.UserProfile{ID: 67890, LoginName: "alice@github", DisplayName: "Alice"},
+			Node:        &tailcfg.Node{ComputedName: "alice-laptop"},
+		},
+	})
+
+	user, ok := p.authenticate(httptest.NewRequest(http.MethodGet, testIssuer+"/authorize", nil))
+	if !ok {
+		t.Fatal("expected caller to be authenticated")
+	}
+	claims := userClaims(user, "openid profile email")
+	if claims["sub"] != "67890" || claims["preferred_username"] != "alice@github" {
+		t.Errorf("claims = %v", claims)
+	}
+	if v, ok := claims["email"]; ok {
+		t.Errorf("claim email = %v, want none for a GitHub login", v)
+	}
+}
+
+func TestAuthorize_Rejections(t *testing.T) {
+	tests := []struct {
+		name       string
+		lc         LocalClient
+		params     url.Values
+		wantStatus int
+	}{
+		{
+			name:       "unknown client",
+			lc:         aliceClient(),
+			params:     url.Values{"client_id": {"nope"}, "redirect_uri": {testRedirect}},
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "unregistered redirect",
+			lc:         aliceClient(),
+			params:     url.Values{"client_id": {"grafana"}, "redirect_uri": {"https://evil.example.com/"}},
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name: "tagged device",
+			lc: &mockLocalClient{whoisResponse: &apitype.WhoIsResponse{
+				UserProfile: &tailcfg.UserProfile{LoginName: "tagged-devices"},
+				Node:        &tailcfg.Node{Tags: []string{"tag:server"}},
+			}},
+			params:     url.Values{"client_id": {"grafana"}, "redirect_uri": {testRedirect}, "response_type": {"code"}, "scope": {"openid"}},
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "whois failure",
+			lc:         &mockLocalClient{whoisErr: errors.New("no peer")},
+			params:     url.Values{"client_id": {"grafana"}, "redirect_uri": {testRedirect}, "response_type": {"code"}, "scope": {"openid"}},
+			wantStatus: http.StatusForbidden,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, _ := newTestProvider(t, tt.lc)
+
+			req := httptest.NewRequest(http.MethodGet, testIssuer+"/authorize?"+tt.params.Encode(), nil)
+			req.RemoteAddr = "100.100.100.1:12345"
+			w := httptest.NewRecorder()
+			p.ServeHTTP(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("StatusCode = %d, want %d", w.Code, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestLoadClients(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr bool
+	}{
+		{"valid", `{"clients":[{"id":"grafana","secret":"x","redirect_uris":["https://grafana.example.ts.net/cb"]}]}`, false},
+		{"missing id", `{"clients":[{"redirect_uris":["https://a.example/cb"]}]}`, true},
+		{"duplicate", `{"clients":[{"id":"a","redirect_uris":["https://a.example/cb"]},{"id":"a","redirect_uris":["https://a.example/cb"]}]}`, true},
+		{"no redirects", `{"clients":[{"id":"a"}]}`, true},
+		{"relative redirect", `{"clients":[{"id":"a","redirect_uris":["/cb"]}]}`, true},
+		{"invalid json", `{`, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "clients.json")
+			if err := os.WriteFile(path, []byte(tt.content), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			clients, err := LoadClients(path)
+			if tt.wantErr {
+				if err == nil {
+					t.Error("expected error but got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(clients) != 1 || clients[0].ID != "grafana" {
+				t.Errorf("unexpected clients: %+v", clients)
+			}
+		})
+	}
+}
@@ -0,0 +1,102 @@
+package oidc
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"time"
+
+	"github.com/jasonwu/dovetail/internal/errorpage"
+	"github.com/jasonwu/dovetail/internal/identity"
+	"tailscale.com/tsnet"
+)
+
+// ServerConfig configures the tailnet node hosting the provider
+type ServerConfig struct {
+	Hostname string
+	StateDir string
+	AuthKey  string
+	Clients  []Client
+
+	Signer     *identity.Signer
+	ErrorPages *errorpage.Renderer
+}
+
+// Server runs the provider on its own tailnet node, so it has a stable
+// issuer URL such as https://idp.<tailnet>.ts.net
+type Server struct {
+	cfg        ServerConfig
+	server     *tsnet.Server
+	httpServer *http.Server
+	logger     *slog.Logger
+	done       chan struct{}
+}
+
+func NewServer(cfg ServerConfig, logger *slog.Logger) *Server {
+	logger = logger.With("component", "oidc", "hostname", cfg.Hostname)
+
+	return &Server{
+		cfg: cfg,
+		server: &tsnet.Server{
+			Hostname:  cfg.Hostname,
+			Dir:       filepath.Join(cfg.StateDir, cfg.Hostname),
+			AuthKey:   cfg.AuthKey,
+			Ephemeral: true,
+			Logf:      func(format string, args ...any) { logger.Debug(fmt.Sprintf(format, args...)) },
+		},
+		logger: logger,
+		done:   make(chan struct{}),
+	}
+}
+
+func (s *Server) Start(ctx context.Context) error {
+	st, err := s.server.Up(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to start tsnet server: %w", err)
+	}
+	if len(st.CertDomains) == 0 {
+		s.server.Close()
+		return fmt.Errorf("HTTPS is not enabled for the tailnet")
+	}
+	issuer := "https://" + st.CertDomains[0]
+
+	lc, err := s.server.LocalClient()
+	if err != nil {
+		s.server.Close()
+		return fmt.Errorf("failed to get local client: %w", err)
+	}
+
+	ln, err := s.server.ListenTLS("tcp", ":443")
+	if err != nil {
+		s.server.Close()
+		return fmt.Errorf("failed to listen on TLS: %w", err)
+	}
+
+	provider := NewProvider(issuer, s.cfg.Clients, s.cfg.Signer, lc, s.cfg.ErrorPages, s.logger)
+	s.httpServer = &http.Server{
+		Handler:           provider,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		defer close(s.done)
+		if err := s.httpServer.Serve(ln); err != nil && err != http.ErrServerClosed {
+			s.logger.Error("oidc server error", "error", err)
+		}
+	}()
+
+	s.logger.Info("oidc provider started", "issuer", issuer, "clients", len(s.cfg.Clients))
+	return nil
+}
+
+func (s *Server) Shutdown(ctx context.Context) error {
+	if s.httpServer != nil {
+		if err := s.httpServer.Shutdown(ctx); err != nil {
+			return err
+		}
+		<-s.done
+	}
+	return s.server.Close()
+}
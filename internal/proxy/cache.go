@@ -0,0 +1,497 @@
+package proxy
+
+import (
+	"bytes"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultCacheMemorySize bounds a service's in-memory cache
+const DefaultCacheMemorySize = 64 << 20
+
+// maxCacheEntrySize is the largest response body that will be stored
+const maxCacheEntrySize = 8 << 20
+
+// Values of the X-Cache-Status response header
+const (
+	CacheHit         = "HIT"
+	CacheMiss        = "MISS"
+	CacheExpired     = "EXPIRED"
+	CacheRevalidated = "REVALIDATED"
+	CacheBypass      = "BYPASS"
+)
+
+// HeaderCacheStatus reports how the cache handled a response
+const HeaderCacheStatus = "X-Cache-Status"
+
+// CacheOptions configures a service's response cache
+type CacheOptions struct {
+	// MemorySize bounds the in-memory store in bytes. Zero uses
+	// DefaultCacheMemorySize.
+	MemorySize int64
+
+	// DiskDir and DiskSize enable a second, persistent store. Zero
+	// DiskSize disables it.
+	DiskDir  string
+	DiskSize int64
+}
+
+// cachedResponse is a stored response. Responses that aren't marked
+// public are stored per caller, since the container may have personalized
+// them using the identity headers, and not at all for anonymous callers.
+type cachedResponse struct {
+	Status  int
+	Header  http.Header
+	Body    []byte
+	Vary    map[string]string
+	Stored  time.Time
+	Expires time.Time
+	NoCache bool
+}
+
+func (e *cachedResponse) size() int64 {
+	n := int64(len(e.Body))
+	for k, vs := range e.Header {
+		n += int64(len(k))
+		for _, v := range vs {
+			n += int64(len(v))
+		}
+	}
+	return n
+}
+
+func (e *cachedResponse) fresh(now time.Time) bool {
+	return !e.NoCache && now.Before(e.Expires)
+}
+
+func (e *cachedResponse) hasValidator() bool {
+	return e.Header.Get("ETag") != "" || e.Header.Get("Last-Modified") != ""
+}
+
+// matches reports whether the request selects this stored variant
+func (e *cachedResponse) matches(r *http.Request) bool {
+	for name, value := range e.Vary {
+		if r.Header.Get(name) != value {
+			return false
+		}
+	}
+	return true
+}
+
+// responseCache looks responses up in memory first, then on disk
+type responseCache struct {
+	memory *memoryStore
+	disk   *diskStore
+	now    func() time.Time
+}
+
+func newResponseCache(opts CacheOptions) (*responseCache, error) {
+	memorySize := opts.MemorySize
+	if memorySize <= 0 {
+		memorySize = DefaultCacheMemorySize
+	}
+
+	c := &responseCache{
+		memory: newMemoryStore(memorySize),
+		now:    time.Now,
+	}
+	if opts.DiskSize > 0 && opts.DiskDir != "" {
+		disk, err := newDiskStore(opts.DiskDir, opts.DiskSize)
+		if err != nil {
+			return nil, err
+		}
+		c.disk = disk
+	}
+	return c, nil
+}
+
+func (c *responseCache) get(key string) *cachedResponse {
+	if e := c.memory.get(key); e != nil {
+		return e
+	}
+	if c.disk == nil {
+		return nil
+	}
+	e := c.disk.get(key)
+	if e != nil {
+		c.memory.put(key, e)
+	}
+	return e
+}
+
+func (c *responseCache) put(key string, e *cachedResponse) {
+	c.memory.put(key, e)
+	if c.disk != nil {
+		c.disk.put(key, e)
+	}
+}
+
+func (c *responseCache) remove(key string) {
+	c.memory.remove(key)
+	if c.disk != nil {
+		c.disk.remove(key)
+	}
+}
+
+// responseKey identifies a response within a partition: "*" for public
+// responses, otherwise the caller
+func responseKey(partition string, r *http.Request) string {
+	return partition + "\x00" + r.URL.RequestURI()
+}
+
+const sharedPartition = "*"
+
+// cacheControl parses a Cache-Control header into directives
+func cacheControl(h http.Header) map[string]string {
+	directives := make(map[string]string)
+	for _, line := range h.Values("Cache-Control") {
+		for _, part := range strings.Split(line, ",") {
+			name, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+			if name == "" {
+				continue
+			}
+			directives[strings.ToLower(name)] = strings.Trim(value, `"`)
+		}
+	}
+	return directives
+}
+
+func cacheableRequest(r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	if r.Header.Get("Range") != "" || isUpgrade(r) {
+		return false
+	}
+	_, noStore := cacheControl(r.Header)["no-store"]
+	return !noStore
+}
+
+// requestWantsRevalidation reports whether the client asked for an
+// end-to-end check, e.g. a forced browser reload
+func requestWantsRevalidation(r *http.Request) bool {
+	cc := cacheControl(r.Header)
+	if _, ok := cc["no-cache"]; ok {
+		return true
+	}
+	if cc["max-age"] == "0" {
+		return true
+	}
+	return r.Header.Get("Pragma") == "no-cache"
+}
+
+var cacheableStatus = []int{
+	http.StatusOK, http.StatusNonAuthoritativeInfo, http.StatusNoContent,
+	http.StatusMultipleChoices, http.StatusMovedPermanently, http.StatusPermanentRedirect,
+	http.StatusNotFound, http.StatusGone,
+}
+
+// storable decides whether a response may be cached and in which
+// partition, following the shared cache rules of RFC 9111
+func storable(r *http.Request, status int, h http.Header, now time.Time) (expires time.Time, shared, ok bool) {
+	if r.Method != http.MethodGet || !slices.Contains(cacheableStatus, status) {
+		return time.Time{}, false, false
+	}
+	if h.Get("Set-Cookie") != "" || h.Get("Vary") == "*" {
+		return time.Time{}, false, false
+	}
+
+	cc := cacheControl(h)
+	if _, ok := cc["no-store"]; ok {
+		return time.Time{}, false, false
+	}
+	if _, ok := cc["private"]; ok {
+		return time.Time{}, false, false
+	}
+
+	_, public := cc["public"]
+	_, hasSMaxAge := cc["s-maxage"]
+	shared = public || hasSMaxAge
+
+	// Credentialed requests need the container's explicit permission
+	if r.Header.Get("Authorization") != "" {
+		if _, mustRevalidate := cc["must-revalidate"]; !shared && !mustRevalidate {
+			return time.Time{}, false, false
+		}
+	}
+	if r.Header.Get("Cookie") != "" && !public {
+		return time.Time{}, false, false
+	}
+
+	lifetime := freshnessLifetime(cc, h)
+	if age, err := strconv.Atoi(h.Get("Age")); err == nil {
+		lifetime -= time.Duration(age) * time.Second
+	}
+	if lifetime <= 0 && h.Get("ETag") == "" && h.Get("Last-Modified") == "" {
+		return time.Time{}, false, false
+	}
+	return now.Add(lifetime), shared, true
+}
+
+func freshnessLifetime(cc map[string]string, h http.Header) time.Duration {
+	for _, directive := range []string{"s-maxage", "max-age"} {
+		if v, ok := cc[directive]; ok {
+			seconds, err := strconv.Atoi(v)
+			if err != nil {
+				return 0
+			}
+			return time.Duration(seconds) * time.Second
+		}
+	}
+
+	if expires := h.Get("Expires"); expires != "" {
+		exp, err := http.ParseTime(expires)
+		if err != nil {
+			return 0
+		}
+		date, err := http.ParseTime(h.Get("Date"))
+		if err != nil {
+			date = time.Now()
+		}
+		return exp.Sub(date)
+	}
+	return 0
+}
+
+// varyValues captures the request headers the response varies on
+func varyValues(r *http.Request, h http.Header) map[string]string {
+	var vary map[string]string
+	for _, line := range h.Values("Vary") {
+		for _, name := range strings.Split(line, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if name == "" {
+				continue
+			}
+			if vary == nil {
+				vary = make(map[string]string)
+			}
+			vary[name] = r.Header.Get(name)
+		}
+	}
+	return vary
+}
+
+// serveCached answers the request through the cache, forwarding to next
+// on misses and to revalidate stale entries
+func (p *Proxy) serveCached(w http.ResponseWriter, r *http.Request, next http.Handler) {
+	if !cacheableRequest(r) {
+		w.Header().Set(HeaderCacheStatus, CacheBypass)
+		cacheRequestsTotal.Inc(p.name, CacheBypass)
+		next.ServeHTTP(w, r)
+		return
+	}
+
+	now := p.cache.now()
+	private := p.cachePartition(r)
+
+	partitions := []string{sharedPartition}
+	if private != "" {
+		partitions = append(partitions, private)
+	}
+
+	var key string
+	var entry *cachedResponse
+	for _, partition := range partitions {
+		k := responseKey(partition, r)
+		if e := p.cache.get(k); e != nil && e.matches(r) {
+			key, entry = k, e
+			break
+		}
+	}
+
+	status := CacheMiss
+	if entry != nil {
+		if entry.fresh(now) && !requestWantsRevalidation(r) {
+			p.writeCached(w, r, entry, CacheHit, now)
+			return
+		}
+		status = CacheExpired
+	}
+
+	cw := &cacheWriter{ResponseWriter: w, cacheStatus: status}
+	outReq := r
+	if entry != nil && entry.hasValidator() {
+		// Ask the container whether our copy is still current
+		outReq = r.Clone(r.Context())
+		outReq.Header.Del("If-None-Match")
+		outReq.Header.Del("If-Modified-Since")
+		if etag := entry.Header.Get("ETag"); etag != "" {
+			outReq.Header.Set("If-None-Match", etag)
+		} else {
+			outReq.Header.Set("If-Modified-Since", entry.Header.Get("Last-Modified"))
+		}
+		cw.interceptNotModified = true
+	}
+
+	next.ServeHTTP(cw, outReq)
+	now = p.cache.now()
+
+	if cw.notModified {
+		// Refresh the stored headers and freshness from the 304
+		updated := *entry
+		updated.Header = entry.Header.Clone()
+		for k, vs := range cw.header {
+			updated.Header[k] = vs
+		}
+		if expires, _, ok := storable(r, entry.Status, updated.Header, now); ok {
+			updated.Expires = expires
+			updated.Stored = now
+			p.cache.put(key, &updated)
+		}
+		p.writeCached(w, r, &updated, CacheRevalidated, now)
+		return
+	}
+
+	cacheRequestsTotal.Inc(p.name, status)
+	if cw.tooLarge || cw.status == 0 {
+		return
+	}
+
+	expires, shared, ok := storable(r, cw.status, cw.header, now)
+	if !ok {
+		// A HEAD response can't replace the stored GET response, so it
+		// mustn't evict it either
+		if key != "" && r.Method == http.MethodGet {
+			p.cache.remove(key)
+		}
+		return
+	}
+
+	partition := private
+	if shared {
+		partition = sharedPartition
+	}
+	if partition == "" {
+		if key != "" {
+			p.cache.remove(key)
+		}
+		return
+	}
+	header := cw.header.Clone()
+	header.Del(HeaderCacheStatus)
+	_, noCache := cacheControl(header)["no-cache"]
+	p.cache.put(responseKey(partition, r), &cachedResponse{
+		Status:  cw.status,
+		Header:  header,
+		Body:    bytes.Clone(cw.body.Bytes()),
+		Vary:    varyValues(r, header),
+		Stored:  now,
+		Expires: expires,
+		NoCache: noCache,
+	})
+}
+
+// cachePartition is the caller's private partition, named by node for
+// tagged devices and by login otherwise, or "" for anonymous callers such
+// as Funnel visitors, who only get shared responses
+func (p *Proxy) cachePartition(r *http.Request) string {
+	whois := p.whois(r)
+	if whois == nil {
+		return ""
+	}
+	if whois.Node != nil && whois.Node.IsTagged() {
+		if whois.Node.ComputedName == "" {
+			return ""
+		}
+		return "node:" + whois.Node.ComputedName
+	}
+	if whois.UserProfile != nil && whois.UserProfile.LoginName != "" {
+		return "user:" + whois.UserProfile.LoginName
+	}
+	return ""
+}
+
+// writeCached serves a stored response, answering the client's own
+// conditional request when its ETag still matches
+func (p *Proxy) writeCached(w http.ResponseWriter, r *http.Request, e *cachedResponse, status string, now time.Time) {
+	cacheRequestsTotal.Inc(p.name, status)
+
+	h := w.Header()
+	for k, vs := range e.Header {
+		h[k] = slices.Clone(vs)
+	}
+	h.Set("Age", strconv.Itoa(int(now.Sub(e.Stored).Seconds())))
+	h.Set(HeaderCacheStatus, status)
+
+	// Compression may have weakened the ETag the client saw
+	if etag := e.Header.Get("ETag"); etag != "" && strings.TrimPrefix(r.Header.Get("If-None-Match"), "W/") == strings.TrimPrefix(etag, "W/") {
+		h.Del("Content-Length")
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	h.Set("Content-Length", strconv.Itoa(len(e.Body)))
+	w.WriteHeader(e.Status)
+	if r.Method != http.MethodHead {
+		w.Write(e.Body)
+	}
+}
+
+// cacheWriter streams the container's response to the client while
+// keeping a copy for the cache. When revalidating, a 304 from the
+// container is intercepted rather than passed on.
+type cacheWriter struct {
+	http.ResponseWriter
+	cacheStatus          string
+	interceptNotModified bool
+
+	status      int
+	header      http.Header
+	body        bytes.Buffer
+	tooLarge    bool
+	notModified bool
+}
+
+func (w *cacheWriter) WriteHeader(code int) {
+	if w.status != 0 || code < http.StatusOK {
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+	w.status = code
+	w.header = w.Header().Clone()
+
+	if code == http.StatusNotModified && w.interceptNotModified {
+		w.notModified = true
+		// Leave the client's response untouched for writeCached
+		for k := range w.Header() {
+			w.Header().Del(k)
+		}
+		return
+	}
+
+	w.Header().Set(HeaderCacheStatus, w.cacheStatus)
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *cacheWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.notModified {
+		return len(b), nil
+	}
+
+	if !w.tooLarge {
+		if w.body.Len()+len(b) > maxCacheEntrySize {
+			w.tooLarge = true
+			w.body = bytes.Buffer{}
+		} else {
+			w.body.Write(b)
+		}
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *cacheWriter) FlushError() error {
+	if w.notModified {
+		return nil
+	}
+	return http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+func (w *cacheWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
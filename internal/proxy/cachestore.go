@@ -0,0 +1,249 @@
+package proxy
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// memoryStore is a byte-bounded LRU of cached responses
+type memoryStore struct {
+	maxSize int64
+
+	mu      sync.Mutex
+	size    int64
+	entries map[string]*list.Element
+	lru     *list.List
+}
+
+type memoryEntry struct {
+	key      string
+	response *cachedResponse
+	size     int64
+}
+
+func newMemoryStore(maxSize int64) *memoryStore {
+	return &memoryStore{
+		maxSize: maxSize,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+func (s *memoryStore) get(key string) *cachedResponse {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	elem, ok := s.entries[key]
+	if !ok {
+		return nil
+	}
+	s.lru.MoveToFront(elem)
+	return elem.Value.(*memoryEntry).response
+}
+
+func (s *memoryStore) put(key string, response *cachedResponse) {
+	size := response.size()
+	if size > s.maxSize {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.removeLocked(key)
+	s.entries[key] = s.lru.PushFront(&memoryEntry{key: key, response: response, size: size})
+	s.size += size
+
+	for s.size > s.maxSize {
+		s.removeLocked(s.lru.Back().Value.(*memoryEntry).key)
+	}
+}
+
+func (s *memoryStore) remove(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.removeLocked(key)
+}
+
+func (s *memoryStore) removeLocked(key string) {
+	elem, ok := s.entries[key]
+	if !ok {
+		return
+	}
+	s.lru.Remove(elem)
+	delete(s.entries, key)
+	s.size -= elem.Value.(*memoryEntry).size
+}
+
+// diskStore keeps cached responses in one file per key so they survive
+// restarts. Files are evicted least recently used first once the store
+// exceeds its size.
+type diskStore struct {
+	dir     string
+	maxSize int64
+
+	mu    sync.Mutex
+	size  int64
+	files map[string]*list.Element
+	lru   *list.List
+}
+
+type diskFile struct {
+	name string
+	size int64
+}
+
+func newDiskStore(dir string, maxSize int64) (*diskStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create cache directory: %w", err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cache directory: %w", err)
+	}
+
+	type existing struct {
+		diskFile
+		modified time.Time
+	}
+	var found []existing
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		if filepath.Ext(entry.Name()) == ".tmp" {
+			os.Remove(filepath.Join(dir, entry.Name()))
+			continue
+		}
+		found = append(found, existing{diskFile{entry.Name(), info.Size()}, info.ModTime()})
+	}
+	slices.SortFunc(found, func(a, b existing) int { return a.modified.Compare(b.modified) })
+
+	s := &diskStore{
+		dir:     dir,
+		maxSize: maxSize,
+		files:   make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+	for _, f := range found {
+		s.files[f.name] = s.lru.PushFront(&diskFile{f.name, f.size})
+		s.size += f.size
+	}
+	s.mu.Lock()
+	s.evictLocked()
+	s.mu.Unlock()
+	return s, nil
+}
+
+func diskFileName(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func (s *diskStore) get(key string) *cachedResponse {
+	name := diskFileName(key)
+
+	s.mu.Lock()
+	elem, ok := s.files[name]
+	if ok {
+		s.lru.MoveToFront(elem)
+	}
+	s.mu.Unlock()
+	if !ok {
+		return nil
+	}
+
+	data, err := os.ReadFile(filepath.Join(s.dir, name))
+	if err != nil {
+		s.remove(key)
+		return nil
+	}
+
+	var stored struct {
+		Key      string
+		Response cachedResponse
+	}
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&stored); err != nil || stored.Key != key {
+		s.remove(key)
+		return nil
+	}
+	return &stored.Response
+}
+
+func (s *diskStore) put(key string, response *cachedResponse) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(struct {
+		Key      string
+		Response *cachedResponse
+	}{key, response})
+	if err != nil || int64(buf.Len()) > s.maxSize {
+		return
+	}
+
+	name := diskFileName(key)
+	path := filepath.Join(s.dir, name)
+	// Concurrent misses for the same key each write their own file, so a
+	// rename never publishes another writer's partial body
+	tmp, err := os.CreateTemp(s.dir, name+"-*.tmp")
+	if err != nil {
+		return
+	}
+	_, err = tmp.Write(buf.Bytes())
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if elem, ok := s.files[name]; ok {
+		s.size -= elem.Value.(*diskFile).size
+		s.lru.Remove(elem)
+	}
+	s.files[name] = s.lru.PushFront(&diskFile{name, int64(buf.Len())})
+	s.size += int64(buf.Len())
+	s.evictLocked()
+}
+
+func (s *diskStore) remove(key string) {
+	name := diskFileName(key)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if elem, ok := s.files[name]; ok {
+		s.removeLocked(elem)
+	}
+}
+
+func (s *diskStore) evictLocked() {
+	for s.size > s.maxSize {
+		s.removeLocked(s.lru.Back())
+	}
+}
+
+func (s *diskStore) removeLocked(elem *list.Element) {
+	f := elem.Value.(*diskFile)
+	s.lru.Remove(elem)
+	delete(s.files, f.name)
+	s.size -= f.size
+	os.Remove(filepath.Join(s.dir, f.name))
+}
@@ -0,0 +1,229 @@
+package proxy
+
+import (
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Content encodings the proxy can produce
+const (
+	EncodingZstd   = "zstd"
+	EncodingBrotli = "br"
+	EncodingGzip   = "gzip"
+)
+
+// DefaultEncodings is the server preference order used when a client
+// accepts several encodings equally
+var DefaultEncodings = []string{EncodingZstd, EncodingBrotli, EncodingGzip}
+
+// minCompressSize is the smallest declared Content-Length worth compressing
+const minCompressSize = 1024
+
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+}
+
+var encoderPools = map[string]*sync.Pool{
+	EncodingGzip: {New: func() any {
+		w, _ := gzip.NewWriterLevel(nil, gzip.DefaultCompression)
+		return w
+	}},
+	EncodingBrotli: {New: func() any {
+		return brotli.NewWriterLevel(nil, 5)
+	}},
+	EncodingZstd: {New: func() any {
+		w, _ := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedDefault), zstd.WithEncoderConcurrency(1))
+		return w
+	}},
+}
+
+func getEncoder(encoding string, w io.Writer) encoder {
+	switch enc := encoderPools[encoding].Get().(type) {
+	case *gzip.Writer:
+		enc.Reset(w)
+		return enc
+	case *brotli.Writer:
+		enc.Reset(w)
+		return enc
+	case *zstd.Encoder:
+		enc.Reset(w)
+		return enc
+	}
+	return nil
+}
+
+// negotiateEncoding picks the encoding from allowed with the highest
+// quality in the Accept-Encoding header, preferring earlier entries in
+// allowed on ties. It returns "" when the client wants none of them.
+func negotiateEncoding(acceptEncoding string, allowed []string) string {
+	if acceptEncoding == "" {
+		return ""
+	}
+
+	quality := make(map[string]float64)
+	wildcard := -1.0
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if parsed, err := strconv.ParseFloat(v, 64); err == nil {
+				q = parsed
+			}
+		}
+		if name == "*" {
+			wildcard = q
+			continue
+		}
+		quality[name] = q
+	}
+
+	best, bestQ := "", 0.0
+	for _, enc := range allowed {
+		q, ok := quality[enc]
+		if !ok {
+			q = max(wildcard, 0)
+		}
+		if q > bestQ {
+			best, bestQ = enc, q
+		}
+	}
+	return best
+}
+
+// compressible reports whether a response of this media type benefits from
+// compression. Images, video, archives and event streams are left alone.
+func compressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	switch {
+	case mediaType == "text/event-stream":
+		return false
+	case strings.HasPrefix(mediaType, "text/"):
+		return true
+	case strings.HasSuffix(mediaType, "+json"), strings.HasSuffix(mediaType, "+xml"):
+		return true
+	}
+
+	switch mediaType {
+	case "application/json", "application/javascript", "application/x-javascript",
+		"application/xml", "application/wasm", "application/manifest+json",
+		"application/x-ndjson", "image/svg+xml", "font/ttf", "font/otf":
+		return true
+	}
+	return false
+}
+
+// compressWriter compresses the response body when the response turns out
+// to be worth compressing. The decision is made when headers are written.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding    string
+	enc         encoder
+	wroteHeader bool
+}
+
+func (p *Proxy) wrapCompression(w http.ResponseWriter, r *http.Request) *compressWriter {
+	if len(p.compression) == 0 || r.Method == http.MethodHead || isUpgrade(r) {
+		return nil
+	}
+
+	encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"), p.compression)
+	if encoding == "" {
+		return nil
+	}
+	return &compressWriter{ResponseWriter: w, encoding: encoding}
+}
+
+func isUpgrade(r *http.Request) bool {
+	return r.Header.Get("Upgrade") != ""
+}
+
+func (w *compressWriter) WriteHeader(code int) {
+	if w.wroteHeader || code < http.StatusOK {
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+	w.wroteHeader = true
+
+	h := w.Header()
+	h.Add("Vary", "Accept-Encoding")
+
+	if w.shouldCompress(code, h) {
+		h.Set("Content-Encoding", w.encoding)
+		h.Del("Content-Length")
+		h.Del("Accept-Ranges")
+		// The representation differs from the container's, so a strong
+		// validator would no longer be accurate
+		if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+			h.Set("ETag", "W/"+etag)
+		}
+		w.enc = getEncoder(w.encoding, w.ResponseWriter)
+	}
+
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *compressWriter) shouldCompress(code int, h http.Header) bool {
+	if code == http.StatusNoContent || code == http.StatusNotModified || code == http.StatusPartialContent {
+		return false
+	}
+	if h.Get("Content-Encoding") != "" || h.Get("Content-Range") != "" {
+		return false
+	}
+	if strings.Contains(h.Get("Cache-Control"), "no-transform") {
+		return false
+	}
+	if n, err := strconv.Atoi(h.Get("Content-Length")); err == nil && n < minCompressSize {
+		return false
+	}
+	return compressible(h.Get("Content-Type"))
+}
+
+func (w *compressWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.enc == nil {
+		return w.ResponseWriter.Write(b)
+	}
+	return w.enc.Write(b)
+}
+
+// FlushError pushes buffered compressed data to the client, so responses
+// the reverse proxy flushes incrementally stay incremental
+func (w *compressWriter) FlushError() error {
+	if w.enc != nil {
+		if err := w.enc.Flush(); err != nil {
+			return err
+		}
+	}
+	return http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+func (w *compressWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Close finishes the compressed stream and returns the encoder to its pool
+func (w *compressWriter) Close() error {
+	if w.enc == nil {
+		return nil
+	}
+	err := w.enc.Close()
+	encoderPools[w.encoding].Put(w.enc)
+	w.enc = nil
+	return err
+}
@@ -0,0 +1,65 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/jasonwu/dovetail/internal/errorpage"
+)
+
+type funnelKey struct{}
+
+// WithFunnel marks a request context as having arrived over Tailscale
+// Funnel, i.e. from the public internet rather than the tailnet.
+func WithFunnel(ctx context.Context) context.Context {
+	return context.WithValue(ctx, funnelKey{}, true)
+}
+
+// IsFunnel reports whether the request context was marked by WithFunnel
+func IsFunnel(ctx context.Context) bool {
+	funnel, _ := ctx.Value(funnelKey{}).(bool)
+	return funnel
+}
+
+// funnelAllowed reports whether a public request may reach path. An empty
+// allow list exposes everything. Paths that are not in clean form are
+// rejected so "/share/../admin" can't slip past a "/share" prefix.
+func funnelAllowed(allowed []string, p string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+
+	cleaned := path.Clean("/" + p)
+	if cleaned != p && cleaned+"/" != p {
+		return false
+	}
+
+	for _, prefix := range allowed {
+		prefix = strings.TrimSuffix(prefix, "/")
+		if prefix == "" || cleaned == prefix || strings.HasPrefix(cleaned, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Proxy) checkFunnel(w http.ResponseWriter, r *http.Request) bool {
+	if !IsFunnel(r.Context()) {
+		return true
+	}
+
+	funnelRequestsTotal.Inc(p.name)
+	if funnelAllowed(p.funnelPaths, r.URL.Path) {
+		return true
+	}
+
+	p.logger.Debug("funnel request to non-public path denied", "path", r.URL.Path)
+	p.errorPages.Render(w, r, errorpage.Page{
+		Status:  http.StatusForbidden,
+		Service: p.name,
+		Message: "This page is not publicly available.",
+	})
+	return false
+}
@@ -0,0 +1,225 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/jasonwu/dovetail/internal/identity"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
+)
+
+// Identity fields that can be mapped onto custom request headers
+const (
+	FieldLogin = "login"
+	FieldName  = "name"
+	FieldEmail = "email"
+	FieldNode  = "node"
+	FieldTags  = "tags"
+)
+
+// HeaderPresets map header names to identity fields in the form popular
+// applications expect for header-based authentication
+var HeaderPresets = map[string]map[string]string{
+	"grafana": {
+		"X-WEBAUTH-USER":  FieldLogin,
+		"X-WEBAUTH-NAME":  FieldName,
+		"X-WEBAUTH-EMAIL": FieldEmail,
+	},
+	"authelia": {
+		"Remote-User":   FieldLogin,
+		"Remote-Name":   FieldName,
+		"Remote-Email":  FieldEmail,
+		"Remote-Groups": FieldTags,
+	},
+	"oauth2-proxy": {
+		"X-Forwarded-User":               FieldLogin,
+		"X-Forwarded-Email":              FieldEmail,
+		"X-Forwarded-Preferred-Username": FieldLogin,
+		"X-Forwarded-Groups":             FieldTags,
+	},
+}
+
+// identityHeaderNames are the built-in headers, which are always removed
+// from client requests
+var identityHeaderNames = []string{
+	HeaderUser, HeaderLogin, HeaderName, HeaderProfilePicture,
+	HeaderNode, HeaderNodeIP, HeaderTags, HeaderOS, HeaderTailnet,
+	HeaderIdentityJWT,
+}
+
+// builtinHeaders returns the X-Tailscale-* headers for a caller, leaving
+// out any that don't apply
+func builtinHeaders(whois *apitype.WhoIsResponse, remoteAddr string, legacy bool) map[string]string {
+	headers := make(map[string]string)
+	set := func(name, value string) {
+		if value != "" {
+			headers[name] = value
+		}
+	}
+
+	if user := callerUser(whois, legacy); user != nil {
+		set(HeaderUser, user.LoginName)
+		set(HeaderName, user.DisplayName)
+		set(HeaderLogin, user.LoginName)
+		set(HeaderProfilePicture, user.ProfilePicURL)
+	}
+
+	if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		set(HeaderNodeIP, host)
+	}
+
+	if whois.Node != nil {
+		set(HeaderNode, whois.Node.ComputedName)
+		set(HeaderTags, strings.Join(whois.Node.Tags, ","))
+		if whois.Node.Hostinfo.Valid() {
+			set(HeaderOS, whois.Node.Hostinfo.OS())
+		}
+		set(HeaderTailnet, tailnetDomain(whois.Node.Name))
+
+		if legacy {
+			delete(headers, HeaderLogin)
+			delete(headers, HeaderTailnet)
+			set(HeaderLogin, whois.Node.ComputedName)
+			if whois.Node.Hostinfo.Valid() {
+				set(HeaderTailnet, whois.Node.Hostinfo.Hostname())
+			}
+		}
+	}
+
+	return headers
+}
+
+// callerUser returns the caller's user profile, or nil for tagged devices,
+// whose profile is the placeholder "tagged-devices" user. Legacy mode keeps
+// the old behaviour of passing it through.
+func callerUser(whois *apitype.WhoIsResponse, legacy bool) *tailcfg.UserProfile {
+	if whois.Node != nil && whois.Node.IsTagged() && !legacy {
+		return nil
+	}
+	return whois.UserProfile
+}
+
+// tailnetDomain extracts the tailnet's MagicDNS domain from a node's FQDN,
+// e.g. "example.ts.net" from "laptop.example.ts.net."
+func tailnetDomain(fqdn string) string {
+	_, domain, ok := strings.Cut(strings.TrimSuffix(fqdn, "."), ".")
+	if !ok {
+		return ""
+	}
+	return domain
+}
+
+// IdentityHeaders combines a preset with custom mappings, which take
+// precedence. Header names are canonicalized.
+func IdentityHeaders(preset string, mappings map[string]string) map[string]string {
+	if preset == "" && len(mappings) == 0 {
+		return nil
+	}
+
+	headers := make(map[string]string)
+	for name, field := range HeaderPresets[preset] {
+		headers[http.CanonicalHeaderKey(name)] = field
+	}
+	for name, field := range mappings {
+		headers[http.CanonicalHeaderKey(name)] = field
+	}
+	return headers
+}
+
+// identityField returns the value of an identity field for a caller, or
+// "" if the caller doesn't have it. Tagged devices have no user fields
+// unless legacy is set.
+func identityField(whois *apitype.WhoIsResponse, field string, legacy bool) string {
+	user := callerUser(whois, legacy)
+	switch field {
+	case FieldLogin:
+		if user != nil {
+			return user.LoginName
+		}
+	case FieldName:
+		if user != nil {
+			return user.DisplayName
+		}
+	case FieldEmail:
+		if user != nil {
+			return identity.Email(user.LoginName)
+		}
+	case FieldNode:
+		if whois.Node != nil {
+			return whois.Node.ComputedName
+		}
+	case FieldTags:
+		if whois.Node != nil {
+			return strings.Join(whois.Node.Tags, ",")
+		}
+	}
+	return ""
+}
+
+// HeaderRules edit a set of headers: Remove runs first, then Set replaces
+// and Add appends values
+type HeaderRules struct {
+	Set    map[string]string
+	Add    map[string]string
+	Remove []string
+}
+
+func (r *HeaderRules) empty() bool {
+	return r == nil || (len(r.Set) == 0 && len(r.Add) == 0 && len(r.Remove) == 0)
+}
+
+func (r *HeaderRules) apply(h http.Header) {
+	if r == nil {
+		return
+	}
+	for _, name := range r.Remove {
+		h.Del(name)
+	}
+	for name, value := range r.Set {
+		h.Set(name, value)
+	}
+	for name, value := range r.Add {
+		h.Add(name, value)
+	}
+}
+
+// Security header profiles
+const (
+	SecurityOff    = "off"
+	SecurityBasic  = "basic"
+	SecurityStrict = "strict"
+)
+
+// SecurityProfiles are response headers added unless the container
+// already sets them
+var SecurityProfiles = map[string]map[string]string{
+	SecurityOff: nil,
+	SecurityBasic: {
+		"Strict-Transport-Security": "max-age=31536000",
+		"X-Content-Type-Options":    "nosniff",
+		"X-Frame-Options":           "SAMEORIGIN",
+		"Referrer-Policy":           "strict-origin-when-cross-origin",
+	},
+	SecurityStrict: {
+		"Strict-Transport-Security":  "max-age=63072000",
+		"X-Content-Type-Options":     "nosniff",
+		"X-Frame-Options":            "DENY",
+		"Referrer-Policy":            "no-referrer",
+		"Content-Security-Policy":    "default-src 'self'; frame-ancestors 'none'; object-src 'none'; base-uri 'self'",
+		"Cross-Origin-Opener-Policy": "same-origin",
+		"Permissions-Policy":         "camera=(), microphone=(), geolocation=()",
+	},
+}
+
+// modifyResponse applies the security profile and response header rules
+func (p *Proxy) modifyResponse(resp *http.Response) error {
+	for name, value := range p.securityHeaders {
+		if resp.Header.Get(name) == "" {
+			resp.Header.Set(name, value)
+		}
+	}
+	p.responseHeaders.apply(resp.Header)
+	return nil
+}
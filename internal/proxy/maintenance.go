@@ -0,0 +1,76 @@
+package proxy
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/jasonwu/dovetail/internal/errorpage"
+	"tailscale.com/client/tailscale/apitype"
+)
+
+// MaintenanceTitle heads the page shown while a service is in maintenance
+const MaintenanceTitle = "Down for maintenance"
+
+// Maintenance answers requests with a 503 maintenance page instead of
+// forwarding them. Callers matching an Allow entry (a login name, a node
+// name or a "tag:" ACL tag) still reach the container.
+type Maintenance struct {
+	Message string
+	Allow   []string
+}
+
+// SetMaintenance puts the service into maintenance, or takes it out with
+// nil
+func (p *Proxy) SetMaintenance(m *Maintenance) {
+	p.maintenance.Store(m)
+	if m != nil {
+		maintenanceGauge.Set(1, p.name)
+	} else {
+		maintenanceGauge.Set(0, p.name)
+	}
+}
+
+// Maintenance returns the current maintenance settings, or nil when the
+// service is serving normally
+func (p *Proxy) Maintenance() *Maintenance {
+	return p.maintenance.Load()
+}
+
+func (p *Proxy) checkMaintenance(w http.ResponseWriter, r *http.Request) bool {
+	m := p.maintenance.Load()
+	if m == nil || m.allows(p.whois(r)) {
+		return true
+	}
+
+	p.errorPages.Render(w, r, errorpage.Page{
+		Status:   http.StatusServiceUnavailable,
+		Service:  p.name,
+		Title:    MaintenanceTitle,
+		Message:  m.Message,
+		Template: "maintenance",
+	})
+	return false
+}
+
+func (m *Maintenance) allows(whois *apitype.WhoIsResponse) bool {
+	if whois == nil || len(m.Allow) == 0 {
+		return false
+	}
+
+	tagged := whois.Node != nil && whois.Node.IsTagged()
+	for _, entry := range m.Allow {
+		switch {
+		case strings.HasPrefix(entry, "tag:"):
+			if whois.Node != nil && slices.Contains(whois.Node.Tags, entry) {
+				return true
+			}
+		case whois.Node != nil && whois.Node.ComputedName == entry:
+			return true
+		case !tagged && whois.UserProfile != nil && strings.EqualFold(whois.UserProfile.LoginName, entry):
+			// Tagged devices have no user of their own
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,106 @@
+package proxy
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/jasonwu/dovetail/internal/metrics"
+)
+
+var (
+	requestsTotal = metrics.NewCounterVec(
+		"dovetail_requests_total",
+		"Requests proxied, by service and HTTP status code.",
+		"service", "code",
+	)
+	grpcRequestsTotal = metrics.NewCounterVec(
+		"dovetail_grpc_requests_total",
+		"gRPC calls proxied, by service and grpc-status.",
+		"service", "grpc_status",
+	)
+	funnelRequestsTotal = metrics.NewCounterVec(
+		"dovetail_funnel_requests_total",
+		"Requests received from the public internet over Tailscale Funnel.",
+		"service",
+	)
+	whoisCacheTotal = metrics.NewCounterVec(
+		"dovetail_whois_cache_requests_total",
+		"Caller identity lookups, by whether the WhoIs cache was hit.",
+		"service", "result",
+	)
+	cacheRequestsTotal = metrics.NewCounterVec(
+		"dovetail_cache_requests_total",
+		"Requests handled by the response cache, by cache status.",
+		"service", "status",
+	)
+	retriesTotal = metrics.NewCounterVec(
+		"dovetail_upstream_retries_total",
+		"Requests resent after failing to connect to the container.",
+		"service",
+	)
+	circuitOpenGauge = metrics.NewGaugeVec(
+		"dovetail_circuit_open",
+		"Whether the circuit breaker is rejecting requests to the container (1) or not (0).",
+		"service",
+	)
+	maintenanceGauge = metrics.NewGaugeVec(
+		"dovetail_maintenance",
+		"Whether the service is in maintenance mode (1) or not (0).",
+		"service",
+	)
+	rateLimitedTotal = metrics.NewCounterVec(
+		"dovetail_ratelimited_requests_total",
+		"Requests rejected with 429 by the per-identity rate limiter.",
+		"service",
+	)
+)
+
+// statusRecorder captures the status code written by the reverse proxy.
+// Unwrap lets http.ResponseController reach the underlying writer for
+// flushing and hijacking.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	if r.status == 0 {
+		r.status = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+func (p *Proxy) recordMetrics(rec *statusRecorder) {
+	status := rec.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	requestsTotal.Inc(p.name, strconv.Itoa(status))
+
+	if code, ok := grpcStatus(rec.Header()); ok {
+		grpcRequestsTotal.Inc(p.name, code)
+	}
+}
+
+// grpcStatus extracts grpc-status once the response has been copied. It is
+// either a header (trailers-only responses) or a trailer, which the reverse
+// proxy stores under its declared name or with http.TrailerPrefix.
+func grpcStatus(h http.Header) (string, bool) {
+	for _, key := range []string{"Grpc-Status", http.TrailerPrefix + "Grpc-Status"} {
+		if v := h.Get(key); v != "" {
+			return v, true
+		}
+	}
+	return "", false
+}
@@ -2,20 +2,59 @@ package proxy
 
 import (
 	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"log/slog"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"strconv"
+	"strings"
 	"sync/atomic"
+	"time"
 
+	"github.com/jasonwu/dovetail/internal/errorpage"
+	"github.com/jasonwu/dovetail/internal/identity"
 	"tailscale.com/client/tailscale/apitype"
 )
 
+// Identity headers describing the tailnet caller. User headers are only
+// set for devices owned by a person; tagged devices are identified by
+// their node and tags instead.
 const (
-	HeaderUser    = "X-Tailscale-User"
-	HeaderName    = "X-Tailscale-Name"
-	HeaderLogin   = "X-Tailscale-Login"
+	// HeaderUser and HeaderLogin hold the user's login name, such as
+	// alice@example.com or alice@github
+	HeaderUser  = "X-Tailscale-User"
+	HeaderLogin = "X-Tailscale-Login"
+
+	// HeaderName is the user's display name
+	HeaderName = "X-Tailscale-Name"
+
+	// HeaderProfilePicture is the URL of the user's avatar
+	HeaderProfilePicture = "X-Tailscale-Profile-Picture"
+
+	// HeaderNode is the calling device's MagicDNS short name
+	HeaderNode = "X-Tailscale-Node"
+
+	// HeaderNodeIP is the calling device's tailnet IP address
+	HeaderNodeIP = "X-Tailscale-Node-IP"
+
+	// HeaderTags lists the calling device's ACL tags, comma-separated
+	HeaderTags = "X-Tailscale-Tags"
+
+	// HeaderOS is the calling device's operating system, e.g. linux or ios
+	HeaderOS = "X-Tailscale-OS"
+
+	// HeaderTailnet is the MagicDNS domain of the calling device's
+	// tailnet, such as example.ts.net. For nodes shared in from another
+	// tailnet it is that tailnet's domain.
 	HeaderTailnet = "X-Tailscale-Tailnet"
+
+	// HeaderIdentityJWT carries a signed assertion of the caller's identity
+	// that backends can verify against dovetail's JWKS
+	HeaderIdentityJWT = "X-Tailscale-Identity-JWT"
 )
 
 // LocalClient abstracts the Tailscale local client for testing
@@ -23,66 +62,469 @@ type LocalClient interface {
 	WhoIs(ctx context.Context, remoteAddr string) (*apitype.WhoIsResponse, error)
 }
 
+// Upstream protocols
+const (
+	ProtocolHTTP = "http"
+	ProtocolH2C  = "h2c"
+	ProtocolGRPC = "grpc"
+)
+
+// Options configures optional proxy behavior.
+type Options struct {
+	// Name identifies the service in metrics.
+	Name string
+
+	// TLSConfig is used for https upstreams. When nil, the default
+	// transport settings apply.
+	TLSConfig *tls.Config
+
+	// Socket is the path of a Unix socket to connect to instead of the
+	// target's host and port. The target URL still sets the scheme and
+	// the Host header.
+	Socket string
+
+	// Protocol selects how the upstream is spoken to. ProtocolH2C and
+	// ProtocolGRPC use HTTP/2 only: cleartext (prior knowledge) for http
+	// targets and ALPN-negotiated for https targets.
+	Protocol string
+
+	// FunnelPaths restricts which path prefixes are reachable by requests
+	// arriving over Tailscale Funnel. Empty allows every path.
+	FunnelPaths []string
+
+	// WhoIsCacheTTL caches caller identities for this long. Zero disables
+	// caching.
+	WhoIsCacheTTL time.Duration
+
+	// RateLimit throttles requests per tailnet identity. Nil disables it.
+	RateLimit *RateLimit
+
+	// RequestHeaders and ResponseHeaders edit headers on the way to and
+	// from the container. Identity headers can't be overridden.
+	RequestHeaders  *HeaderRules
+	ResponseHeaders *HeaderRules
+
+	// SecurityHeaders names a SecurityProfiles entry whose headers are
+	// added to responses. Empty or SecurityOff adds none.
+	SecurityHeaders string
+
+	// Compression lists the encodings (see DefaultEncodings) responses may
+	// be compressed with, in order of preference. Empty disables it.
+	Compression []string
+
+	// Cache stores cacheable responses so repeat requests for static
+	// assets don't reach the container. Nil disables caching.
+	Cache *CacheOptions
+
+	// Retry resends idempotent requests that fail to connect. Nil sends
+	// each request once.
+	Retry *Retry
+
+	// CircuitBreaker rejects requests while the container keeps failing.
+	// Nil disables it.
+	CircuitBreaker *CircuitBreaker
+
+	// Maintenance starts the service in maintenance mode. See
+	// Proxy.SetMaintenance.
+	Maintenance *Maintenance
+
+	// MaxBodySize rejects requests with larger bodies with 413 Content Too
+	// Large. Zero means unlimited.
+	MaxBodySize int64
+
+	// PreserveHost sends the client's Host header to the container instead
+	// of the container's address
+	PreserveHost bool
+
+	// LegacyHeaders restores the original meaning of HeaderLogin (the node
+	// name) and HeaderTailnet (the device hostname), and user headers for
+	// tagged devices
+	LegacyHeaders bool
+
+	// IdentityHeaders maps additional request header names to identity
+	// fields (see IdentityHeaders and the Field constants)
+	IdentityHeaders map[string]string
+
+	// IdentitySigner, when set, adds a signed identity JWT to every
+	// request from a known caller
+	IdentitySigner *identity.Signer
+
+	// ErrorPages renders upstream failures and denied requests. Defaults to
+	// the built-in pages.
+	ErrorPages *errorpage.Renderer
+}
+
 type Proxy struct {
-	target      atomic.Pointer[url.URL]
-	localClient LocalClient
-	logger      *slog.Logger
-	handler     http.Handler
+	name            string
+	target          atomic.Pointer[url.URL]
+	localClient     LocalClient
+	funnelPaths     []string
+	errorPages      *errorpage.Renderer
+	limiter         *limiter
+	whoisCache      *whoisCache
+	signer          *identity.Signer
+	jwks            http.Handler
+	identityHeaders map[string]string
+	legacyHeaders   bool
+	preserveHost    bool
+	requestHeaders  *HeaderRules
+	responseHeaders *HeaderRules
+	securityHeaders map[string]string
+	compression     []string
+	cache           *responseCache
+	maxBodySize     int64
+	maintenance     atomic.Pointer[Maintenance]
+	logger          *slog.Logger
+	handler         http.Handler
 }
 
 func New(targetURL *url.URL, localClient LocalClient, logger *slog.Logger) *Proxy {
+	return NewWithOptions(targetURL, localClient, logger, Options{})
+}
+
+// NewWithOptions creates a Proxy with custom upstream connection settings
+func NewWithOptions(targetURL *url.URL, localClient LocalClient, logger *slog.Logger, opts Options) *Proxy {
 	p := &Proxy{
-		localClient: localClient,
-		logger:      logger,
+		name:            opts.Name,
+		localClient:     localClient,
+		funnelPaths:     opts.FunnelPaths,
+		errorPages:      opts.ErrorPages,
+		signer:          opts.IdentitySigner,
+		identityHeaders: opts.IdentityHeaders,
+		legacyHeaders:   opts.LegacyHeaders,
+		preserveHost:    opts.PreserveHost,
+		requestHeaders:  opts.RequestHeaders,
+		responseHeaders: opts.ResponseHeaders,
+		securityHeaders: SecurityProfiles[opts.SecurityHeaders],
+		compression:     opts.Compression,
+		maxBodySize:     opts.MaxBodySize,
+		logger:          logger,
+	}
+	if p.errorPages == nil {
+		p.errorPages = errorpage.Default()
+	}
+	if p.signer != nil {
+		p.jwks = p.signer.JWKSHandler()
+	}
+	if opts.RateLimit != nil {
+		p.limiter = newLimiter(*opts.RateLimit)
+	}
+	if opts.WhoIsCacheTTL > 0 {
+		p.whoisCache = newWhoIsCache(opts.WhoIsCacheTTL, DefaultWhoIsCacheSize)
+	}
+	if opts.Cache != nil {
+		cache, err := newResponseCache(*opts.Cache)
+		if err != nil {
+			logger.Warn("response cache disk store unavailable, caching in memory only", "service", opts.Name, "error", err)
+			cache, _ = newResponseCache(CacheOptions{MemorySize: opts.Cache.MemorySize})
+		}
+		p.cache = cache
 	}
 	p.target.Store(targetURL)
+	if opts.Maintenance != nil {
+		p.SetMaintenance(opts.Maintenance)
+	}
 
 	rp := &httputil.ReverseProxy{
-		Director: p.director,
+		Rewrite:      p.rewrite,
+		Transport:    p.upstreamTransport(opts),
+		ErrorHandler: p.handleError,
+	}
+	if len(p.securityHeaders) > 0 || !p.responseHeaders.empty() {
+		rp.ModifyResponse = p.modifyResponse
 	}
 
 	p.handler = rp
 	return p
 }
 
+// upstreamTransport layers retries over the circuit breaker, so every
+// attempt counts towards opening the circuit
+func (p *Proxy) upstreamTransport(opts Options) http.RoundTripper {
+	transport := newTransport(opts)
+	if opts.CircuitBreaker != nil && opts.CircuitBreaker.Failures > 0 {
+		transport = &breakerTransport{next: transport, breaker: newBreaker(opts.Name, *opts.CircuitBreaker)}
+	}
+	if opts.Retry != nil && opts.Retry.Attempts > 0 {
+		transport = newRetryTransport(transport, opts.Name, *opts.Retry)
+	}
+	return transport
+}
+
+func newTransport(opts Options) http.RoundTripper {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if opts.TLSConfig != nil {
+		transport.TLSClientConfig = opts.TLSConfig
+	}
+	if opts.Socket != "" {
+		var dialer net.Dialer
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "unix", opts.Socket)
+		}
+	}
+
+	switch opts.Protocol {
+	case ProtocolH2C, ProtocolGRPC:
+		var protocols http.Protocols
+		protocols.SetHTTP2(true)
+		protocols.SetUnencryptedHTTP2(true)
+		transport.Protocols = &protocols
+	}
+
+	return transport
+}
+
 func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Backends verifying identity assertions can fetch the keys here
+	if p.jwks != nil && r.URL.Path == identity.ServiceJWKSPath {
+		p.jwks.ServeHTTP(w, r)
+		return
+	}
+
+	rec := &statusRecorder{ResponseWriter: w}
+	r = p.resolveIdentity(r)
+	if p.checkFunnel(rec, r) && p.checkMaintenance(rec, r) && p.checkRateLimit(rec, r) && p.checkBodySize(rec, r) {
+		if cw := p.wrapCompression(rec, r); cw != nil {
+			p.serve(cw, r)
+			cw.Close()
+		} else {
+			p.serve(rec, r)
+		}
+	}
+	p.recordMetrics(rec)
+}
+
+// serve passes the request to the container, through the response cache
+// when one is configured. The cache sees uncompressed responses.
+func (p *Proxy) serve(w http.ResponseWriter, r *http.Request) {
+	if p.cache != nil {
+		p.serveCached(w, r, p.handler)
+		return
+	}
 	p.handler.ServeHTTP(w, r)
 }
 
+// handleError renders an error page when the upstream can't be reached or
+// doesn't answer in time
+func (p *Proxy) handleError(w http.ResponseWriter, r *http.Request, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		p.logger.Debug("request body too large", "path", r.URL.Path, "limit", tooLarge.Limit)
+		p.errorPages.Render(w, r, errorpage.Page{Status: http.StatusRequestEntityTooLarge, Service: p.name})
+		return
+	}
+
+	var open *circuitOpenError
+	if errors.As(err, &open) {
+		p.logger.Debug("circuit open, rejecting request", "path", r.URL.Path)
+		w.Header().Set("Retry-After", retryAfterHeader(open.retryAfter))
+		p.errorPages.Render(w, r, errorpage.Page{Status: http.StatusServiceUnavailable, Service: p.name})
+		return
+	}
+
+	status := http.StatusBadGateway
+	if errors.Is(err, context.DeadlineExceeded) || isTimeout(err) {
+		status = http.StatusGatewayTimeout
+	}
+
+	if r.Context().Err() != nil {
+		// The client went away; nobody will see the page
+		p.logger.Debug("client canceled request", "path", r.URL.Path, "error", err)
+	} else {
+		p.logger.Warn("upstream request failed", "path", r.URL.Path, "status", status, "error", err)
+	}
+
+	p.errorPages.Render(w, r, errorpage.Page{Status: status, Service: p.name})
+}
+
+// checkBodySize rejects requests declaring a body over the limit before
+// anything reaches the container, and caps the rest as they're read
+func (p *Proxy) checkBodySize(w http.ResponseWriter, r *http.Request) bool {
+	if p.maxBodySize <= 0 || r.Body == nil || r.Body == http.NoBody {
+		return true
+	}
+
+	if r.ContentLength > p.maxBodySize {
+		p.logger.Debug("request body too large", "path", r.URL.Path, "length", r.ContentLength, "limit", p.maxBodySize)
+		p.errorPages.Render(w, r, errorpage.Page{Status: http.StatusRequestEntityTooLarge, Service: p.name})
+		return false
+	}
+
+	// MaxBytesReader can only tell the server to close the connection
+	// through the server's own writer, not the status recorder
+	if rec, ok := w.(*statusRecorder); ok {
+		w = rec.ResponseWriter
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, p.maxBodySize)
+	return true
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
 func (p *Proxy) UpdateTarget(target *url.URL) {
 	p.target.Store(target)
 }
 
-func (p *Proxy) director(req *http.Request) {
+// rewrite points the outbound request at the container. ReverseProxy has
+// already removed hop-by-hop and client-supplied X-Forwarded-* headers.
+func (p *Proxy) rewrite(pr *httputil.ProxyRequest) {
 	target := p.target.Load()
-	req.URL.Scheme = target.Scheme
-	req.URL.Host = target.Host
-	req.Host = target.Host
+	pr.Out.URL.Scheme = target.Scheme
+	pr.Out.URL.Host = target.Host
+	pr.Out.Host = target.Host
+	if p.preserveHost {
+		pr.Out.Host = pr.In.Host
+	}
+
+	pr.SetXForwarded()
+	pr.Out.Header.Set("Forwarded", forwarded(pr.In))
+
+	p.requestHeaders.apply(pr.Out.Header)
 
 	// Inject Tailscale identity headers
-	p.injectIdentity(req)
+	p.injectIdentity(pr.Out)
 }
 
-func (p *Proxy) injectIdentity(req *http.Request) {
-	if p.localClient == nil {
-		return
+// forwarded builds an RFC 7239 Forwarded header describing the client's
+// request. Any value sent by the client is replaced rather than appended
+// to, since dovetail is the edge proxy.
+func forwarded(req *http.Request) string {
+	proto := "http"
+	if req.TLS != nil {
+		proto = "https"
+	}
+
+	var parts []string
+	if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		if strings.Contains(host, ":") {
+			// IPv6 addresses must be bracketed and quoted
+			host = `"[` + host + `]"`
+		}
+		parts = append(parts, "for="+host)
+	}
+	parts = append(parts, "host="+strconv.Quote(req.Host), "proto="+proto)
+
+	return strings.Join(parts, ";")
+}
+
+type whoisKey struct{}
+
+// resolveIdentity looks up the caller once per request and stores the
+// result in the request context for rate limiting and header injection
+func (p *Proxy) resolveIdentity(req *http.Request) *http.Request {
+	whois := p.whois(req)
+	if whois == nil {
+		return req
+	}
+	return req.WithContext(context.WithValue(req.Context(), whoisKey{}, whois))
+}
+
+// whois returns the tailnet identity of the caller, or nil if it is unknown.
+// Funnel traffic comes from the public internet and has no tailnet identity.
+func (p *Proxy) whois(req *http.Request) *apitype.WhoIsResponse {
+	if whois, ok := req.Context().Value(whoisKey{}).(*apitype.WhoIsResponse); ok {
+		return whois
+	}
+
+	if p.localClient == nil || IsFunnel(req.Context()) {
+		return nil
+	}
+
+	if p.whoisCache != nil {
+		if whois, ok := p.whoisCache.get(req.RemoteAddr); ok {
+			whoisCacheTotal.Inc(p.name, "hit")
+			return whois
+		}
+		whoisCacheTotal.Inc(p.name, "miss")
 	}
 
 	whois, err := p.localClient.WhoIs(req.Context(), req.RemoteAddr)
 	if err != nil {
 		p.logger.Debug("failed to get whois info", "remote", req.RemoteAddr, "error", err)
+		return nil
+	}
+
+	if p.whoisCache != nil {
+		p.whoisCache.put(req.RemoteAddr, whois)
+	}
+	return whois
+}
+
+// InvalidateIdentityCache drops cached WhoIs results, e.g. after the
+// netmap changes and users, tags or node names may have moved
+func (p *Proxy) InvalidateIdentityCache() {
+	if p.whoisCache != nil {
+		p.whoisCache.clear()
+	}
+}
+
+func (p *Proxy) injectIdentity(req *http.Request) {
+	// Never trust identity headers supplied by the client
+	for _, h := range identityHeaderNames {
+		req.Header.Del(h)
+	}
+	for h := range p.identityHeaders {
+		req.Header.Del(h)
+	}
+
+	whois := p.whois(req)
+	if whois == nil {
 		return
 	}
 
-	if whois.UserProfile != nil {
-		req.Header.Set(HeaderUser, whois.UserProfile.LoginName)
-		req.Header.Set(HeaderName, whois.UserProfile.DisplayName)
+	for h, value := range builtinHeaders(whois, req.RemoteAddr, p.legacyHeaders) {
+		req.Header.Set(h, value)
+	}
+
+	for h, field := range p.identityHeaders {
+		if value := identityField(whois, field, p.legacyHeaders); value != "" {
+			req.Header.Set(h, value)
+		}
+	}
+
+	if p.signer != nil {
+		token, err := p.signer.Sign(p.identityClaims(whois))
+		if err != nil {
+			p.logger.Warn("failed to sign identity assertion", "error", err)
+			return
+		}
+		req.Header.Set(HeaderIdentityJWT, token)
+	}
+}
+
+// identityClaims builds the signed assertion for a caller. Tagged devices
+// have no meaningful user, so the node name becomes the subject and the
+// user claims are left out unless legacy headers are on.
+func (p *Proxy) identityClaims(whois *apitype.WhoIsResponse) identity.Claims {
+	claims := identity.Claims{Audience: p.name}
+
+	if user := callerUser(whois, p.legacyHeaders); user != nil {
+		claims.Login = user.LoginName
+		claims.Name = user.DisplayName
+		claims.Subject = user.LoginName
 	}
 
 	if whois.Node != nil {
-		req.Header.Set(HeaderLogin, whois.Node.ComputedName)
-		if whois.Node.Hostinfo.Valid() {
-			req.Header.Set(HeaderTailnet, string(whois.Node.Hostinfo.Hostname()))
+		claims.Node = whois.Node.ComputedName
+		claims.Tags = whois.Node.Tags
+		if whois.Node.IsTagged() {
+			claims.Subject = whois.Node.ComputedName
 		}
 	}
+
+	if len(whois.CapMap) > 0 {
+		claims.Capabilities = make(map[string][]json.RawMessage, len(whois.CapMap))
+		for capability, values := range whois.CapMap {
+			raw := make([]json.RawMessage, len(values))
+			for i, v := range values {
+				raw[i] = json.RawMessage(v)
+			}
+			claims.Capabilities[string(capability)] = raw
+		}
+	}
+
+	return claims
 }
@@ -1,15 +1,30 @@
 package proxy
 
 import (
+	"bytes"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"io"
 	"log/slog"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/http/httputil"
 	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/andybalholm/brotli"
+	"github.com/jasonwu/dovetail/internal/identity"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
 	"tailscale.com/client/tailscale/apitype"
 	"tailscale.com/tailcfg"
 )
@@ -42,34 +57,116 @@ func TestUpdateTarget(t *testing.T) {
 	}
 }
 
-func TestDirector(t *testing.T) {
+func TestRewrite(t *testing.T) {
 	targetURL, _ := url.Parse("http://backend:8080")
 	logger := slog.Default()
 
 	p := New(targetURL, nil, logger)
 
 	req := httptest.NewRequest(http.MethodGet, "https://original.example.com/path?query=1", nil)
+	pr := &httputil.ProxyRequest{In: req, Out: req.Clone(req.Context())}
 
-	p.director(req)
+	p.rewrite(pr)
 
-	if req.URL.Scheme != "http" {
-		t.Errorf("scheme = %q, want %q", req.URL.Scheme, "http")
+	if pr.Out.URL.Scheme != "http" {
+		t.Errorf("scheme = %q, want %q", pr.Out.URL.Scheme, "http")
 	}
 
-	if req.URL.Host != "backend:8080" {
-		t.Errorf("host = %q, want %q", req.URL.Host, "backend:8080")
+	if pr.Out.URL.Host != "backend:8080" {
+		t.Errorf("host = %q, want %q", pr.Out.URL.Host, "backend:8080")
 	}
 
-	if req.Host != "backend:8080" {
-		t.Errorf("req.Host = %q, want %q", req.Host, "backend:8080")
+	if pr.Out.Host != "backend:8080" {
+		t.Errorf("req.Host = %q, want %q", pr.Out.Host, "backend:8080")
 	}
 
-	if req.URL.Path != "/path" {
-		t.Errorf("path = %q, want %q", req.URL.Path, "/path")
+	if pr.Out.URL.Path != "/path" {
+		t.Errorf("path = %q, want %q", pr.Out.URL.Path, "/path")
 	}
 
-	if req.URL.RawQuery != "query=1" {
-		t.Errorf("query = %q, want %q", req.URL.RawQuery, "query=1")
+	if pr.Out.URL.RawQuery != "query=1" {
+		t.Errorf("query = %q, want %q", pr.Out.URL.RawQuery, "query=1")
+	}
+}
+
+func TestRewrite_PreserveHost(t *testing.T) {
+	targetURL, _ := url.Parse("http://backend:8080")
+	p := NewWithOptions(targetURL, nil, slog.Default(), Options{PreserveHost: true})
+
+	req := httptest.NewRequest(http.MethodGet, "https://app.example.ts.net/", nil)
+	pr := &httputil.ProxyRequest{In: req, Out: req.Clone(req.Context())}
+	p.rewrite(pr)
+
+	if pr.Out.Host != "app.example.ts.net" {
+		t.Errorf("req.Host = %q, want %q", pr.Out.Host, "app.example.ts.net")
+	}
+	if pr.Out.URL.Host != "backend:8080" {
+		t.Errorf("URL.Host = %q, want %q", pr.Out.URL.Host, "backend:8080")
+	}
+}
+
+func TestForwarded(t *testing.T) {
+	tests := []struct {
+		name       string
+		remoteAddr string
+		tls        bool
+		want       string
+	}{
+		{"https ipv4", "100.100.100.1:12345", true, `for=100.100.100.1;host="app.example.ts.net";proto=https`},
+		{"http ipv6", "[fd7a:115c:a1e0::1]:12345", false, `for="[fd7a:115c:a1e0::1]";host="app.example.ts.net";proto=http`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "http://app.example.ts.net/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			if tt.tls {
+				req.TLS = &tls.ConnectionState{}
+			}
+
+			if got := forwarded(req); got != tt.want {
+				t.Errorf("forwarded = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestServeHTTP_ForwardingHeaders(t *testing.T) {
+	var got http.Header
+	var gotHost string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+		gotHost = r.Host
+	}))
+	defer backend.Close()
+
+	backendURL, _ := url.Parse(backend.URL)
+	p := New(backendURL, nil, slog.Default())
+
+	req := httptest.NewRequest(http.MethodGet, "https://app.example.ts.net/", nil)
+	req.RemoteAddr = "100.100.100.1:12345"
+	req.TLS = &tls.ConnectionState{}
+	req.Header.Set("X-Forwarded-For", "10.0.0.1")
+	req.Header.Set("X-Forwarded-Host", "evil.example.com")
+	req.Header.Set("Forwarded", "for=10.0.0.1")
+	req.Header.Set("Connection", "X-Secret")
+	req.Header.Set("X-Secret", "hop-by-hop")
+	p.ServeHTTP(httptest.NewRecorder(), req)
+
+	want := map[string]string{
+		"X-Forwarded-For":   "100.100.100.1",
+		"X-Forwarded-Host":  "app.example.ts.net",
+		"X-Forwarded-Proto": "https",
+		"Forwarded":         `for=100.100.100.1;host="app.example.ts.net";proto=https`,
+		"X-Secret":          "",
+	}
+	for h, v := range want {
+		if got.Get(h) != v {
+			t.Errorf("%s = %q, want %q", h, got.Get(h), v)
+		}
+	}
+	if gotHost != backendURL.Host {
+		t.Errorf("Host = %q, want %q", gotHost, backendURL.Host)
 	}
 }
 
@@ -83,6 +180,11 @@ func TestHeaderConstants(t *testing.T) {
 		{"HeaderName", HeaderName, "X-Tailscale-Name"},
 		{"HeaderLogin", HeaderLogin, "X-Tailscale-Login"},
 		{"HeaderTailnet", HeaderTailnet, "X-Tailscale-Tailnet"},
+		{"HeaderProfilePicture", HeaderProfilePicture, "X-Tailscale-Profile-Picture"},
+		{"HeaderNode", HeaderNode, "X-Tailscale-Node"},
+		{"HeaderNodeIP", HeaderNodeIP, "X-Tailscale-Node-IP"},
+		{"HeaderTags", HeaderTags, "X-Tailscale-Tags"},
+		{"HeaderOS", HeaderOS, "X-Tailscale-OS"},
 	}
 
 	for _, tt := range tests {
@@ -98,9 +200,11 @@ func TestHeaderConstants(t *testing.T) {
 type mockLocalClient struct {
 	whoisResponse *apitype.WhoIsResponse
 	whoisErr      error
+	calls         int
 }
 
 func (m *mockLocalClient) WhoIs(ctx context.Context, remoteAddr string) (*apitype.WhoIsResponse, error) {
+	m.calls++
 	if m.whoisErr != nil {
 		return nil, m.whoisErr
 	}
@@ -189,8 +293,11 @@ func TestInjectIdentity_WithNode(t *testing.T) {
 	req.RemoteAddr = "100.100.100.1:12345"
 	p.injectIdentity(req)
 
-	if got := req.Header.Get(HeaderLogin); got != "test-node" {
-		t.Errorf("HeaderLogin = %q, want %q", got, "test-node")
+	if got := req.Header.Get(HeaderNode); got != "test-node" {
+		t.Errorf("HeaderNode = %q, want %q", got, "test-node")
+	}
+	if got := req.Header.Get(HeaderLogin); got != "" {
+		t.Errorf("HeaderLogin = %q, want empty without a user profile", got)
 	}
 }
 
@@ -226,7 +333,9 @@ func TestInjectIdentity_FullResponse(t *testing.T) {
 	}{
 		{HeaderUser, "alice@example.com"},
 		{HeaderName, "Alice Smith"},
-		{HeaderLogin, "alice-laptop"},
+		{HeaderLogin, "alice@example.com"},
+		{HeaderNode, "alice-laptop"},
+		{HeaderNodeIP, "100.100.100.1"},
 	}
 
 	for _, tt := range tests {
@@ -284,3 +393,1730 @@ func TestServeHTTP(t *testing.T) {
 		t.Errorf("Backend received HeaderUser = %q, want %q", got, "test@example.com")
 	}
 }
+
+func TestServeHTTP_HTTPSUpstream(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("secure"))
+	}))
+	defer backend.Close()
+
+	backendURL, _ := url.Parse(backend.URL)
+	logger := slog.Default()
+
+	t.Run("self-signed certificate rejected by default", func(t *testing.T) {
+		p := New(backendURL, nil, logger)
+
+		req := httptest.NewRequest(http.MethodGet, "https://proxy.example.com/", nil)
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, req)
+
+		if w.Code != http.StatusBadGateway {
+			t.Errorf("StatusCode = %d, want %d", w.Code, http.StatusBadGateway)
+		}
+	})
+
+	t.Run("insecure skip verify", func(t *testing.T) {
+		p := NewWithOptions(backendURL, nil, logger, Options{
+			TLSConfig: &tls.Config{InsecureSkipVerify: true},
+		})
+
+		req := httptest.NewRequest(http.MethodGet, "https://proxy.example.com/", nil)
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Errorf("StatusCode = %d, want %d", w.Code, http.StatusOK)
+		}
+		if got := w.Body.String(); got != "secure" {
+			t.Errorf("Body = %q, want %q", got, "secure")
+		}
+	})
+
+	t.Run("custom root CA", func(t *testing.T) {
+		pool := x509.NewCertPool()
+		pool.AddCert(backend.Certificate())
+
+		p := NewWithOptions(backendURL, nil, logger, Options{
+			TLSConfig: &tls.Config{RootCAs: pool},
+		})
+
+		req := httptest.NewRequest(http.MethodGet, "https://proxy.example.com/", nil)
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Errorf("StatusCode = %d, want %d", w.Code, http.StatusOK)
+		}
+	})
+}
+
+func TestServeHTTP_H2CUpstream(t *testing.T) {
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 {
+			t.Errorf("backend received HTTP/%d.%d, want HTTP/2", r.ProtoMajor, r.ProtoMinor)
+		}
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("frame"))
+		w.Header().Set("Grpc-Status", "5")
+	}))
+	backend.Config.Protocols = new(http.Protocols)
+	backend.Config.Protocols.SetUnencryptedHTTP2(true)
+	backend.Start()
+	defer backend.Close()
+
+	backendURL, _ := url.Parse(backend.URL)
+	logger := slog.Default()
+
+	p := NewWithOptions(backendURL, nil, logger, Options{
+		Name:     "grpc-test",
+		Protocol: ProtocolGRPC,
+	})
+
+	req := httptest.NewRequest(http.MethodPost, "https://proxy.example.com/pkg.Service/Method", nil)
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("Te", "trailers")
+	w := httptest.NewRecorder()
+
+	p.ServeHTTP(w, req)
+
+	resp := w.Result()
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("StatusCode = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if got := resp.Trailer.Get("Grpc-Status"); got != "5" {
+		t.Errorf("Grpc-Status trailer = %q, want %q", got, "5")
+	}
+	if got := grpcRequestsTotal.Value("grpc-test", "5"); got != 1 {
+		t.Errorf("grpc requests metric = %v, want 1", got)
+	}
+	if got := requestsTotal.Value("grpc-test", "200"); got != 1 {
+		t.Errorf("requests metric = %v, want 1", got)
+	}
+}
+
+func TestServeHTTP_UnixSocket(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "app.sock")
+	ln, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Skipf("unix sockets unavailable: %v", err)
+	}
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("host=" + r.Host + " path=" + r.URL.Path))
+	}))
+	backend.Listener = ln
+	backend.Start()
+	defer backend.Close()
+
+	targetURL, _ := url.Parse("http://localhost")
+	p := NewWithOptions(targetURL, nil, slog.Default(), Options{Name: "socket-test", Socket: socket})
+
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "https://proxy.example.com/api/status", nil))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("StatusCode = %d, want %d", w.Code, http.StatusOK)
+	}
+	if got, want := w.Body.String(), "host=localhost path=/api/status"; got != want {
+		t.Errorf("body = %q, want %q", got, want)
+	}
+}
+
+func TestGRPCStatus(t *testing.T) {
+	tests := []struct {
+		name   string
+		header http.Header
+		want   string
+		wantOK bool
+	}{
+		{"no status", http.Header{}, "", false},
+		{"trailers-only header", http.Header{"Grpc-Status": {"14"}}, "14", true},
+		{"unannounced trailer", http.Header{http.TrailerPrefix + "Grpc-Status": {"0"}}, "0", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := grpcStatus(tt.header)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("grpcStatus() = (%q, %v), want (%q, %v)", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestFunnelAllowed(t *testing.T) {
+	tests := []struct {
+		name    string
+		allowed []string
+		path    string
+		want    bool
+	}{
+		{"no restrictions", nil, "/admin", true},
+		{"exact match", []string{"/share"}, "/share", true},
+		{"nested path", []string{"/share"}, "/share/album/1", true},
+		{"trailing slash prefix", []string{"/share/"}, "/share/album", true},
+		{"similar prefix rejected", []string{"/share"}, "/shared-secrets", false},
+		{"other path rejected", []string{"/share", "/api/webhook"}, "/admin", false},
+		{"second prefix", []string{"/share", "/api/webhook"}, "/api/webhook/github", true},
+		{"dot segments rejected", []string{"/share"}, "/share/../admin", false},
+		{"double slash rejected", []string{"/share"}, "//share/x", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := funnelAllowed(tt.allowed, tt.path); got != tt.want {
+				t.Errorf("funnelAllowed(%v, %q) = %v, want %v", tt.allowed, tt.path, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestServeHTTP_Funnel(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Received-User", r.Header.Get(HeaderUser))
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer backend.Close()
+
+	backendURL, _ := url.Parse(backend.URL)
+	logger := slog.Default()
+
+	mock := &mockLocalClient{
+		whoisResponse: &apitype.WhoIsResponse{
+			UserProfile: &tailcfg.UserProfile{LoginName: "alice@example.com"},
+		},
+	}
+	p := NewWithOptions(backendURL, mock, logger, Options{
+		Name:        "funnel-test",
+		FunnelPaths: []string{"/share"},
+	})
+
+	t.Run("public path omits identity headers", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "https://proxy.example.com/share/abc", nil)
+		req = req.WithContext(WithFunnel(req.Context()))
+		req.Header.Set(HeaderUser, "spoofed@example.com")
+		w := httptest.NewRecorder()
+
+		p.ServeHTTP(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("StatusCode = %d, want %d", w.Code, http.StatusOK)
+		}
+		if got := w.Header().Get("X-Received-User"); got != "" {
+			t.Errorf("backend received HeaderUser = %q, want empty", got)
+		}
+	})
+
+	t.Run("non-public path denied", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "https://proxy.example.com/admin", nil)
+		req = req.WithContext(WithFunnel(req.Context()))
+		w := httptest.NewRecorder()
+
+		p.ServeHTTP(w, req)
+
+		if w.Code != http.StatusForbidden {
+			t.Errorf("StatusCode = %d, want %d", w.Code, http.StatusForbidden)
+		}
+	})
+
+	t.Run("tailnet request unrestricted", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "https://proxy.example.com/admin", nil)
+		req.RemoteAddr = "100.100.100.1:12345"
+		w := httptest.NewRecorder()
+
+		p.ServeHTTP(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Errorf("StatusCode = %d, want %d", w.Code, http.StatusOK)
+		}
+		if got := w.Header().Get("X-Received-User"); got != "alice@example.com" {
+			t.Errorf("backend received HeaderUser = %q, want %q", got, "alice@example.com")
+		}
+	})
+
+	if got := funnelRequestsTotal.Value("funnel-test"); got != 2 {
+		t.Errorf("funnel requests metric = %v, want 2", got)
+	}
+}
+
+func TestInjectIdentity_StripsClientHeaders(t *testing.T) {
+	targetURL, _ := url.Parse("http://localhost:8080")
+	logger := slog.Default()
+
+	mock := &mockLocalClient{
+		whoisErr: errors.New("whois lookup failed"),
+	}
+	p := New(targetURL, mock, logger)
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	req.RemoteAddr = "100.100.100.1:12345"
+	req.Header.Set(HeaderUser, "spoofed@example.com")
+	req.Header.Set(HeaderLogin, "spoofed-node")
+	p.injectIdentity(req)
+
+	if got := req.Header.Get(HeaderUser); got != "" {
+		t.Errorf("HeaderUser = %q, want empty", got)
+	}
+	if got := req.Header.Get(HeaderLogin); got != "" {
+		t.Errorf("HeaderLogin = %q, want empty", got)
+	}
+}
+
+func TestServeHTTP_ErrorPages(t *testing.T) {
+	// Reserve a port and close it so connections are refused
+	backend := httptest.NewServer(http.NotFoundHandler())
+	backendURL, _ := url.Parse(backend.URL)
+	backend.Close()
+
+	logger := slog.Default()
+	p := NewWithOptions(backendURL, nil, logger, Options{Name: "down"})
+
+	t.Run("html", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "https://proxy.example.com/", nil)
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, req)
+
+		if w.Code != http.StatusBadGateway {
+			t.Errorf("StatusCode = %d, want %d", w.Code, http.StatusBadGateway)
+		}
+		if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/html") {
+			t.Errorf("Content-Type = %q, want text/html", ct)
+		}
+		if !strings.Contains(w.Body.String(), "down") {
+			t.Error("error page should mention the service name")
+		}
+	})
+
+	t.Run("json", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "https://proxy.example.com/api", nil)
+		req.Header.Set("Accept", "application/json")
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, req)
+
+		if w.Code != http.StatusBadGateway {
+			t.Errorf("StatusCode = %d, want %d", w.Code, http.StatusBadGateway)
+		}
+		if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("Content-Type = %q, want application/json", ct)
+		}
+	})
+}
+
+func TestServeHTTP_GatewayTimeout(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer backend.Close()
+
+	backendURL, _ := url.Parse(backend.URL)
+	p := New(backendURL, nil, slog.Default())
+	p.handler.(*httputil.ReverseProxy).Transport.(*http.Transport).ResponseHeaderTimeout = 20 * time.Millisecond
+
+	req := httptest.NewRequest(http.MethodGet, "https://proxy.example.com/", nil)
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, req)
+
+	if w.Code != http.StatusGatewayTimeout {
+		t.Errorf("StatusCode = %d, want %d", w.Code, http.StatusGatewayTimeout)
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	l := newLimiter(RateLimit{Requests: 2, Per: time.Minute, Burst: 2})
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.allow("user:alice"); !ok {
+			t.Fatalf("request %d denied, want allowed within burst", i+1)
+		}
+	}
+
+	ok, delay := l.allow("user:alice")
+	if ok {
+		t.Fatal("third request allowed, want denied")
+	}
+	if delay <= 0 || delay > 30*time.Second {
+		t.Errorf("delay = %v, want (0, 30s]", delay)
+	}
+
+	if ok, _ := l.allow("user:bob"); !ok {
+		t.Error("other user denied, want separate bucket")
+	}
+
+	now = now.Add(30 * time.Second)
+	if ok, _ := l.allow("user:alice"); !ok {
+		t.Error("request after refill denied, want allowed")
+	}
+
+	now = now.Add(limiterIdleTimeout + time.Minute)
+	l.allow("user:carol")
+	if _, ok := l.buckets["user:bob"]; ok {
+		t.Error("idle bucket was not swept")
+	}
+}
+
+func TestLimiter_HourlySweep(t *testing.T) {
+	l := newLimiter(RateLimit{Requests: 10, Per: time.Hour})
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < 10; i++ {
+		if ok, _ := l.allow("user:alice"); !ok {
+			t.Fatalf("request %d denied, want allowed within burst", i+1)
+		}
+	}
+
+	// Sweeping after the default idle timeout mustn't hand out a fresh
+	// bucket before the old one has refilled
+	now = now.Add(limiterIdleTimeout + time.Minute)
+	l.sweep(now)
+	if _, ok := l.buckets["user:alice"]; !ok {
+		t.Fatal("bucket swept before it refilled")
+	}
+	// 11 minutes refill one request, not the whole burst
+	l.allow("user:alice")
+	if ok, _ := l.allow("user:alice"); ok {
+		t.Error("second request allowed 11 minutes into an hourly limit of 10, want denied")
+	}
+
+	now = now.Add(time.Hour + time.Minute)
+	l.sweep(now)
+	if _, ok := l.buckets["user:alice"]; ok {
+		t.Error("refilled bucket was not swept")
+	}
+}
+
+func TestLimiterKey(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "100.64.0.7:4242"
+
+	user := &apitype.WhoIsResponse{
+		UserProfile: &tailcfg.UserProfile{LoginName: "alice@example.com"},
+		Node:        &tailcfg.Node{StableID: "nAbC123"},
+	}
+	// WhoIs returns the same placeholder profile for every tagged device
+	tagged := &apitype.WhoIsResponse{
+		UserProfile: &tailcfg.UserProfile{LoginName: "tagged-devices", DisplayName: "Tagged Devices"},
+		Node:        &tailcfg.Node{StableID: "nTag456", Tags: []string{"tag:ci"}},
+	}
+	noUser := &apitype.WhoIsResponse{
+		Node: &tailcfg.Node{StableID: "nDef789"},
+	}
+
+	tests := []struct {
+		name  string
+		by    string
+		whois *apitype.WhoIsResponse
+		want  string
+	}{
+		{"by user", RateLimitByUser, user, "user:alice@example.com"},
+		{"by node", RateLimitByNode, user, "node:nAbC123"},
+		{"tagged node", RateLimitByUser, tagged, "node:nTag456"},
+		{"node without user", RateLimitByUser, noUser, "node:nDef789"},
+		{"unknown caller", RateLimitByUser, nil, "ip:100.64.0.7"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newLimiter(RateLimit{Requests: 1, Per: time.Second, By: tt.by})
+			if got := l.key(tt.whois, req); got != tt.want {
+				t.Errorf("key() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestServeHTTP_RateLimit(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer backend.Close()
+
+	backendURL, _ := url.Parse(backend.URL)
+	mock := &mockLocalClient{
+		whoisResponse: &apitype.WhoIsResponse{
+			UserProfile: &tailcfg.UserProfile{LoginName: "script@example.com"},
+		},
+	}
+	p := NewWithOptions(backendURL, mock, slog.Default(), Options{
+		Name:      "ratelimit-test",
+		RateLimit: &RateLimit{Requests: 1, Per: time.Minute, Burst: 1, By: RateLimitByUser},
+	})
+
+	send := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "https://proxy.example.com/", nil)
+		req.RemoteAddr = "100.100.100.1:12345"
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := send(); w.Code != http.StatusOK {
+		t.Fatalf("first request StatusCode = %d, want %d", w.Code, http.StatusOK)
+	}
+	if mock.calls != 1 {
+		t.Errorf("WhoIs called %d times for one request, want 1", mock.calls)
+	}
+
+	w := send()
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("second request StatusCode = %d, want %d", w.Code, http.StatusTooManyRequests)
+	}
+	if got := w.Header().Get("Retry-After"); got != "60" {
+		t.Errorf("Retry-After = %q, want %q", got, "60")
+	}
+	if got := rateLimitedTotal.Value("ratelimit-test"); got != 1 {
+		t.Errorf("rate limited metric = %v, want 1", got)
+	}
+}
+
+func TestWhoIsCache(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	c := newWhoIsCache(10*time.Second, 2)
+	c.now = func() time.Time { return now }
+
+	alice := &apitype.WhoIsResponse{UserProfile: &tailcfg.UserProfile{LoginName: "alice@example.com"}}
+	bob := &apitype.WhoIsResponse{UserProfile: &tailcfg.UserProfile{LoginName: "bob@example.com"}}
+	carol := &apitype.WhoIsResponse{UserProfile: &tailcfg.UserProfile{LoginName: "carol@example.com"}}
+
+	c.put("100.100.100.1:1000", alice)
+	if got, ok := c.get("100.100.100.1:2000"); !ok || got != alice {
+		t.Fatal("expected cache hit for a different port on the same IP")
+	}
+
+	// Touching alice makes bob the least recently used entry
+	c.put("100.100.100.2:1000", bob)
+	c.get("100.100.100.1:1000")
+	c.put("100.100.100.3:1000", carol)
+
+	if c.len() != 2 {
+		t.Errorf("len = %d, want 2", c.len())
+	}
+	if _, ok := c.get("100.100.100.2:1000"); ok {
+		t.Error("expected least recently used entry to be evicted")
+	}
+
+	now = now.Add(11 * time.Second)
+	if _, ok := c.get("100.100.100.1:1000"); ok {
+		t.Error("expected expired entry to miss")
+	}
+
+	c.put("100.100.100.1:1000", alice)
+	c.clear()
+	if c.len() != 0 {
+		t.Errorf("len after clear = %d, want 0", c.len())
+	}
+}
+
+func TestServeHTTP_WhoIsCache(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get(HeaderUser)))
+	}))
+	defer backend.Close()
+
+	backendURL, _ := url.Parse(backend.URL)
+	mock := &mockLocalClient{
+		whoisResponse: &apitype.WhoIsResponse{
+			UserProfile: &tailcfg.UserProfile{LoginName: "cached@example.com"},
+		},
+	}
+	p := NewWithOptions(backendURL, mock, slog.Default(), Options{
+		Name:          "whois-cache-test",
+		WhoIsCacheTTL: time.Minute,
+	})
+
+	send := func() string {
+		req := httptest.NewRequest(http.MethodGet, "https://proxy.example.com/", nil)
+		req.RemoteAddr = "100.100.100.1:12345"
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, req)
+		return w.Body.String()
+	}
+
+	for i := 0; i < 3; i++ {
+		if got := send(); got != "cached@example.com" {
+			t.Fatalf("request %d login = %q, want %q", i, got, "cached@example.com")
+		}
+	}
+	if mock.calls != 1 {
+		t.Errorf("WhoIs called %d times, want 1", mock.calls)
+	}
+	if got := whoisCacheTotal.Value("whois-cache-test", "hit"); got != 2 {
+		t.Errorf("cache hits = %v, want 2", got)
+	}
+	if got := whoisCacheTotal.Value("whois-cache-test", "miss"); got != 1 {
+		t.Errorf("cache misses = %v, want 1", got)
+	}
+
+	p.InvalidateIdentityCache()
+	send()
+	if mock.calls != 2 {
+		t.Errorf("WhoIs called %d times after invalidation, want 2", mock.calls)
+	}
+}
+
+func TestServeHTTP_IdentityJWT(t *testing.T) {
+	var gotToken string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotToken = r.Header.Get(HeaderIdentityJWT)
+	}))
+	defer backend.Close()
+
+	signer, err := identity.LoadOrCreate(filepath.Join(t.TempDir(), identity.KeyFile))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	backendURL, _ := url.Parse(backend.URL)
+	mock := &mockLocalClient{
+		whoisResponse: &apitype.WhoIsResponse{
+			UserProfile: &tailcfg.UserProfile{LoginName: "tagged-devices"},
+			Node: &tailcfg.Node{
+				ComputedName: "ci-runner",
+				Tags:         []string{"tag:ci"},
+			},
+			CapMap: tailcfg.PeerCapMap{"example.com/cap/deploy": {`"prod"`}},
+		},
+	}
+	p := NewWithOptions(backendURL, mock, slog.Default(), Options{
+		Name:           "deploy",
+		IdentitySigner: signer,
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "https://proxy.example.com/", nil)
+	req.RemoteAddr = "100.100.100.1:12345"
+	req.Header.Set(HeaderIdentityJWT, "forged")
+	p.ServeHTTP(httptest.NewRecorder(), req)
+
+	claims, err := signer.Verify(gotToken)
+	if err != nil {
+		t.Fatalf("backend received unverifiable token %q: %v", gotToken, err)
+	}
+	if claims.Audience != "deploy" {
+		t.Errorf("Audience = %q, want %q", claims.Audience, "deploy")
+	}
+	if claims.Subject != "ci-runner" {
+		t.Errorf("Subject = %q, want node name for tagged device", claims.Subject)
+	}
+	if claims.Login != "" || claims.Name != "" {
+		t.Errorf("Login = %q, Name = %q, want no user claims for tagged device", claims.Login, claims.Name)
+	}
+	if len(claims.Tags) != 1 || claims.Tags[0] != "tag:ci" {
+		t.Errorf("Tags = %v, want [tag:ci]", claims.Tags)
+	}
+	if got := string(claims.Capabilities["example.com/cap/deploy"][0]); got != `"prod"` {
+		t.Errorf("capability value = %s, want %q", got, `"prod"`)
+	}
+}
+
+func TestServeHTTP_ServiceJWKS(t *testing.T) {
+	backendHit := false
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		backendHit = true
+	}))
+	defer backend.Close()
+
+	signer, err := identity.LoadOrCreate(filepath.Join(t.TempDir(), identity.KeyFile))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	backendURL, _ := url.Parse(backend.URL)
+	mock := &mockLocalClient{
+		whoisResponse: &apitype.WhoIsResponse{
+			UserProfile: &tailcfg.UserProfile{LoginName: "user@example.com"},
+			Node:        &tailcfg.Node{ComputedName: "laptop"},
+		},
+	}
+	p := NewWithOptions(backendURL, mock, slog.Default(), Options{
+		Name:           "deploy",
+		IdentitySigner: signer,
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "https://proxy.example.com"+identity.ServiceJWKSPath, nil)
+	req.RemoteAddr = "100.100.100.1:12345"
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	if backendHit {
+		t.Error("expected key set to be served without reaching the backend")
+	}
+	if !strings.Contains(rec.Body.String(), `"keys"`) {
+		t.Errorf("body = %q, want a JWK set", rec.Body.String())
+	}
+
+	// Without a signer the path belongs to the backend
+	p = NewWithOptions(backendURL, mock, slog.Default(), Options{Name: "plain"})
+	p.ServeHTTP(httptest.NewRecorder(), req)
+	if !backendHit {
+		t.Error("expected request to reach the backend when no signer is set")
+	}
+}
+
+func TestIdentityHeaders(t *testing.T) {
+	if got := IdentityHeaders("", nil); got != nil {
+		t.Errorf("IdentityHeaders with nothing configured = %v, want nil", got)
+	}
+
+	got := IdentityHeaders("grafana", map[string]string{
+		"x-webauth-user": FieldEmail,
+		"remote-groups":  FieldTags,
+	})
+	want := map[string]string{
+		"X-Webauth-User":  FieldEmail,
+		"X-Webauth-Name":  FieldName,
+		"X-Webauth-Email": FieldEmail,
+		"Remote-Groups":   FieldTags,
+	}
+	if len(got) != len(want) {
+		t.Fatalf("IdentityHeaders = %v, want %v", got, want)
+	}
+	for h, field := range want {
+		if got[h] != field {
+			t.Errorf("header %s = %q, want %q", h, got[h], field)
+		}
+	}
+}
+
+func TestInjectIdentity_MappedHeaders(t *testing.T) {
+	targetURL, _ := url.Parse("http://localhost:8080")
+	mock := &mockLocalClient{
+		whoisResponse: &apitype.WhoIsResponse{
+			UserProfile: &tailcfg.UserProfile{
+				LoginName:   "alice@example.com",
+				DisplayName: "Alice Smith",
+			},
+			Node: &tailcfg.Node{
+				ComputedName: "alice-laptop",
+			},
+		},
+	}
+	p := NewWithOptions(targetURL, mock, slog.Default(), Options{
+		IdentityHeaders: IdentityHeaders("authelia", map[string]string{"X-Device": FieldNode}),
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	req.RemoteAddr = "100.100.100.1:12345"
+	p.injectIdentity(req)
+
+	want := map[string]string{
+		"Remote-User":   "alice@example.com",
+		"Remote-Name":   "Alice Smith",
+		"Remote-Email":  "alice@example.com",
+		"Remote-Groups": "",
+		"X-Device":      "alice-laptop",
+	}
+	for h, v := range want {
+		if got := req.Header.Get(h); got != v {
+			t.Errorf("%s = %q, want %q", h, got, v)
+		}
+	}
+
+	tagged := &mockLocalClient{
+		whoisResponse: &apitype.WhoIsResponse{
+			UserProfile: &tailcfg.UserProfile{
+				LoginName:   "tagged-devices",
+				DisplayName: "Tagged Devices",
+			},
+			Node: &tailcfg.Node{
+				ComputedName: "ci-runner",
+				Tags:         []string{"tag:admin", "tag:dev"},
+			},
+		},
+	}
+
+	t.Run("tagged node has no user fields", func(t *testing.T) {
+		p := NewWithOptions(targetURL, tagged, slog.Default(), Options{
+			IdentityHeaders: IdentityHeaders("authelia", map[string]string{"X-Device": FieldNode}),
+		})
+
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		req.RemoteAddr = "100.100.100.1:12345"
+		p.injectIdentity(req)
+
+		want := map[string]string{
+			"Remote-User":   "",
+			"Remote-Name":   "",
+			"Remote-Email":  "",
+			"Remote-Groups": "tag:admin,tag:dev",
+			"X-Device":      "ci-runner",
+		}
+		for h, v := range want {
+			if got := req.Header.Get(h); got != v {
+				t.Errorf("%s = %q, want %q", h, got, v)
+			}
+		}
+	})
+
+	t.Run("tagged node with legacy headers", func(t *testing.T) {
+		p := NewWithOptions(targetURL, tagged, slog.Default(), Options{
+			IdentityHeaders: IdentityHeaders("authelia", nil),
+			LegacyHeaders:   true,
+		})
+
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		req.RemoteAddr = "100.100.100.1:12345"
+		p.injectIdentity(req)
+
+		if got := req.Header.Get("Remote-User"); got != "tagged-devices" {
+			t.Errorf("Remote-User = %q, want %q", got, "tagged-devices")
+		}
+	})
+
+	t.Run("login that isn't an email address", func(t *testing.T) {
+		github := &mockLocalClient{
+			whoisResponse: &apitype.WhoIsResponse{
+				UserProfile: &tailcfg.UserProfile{LoginName: "alice@github", DisplayName: "Alice"},
+				Node:        &tailcfg.Node{ComputedName: "alice-laptop"},
+			},
+		}
+		p := NewWithOptions(targetURL, github, slog.Default(), Options{
+			IdentityHeaders: IdentityHeaders("grafana", nil),
+		})
+
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		req.RemoteAddr = "100.100.100.1:12345"
+		req.Header.Set("X-WEBAUTH-EMAIL", "admin@example.com")
+		p.injectIdentity(req)
+
+		if got := req.Header.Get("X-WEBAUTH-USER"); got != "alice@github" {
+			t.Errorf("X-WEBAUTH-USER = %q, want %q", got, "alice@github")
+		}
+		if got := req.Header.Get("X-WEBAUTH-EMAIL"); got != "" {
+			t.Errorf("X-WEBAUTH-EMAIL = %q, want none", got)
+		}
+	})
+
+	t.Run("strips forged headers without identity", func(t *testing.T) {
+		p := NewWithOptions(targetURL, &mockLocalClient{whoisErr: errors.New("no peer")}, slog.Default(), Options{
+			IdentityHeaders: IdentityHeaders("grafana", nil),
+		})
+
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		req.Header.Set("X-WEBAUTH-USER", "admin")
+		p.injectIdentity(req)
+
+		if got := req.Header.Get("X-WEBAUTH-USER"); got != "" {
+			t.Errorf("X-WEBAUTH-USER = %q, want it stripped", got)
+		}
+	})
+}
+
+func TestInjectIdentity_Headers(t *testing.T) {
+	targetURL, _ := url.Parse("http://localhost:8080")
+
+	tests := []struct {
+		name   string
+		whois  *apitype.WhoIsResponse
+		legacy bool
+		want   map[string]string
+	}{
+		{
+			name: "personal device",
+			whois: &apitype.WhoIsResponse{
+				UserProfile: &tailcfg.UserProfile{
+					LoginName:     "alice@example.com",
+					DisplayName:   "Alice Smith",
+					ProfilePicURL: "https://example.com/alice.png",
+				},
+				Node: &tailcfg.Node{
+					Name:         "alice-laptop.example.ts.net.",
+					ComputedName: "alice-laptop",
+					Hostinfo:     (&tailcfg.Hostinfo{Hostname: "Alices-MacBook", OS: "macOS"}).View(),
+				},
+			},
+			want: map[string]string{
+				HeaderUser:           "alice@example.com",
+				HeaderLogin:          "alice@example.com",
+				HeaderName:           "Alice Smith",
+				HeaderProfilePicture: "https://example.com/alice.png",
+				HeaderNode:           "alice-laptop",
+				HeaderNodeIP:         "100.100.100.1",
+				HeaderTags:           "",
+				HeaderOS:             "macOS",
+				HeaderTailnet:        "example.ts.net",
+			},
+		},
+		{
+			name: "tagged node",
+			whois: &apitype.WhoIsResponse{
+				UserProfile: &tailcfg.UserProfile{LoginName: "tagged-devices", DisplayName: "Tagged Devices"},
+				Node: &tailcfg.Node{
+					Name:         "ci-runner.example.ts.net.",
+					ComputedName: "ci-runner",
+					Tags:         []string{"tag:ci", "tag:server"},
+					Hostinfo:     (&tailcfg.Hostinfo{OS: "linux"}).View(),
+				},
+			},
+			want: map[string]string{
+				HeaderUser:    "",
+				HeaderLogin:   "",
+				HeaderName:    "",
+				HeaderNode:    "ci-runner",
+				HeaderTags:    "tag:ci,tag:server",
+				HeaderOS:      "linux",
+				HeaderTailnet: "example.ts.net",
+			},
+		},
+		{
+			name: "node shared from another tailnet",
+			whois: &apitype.WhoIsResponse{
+				UserProfile: &tailcfg.UserProfile{LoginName: "bob@other.com", DisplayName: "Bob"},
+				Node: &tailcfg.Node{
+					Name:         "bob-pc.other-tailnet.ts.net.",
+					ComputedName: "bob-pc",
+				},
+			},
+			want: map[string]string{
+				HeaderUser:    "bob@other.com",
+				HeaderNode:    "bob-pc",
+				HeaderTailnet: "other-tailnet.ts.net",
+			},
+		},
+		{
+			name: "legacy",
+			whois: &apitype.WhoIsResponse{
+				UserProfile: &tailcfg.UserProfile{LoginName: "tagged-devices"},
+				Node: &tailcfg.Node{
+					Name:         "ci-runner.example.ts.net.",
+					ComputedName: "ci-runner",
+					Tags:         []string{"tag:ci"},
+					Hostinfo:     (&tailcfg.Hostinfo{Hostname: "runner-01"}).View(),
+				},
+			},
+			legacy: true,
+			want: map[string]string{
+				HeaderUser:    "tagged-devices",
+				HeaderLogin:   "ci-runner",
+				HeaderTailnet: "runner-01",
+				HeaderTags:    "tag:ci",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewWithOptions(targetURL, &mockLocalClient{whoisResponse: tt.whois}, slog.Default(), Options{
+				LegacyHeaders: tt.legacy,
+			})
+
+			req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+			req.RemoteAddr = "100.100.100.1:12345"
+			req.Header.Set(HeaderTags, "tag:forged")
+			p.injectIdentity(req)
+
+			for h, want := range tt.want {
+				if got := req.Header.Get(h); got != want {
+					t.Errorf("%s = %q, want %q", h, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestServeHTTP_HeaderRules(t *testing.T) {
+	var gotRequest http.Header
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotRequest = r.Header.Clone()
+		w.Header().Set("Server", "nginx/1.25")
+		w.Header().Set("X-Frame-Options", "ALLOW-FROM https://example.com")
+		w.Header().Set("Vary", "Accept")
+	}))
+	defer backend.Close()
+
+	backendURL, _ := url.Parse(backend.URL)
+	mock := &mockLocalClient{
+		whoisResponse: &apitype.WhoIsResponse{
+			UserProfile: &tailcfg.UserProfile{LoginName: "alice@example.com"},
+		},
+	}
+	p := NewWithOptions(backendURL, mock, slog.Default(), Options{
+		RequestHeaders: &HeaderRules{
+			Set:    map[string]string{"X-Foo": "bar", HeaderUser: "admin"},
+			Remove: []string{"Cookie"},
+		},
+		ResponseHeaders: &HeaderRules{
+			Add:    map[string]string{"Vary": "Origin"},
+			Remove: []string{"Server"},
+		},
+		SecurityHeaders: SecurityBasic,
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "https://app.example.ts.net/", nil)
+	req.RemoteAddr = "100.100.100.1:12345"
+	req.Header.Set("Cookie", "session=1")
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, req)
+
+	if got := gotRequest.Get("X-Foo"); got != "bar" {
+		t.Errorf("request X-Foo = %q, want %q", got, "bar")
+	}
+	if got := gotRequest.Get("Cookie"); got != "" {
+		t.Errorf("request Cookie = %q, want it removed", got)
+	}
+	if got := gotRequest.Get(HeaderUser); got != "alice@example.com" {
+		t.Errorf("request %s = %q, want identity to win over header rules", HeaderUser, got)
+	}
+
+	if got := w.Header().Get("Server"); got != "" {
+		t.Errorf("response Server = %q, want it removed", got)
+	}
+	if got := w.Header().Values("Vary"); len(got) != 2 {
+		t.Errorf("response Vary = %v, want [Accept Origin]", got)
+	}
+	if got := w.Header().Get("X-Frame-Options"); got != "ALLOW-FROM https://example.com" {
+		t.Errorf("X-Frame-Options = %q, want the container's value kept", got)
+	}
+	if got := w.Header().Get("X-Content-Type-Options"); got != "nosniff" {
+		t.Errorf("X-Content-Type-Options = %q, want %q", got, "nosniff")
+	}
+}
+
+func TestNegotiateEncoding(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   string
+	}{
+		{"", ""},
+		{"gzip", "gzip"},
+		{"gzip, deflate, br", "br"},
+		{"gzip, deflate, br, zstd", "zstd"},
+		{"br;q=0.5, gzip", "gzip"},
+		{"zstd;q=0, gzip;q=0.1", "gzip"},
+		{"*", "zstd"},
+		{"*;q=0, gzip", "gzip"},
+		{"identity", ""},
+	}
+
+	for _, tt := range tests {
+		if got := negotiateEncoding(tt.accept, DefaultEncodings); got != tt.want {
+			t.Errorf("negotiateEncoding(%q) = %q, want %q", tt.accept, got, tt.want)
+		}
+	}
+}
+
+func TestCompressible(t *testing.T) {
+	tests := map[string]bool{
+		"text/html; charset=utf-8":  true,
+		"application/json":          true,
+		"application/javascript":    true,
+		"application/activity+json": true,
+		"image/svg+xml":             true,
+		"text/event-stream":         false,
+		"image/png":                 false,
+		"application/zip":           false,
+		"application/grpc":          false,
+		"":                          false,
+	}
+
+	for contentType, want := range tests {
+		if got := compressible(contentType); got != want {
+			t.Errorf("compressible(%q) = %v, want %v", contentType, got, want)
+		}
+	}
+}
+
+func TestServeHTTP_Compression(t *testing.T) {
+	body := strings.Repeat(`{"name":"dovetail","status":"ok"}`, 200)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/image":
+			w.Header().Set("Content-Type", "image/png")
+		case "/small":
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{}`))
+			return
+		default:
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("ETag", `"v1"`)
+		}
+		w.Write([]byte(body))
+	}))
+	defer backend.Close()
+
+	backendURL, _ := url.Parse(backend.URL)
+	p := NewWithOptions(backendURL, nil, slog.Default(), Options{Compression: DefaultEncodings})
+
+	send := func(path, acceptEncoding string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "https://app.example.ts.net"+path, nil)
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, req)
+		return w
+	}
+
+	decoders := map[string]func(io.Reader) (io.Reader, error){
+		"gzip": func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) },
+		"br":   func(r io.Reader) (io.Reader, error) { return brotli.NewReader(r), nil },
+		"zstd": func(r io.Reader) (io.Reader, error) { return zstd.NewReader(r) },
+	}
+	for encoding, decode := range decoders {
+		t.Run(encoding, func(t *testing.T) {
+			w := send("/", encoding)
+
+			if got := w.Header().Get("Content-Encoding"); got != encoding {
+				t.Fatalf("Content-Encoding = %q, want %q", got, encoding)
+			}
+			if got := w.Header().Get("Vary"); got != "Accept-Encoding" {
+				t.Errorf("Vary = %q, want %q", got, "Accept-Encoding")
+			}
+			if got := w.Header().Get("ETag"); got != `W/"v1"` {
+				t.Errorf("ETag = %q, want weak validator", got)
+			}
+			if w.Body.Len() >= len(body) {
+				t.Errorf("compressed size %d not smaller than %d", w.Body.Len(), len(body))
+			}
+
+			r, err := decode(w.Body)
+			if err != nil {
+				t.Fatalf("failed to create decoder: %v", err)
+			}
+			decoded, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatalf("failed to decode body: %v", err)
+			}
+			if string(decoded) != body {
+				t.Error("decoded body does not match")
+			}
+		})
+	}
+
+	for _, tt := range []struct{ name, path, accept string }{
+		{"not accepted", "/", ""},
+		{"already compressed media", "/image", "gzip"},
+		{"below minimum size", "/small", "gzip"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := send(tt.path, tt.accept).Header().Get("Content-Encoding"); got != "" {
+				t.Errorf("Content-Encoding = %q, want none", got)
+			}
+		})
+	}
+}
+
+func TestStorable(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name        string
+		method      string
+		status      int
+		header      http.Header
+		wantOK      bool
+		wantShared  bool
+		wantExpires time.Duration
+	}{
+		{"max-age", http.MethodGet, 200, http.Header{"Cache-Control": {"max-age=60"}}, true, false, time.Minute},
+		{"public", http.MethodGet, 200, http.Header{"Cache-Control": {"public, max-age=60"}}, true, true, time.Minute},
+		{"s-maxage wins", http.MethodGet, 200, http.Header{"Cache-Control": {"max-age=60, s-maxage=120"}}, true, true, 2 * time.Minute},
+		{"age reduces lifetime", http.MethodGet, 200, http.Header{"Cache-Control": {"max-age=60"}, "Age": {"30"}}, true, false, 30 * time.Second},
+		{"expires", http.MethodGet, 200, http.Header{
+			"Date":    {"Thu, 01 Jan 2026 00:00:00 GMT"},
+			"Expires": {"Thu, 01 Jan 2026 00:05:00 GMT"},
+		}, true, false, 5 * time.Minute},
+		{"validator only", http.MethodGet, 200, http.Header{"Etag": {`"v1"`}}, true, false, 0},
+		{"no freshness", http.MethodGet, 200, http.Header{}, false, false, 0},
+		{"no-store", http.MethodGet, 200, http.Header{"Cache-Control": {"no-store, max-age=60"}}, false, false, 0},
+		{"private", http.MethodGet, 200, http.Header{"Cache-Control": {"private, max-age=60"}}, false, false, 0},
+		{"set-cookie", http.MethodGet, 200, http.Header{"Cache-Control": {"max-age=60"}, "Set-Cookie": {"a=b"}}, false, false, 0},
+		{"vary star", http.MethodGet, 200, http.Header{"Cache-Control": {"max-age=60"}, "Vary": {"*"}}, false, false, 0},
+		{"uncacheable status", http.MethodGet, 500, http.Header{"Cache-Control": {"max-age=60"}}, false, false, 0},
+		{"head", http.MethodHead, 200, http.Header{"Cache-Control": {"max-age=60"}}, false, false, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "https://app.example.ts.net/", nil)
+			expires, shared, ok := storable(req, tt.status, tt.header, now)
+			if ok != tt.wantOK {
+				t.Fatalf("ok = %v, want %v", ok, tt.wantOK)
+			}
+			if !ok {
+				return
+			}
+			if shared != tt.wantShared {
+				t.Errorf("shared = %v, want %v", shared, tt.wantShared)
+			}
+			if got := expires.Sub(now); got != tt.wantExpires {
+				t.Errorf("lifetime = %v, want %v", got, tt.wantExpires)
+			}
+		})
+	}
+
+	credentials := []struct {
+		name       string
+		header     string
+		control    string
+		wantOK     bool
+		wantShared bool
+	}{
+		{"authorization", "Authorization", "max-age=60", false, false},
+		{"authorization public", "Authorization", "public, max-age=60", true, true},
+		{"authorization s-maxage", "Authorization", "s-maxage=60", true, true},
+		{"authorization must-revalidate", "Authorization", "max-age=60, must-revalidate", true, false},
+		{"cookie", "Cookie", "max-age=60", false, false},
+		{"cookie s-maxage", "Cookie", "s-maxage=60", false, false},
+		{"cookie public", "Cookie", "public, max-age=60", true, true},
+	}
+
+	for _, tt := range credentials {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "https://app.example.ts.net/", nil)
+			req.Header.Set(tt.header, "secret")
+			_, shared, ok := storable(req, http.StatusOK, http.Header{"Cache-Control": {tt.control}}, now)
+			if ok != tt.wantOK || shared != tt.wantShared {
+				t.Errorf("ok, shared = %v, %v, want %v, %v", ok, shared, tt.wantOK, tt.wantShared)
+			}
+		})
+	}
+}
+
+func TestServeHTTP_Cache(t *testing.T) {
+	hits := make(map[string]int)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits[r.URL.Path]++
+		switch r.URL.Path {
+		case "/app.js":
+			w.Header().Set("Cache-Control", "public, max-age=60")
+			w.Write([]byte("console.log(1)"))
+		case "/profile":
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Write([]byte(r.Header.Get(HeaderUser)))
+		case "/account":
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Write([]byte(r.Header.Get("Authorization")))
+		case "/etag":
+			w.Header().Set("Cache-Control", "no-cache")
+			w.Header().Set("ETag", `"v1"`)
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.Write([]byte("validated"))
+		default:
+			w.Header().Set("Cache-Control", "no-store")
+			w.Write([]byte("dynamic"))
+		}
+	}))
+	defer backend.Close()
+
+	backendURL, _ := url.Parse(backend.URL)
+	users := map[string]*apitype.WhoIsResponse{
+		"100.100.100.1": {UserProfile: &tailcfg.UserProfile{LoginName: "alice@example.com"}},
+		"100.100.100.2": {UserProfile: &tailcfg.UserProfile{LoginName: "bob@example.com"}},
+	}
+	p := NewWithOptions(backendURL, nil, slog.Default(), Options{
+		Name:  "cache-test",
+		Cache: &CacheOptions{},
+	})
+
+	send := func(method, path, caller string, header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "https://app.example.ts.net"+path, nil)
+		req.RemoteAddr = caller + ":12345"
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		if whois, ok := users[caller]; ok {
+			req = req.WithContext(context.WithValue(req.Context(), whoisKey{}, whois))
+		}
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("public response shared", func(t *testing.T) {
+		if got := send(http.MethodGet, "/app.js", "100.100.100.1", nil).Header().Get(HeaderCacheStatus); got != CacheMiss {
+			t.Errorf("first request status = %q, want %q", got, CacheMiss)
+		}
+		w := send(http.MethodGet, "/app.js", "100.100.100.2", nil)
+		if got := w.Header().Get(HeaderCacheStatus); got != CacheHit {
+			t.Errorf("second request status = %q, want %q", got, CacheHit)
+		}
+		if w.Body.String() != "console.log(1)" {
+			t.Errorf("cached body = %q", w.Body.String())
+		}
+		if hits["/app.js"] != 1 {
+			t.Errorf("backend hits = %d, want 1", hits["/app.js"])
+		}
+
+		w = send(http.MethodHead, "/app.js", "100.100.100.1", nil)
+		if got := w.Header().Get(HeaderCacheStatus); got != CacheHit || w.Body.Len() != 0 {
+			t.Errorf("HEAD status = %q with %d body bytes, want cached headers only", got, w.Body.Len())
+		}
+	})
+
+	t.Run("private per caller", func(t *testing.T) {
+		send(http.MethodGet, "/profile", "100.100.100.1", nil)
+		if got := send(http.MethodGet, "/profile", "100.100.100.2", nil).Body.String(); got != "bob@example.com" {
+			t.Errorf("bob got %q, another caller's response leaked", got)
+		}
+		w := send(http.MethodGet, "/profile", "100.100.100.1", nil)
+		if got := w.Header().Get(HeaderCacheStatus); got != CacheHit || w.Body.String() != "alice@example.com" {
+			t.Errorf("alice got %q (%s), want her cached response", w.Body.String(), got)
+		}
+		if hits["/profile"] != 2 {
+			t.Errorf("backend hits = %d, want 2", hits["/profile"])
+		}
+	})
+
+	t.Run("revalidation", func(t *testing.T) {
+		send(http.MethodGet, "/etag", "100.100.100.1", nil)
+		w := send(http.MethodGet, "/etag", "100.100.100.1", nil)
+		if got := w.Header().Get(HeaderCacheStatus); got != CacheRevalidated {
+			t.Errorf("status = %q, want %q", got, CacheRevalidated)
+		}
+		if w.Code != http.StatusOK || w.Body.String() != "validated" {
+			t.Errorf("got %d %q, want the stored response", w.Code, w.Body.String())
+		}
+
+		w = send(http.MethodGet, "/etag", "100.100.100.1", http.Header{"If-None-Match": {`"v1"`}})
+		if w.Code != http.StatusNotModified {
+			t.Errorf("conditional request StatusCode = %d, want %d", w.Code, http.StatusNotModified)
+		}
+	})
+
+	t.Run("expiry", func(t *testing.T) {
+		p.cache.now = func() time.Time { return time.Now().Add(2 * time.Minute) }
+		defer func() { p.cache.now = time.Now }()
+
+		if got := send(http.MethodGet, "/app.js", "100.100.100.1", nil).Header().Get(HeaderCacheStatus); got != CacheExpired {
+			t.Errorf("status = %q, want %q", got, CacheExpired)
+		}
+	})
+
+	t.Run("HEAD after expiry keeps the entry", func(t *testing.T) {
+		p.cache.now = func() time.Time { return time.Now().Add(5 * time.Minute) }
+		defer func() { p.cache.now = time.Now }()
+
+		if got := send(http.MethodHead, "/app.js", "100.100.100.1", nil).Header().Get(HeaderCacheStatus); got != CacheExpired {
+			t.Errorf("HEAD status = %q, want %q", got, CacheExpired)
+		}
+		if got := send(http.MethodGet, "/app.js", "100.100.100.1", nil).Header().Get(HeaderCacheStatus); got != CacheExpired {
+			t.Errorf("GET status = %q, want %q from the entry HEAD left in place", got, CacheExpired)
+		}
+	})
+
+	t.Run("anonymous callers only share public responses", func(t *testing.T) {
+		// Funnel visitors have no tailnet identity
+		send(http.MethodGet, "/profile", "203.0.113.7", nil)
+		w := send(http.MethodGet, "/profile", "203.0.113.8", nil)
+		if got := w.Header().Get(HeaderCacheStatus); got != CacheMiss {
+			t.Errorf("status = %q, want %q", got, CacheMiss)
+		}
+		if hits["/profile"] != 4 {
+			t.Errorf("backend hits = %d, want 4", hits["/profile"])
+		}
+
+		if got := send(http.MethodGet, "/app.js", "203.0.113.7", nil).Header().Get(HeaderCacheStatus); got != CacheHit {
+			t.Errorf("public response status = %q, want %q", got, CacheHit)
+		}
+	})
+
+	t.Run("authorization not stored", func(t *testing.T) {
+		auth := http.Header{"Authorization": {"Bearer secret"}}
+		send(http.MethodGet, "/account", "100.100.100.1", auth)
+		send(http.MethodGet, "/account", "100.100.100.1", auth)
+		if hits["/account"] != 2 {
+			t.Errorf("backend hits = %d, want 2", hits["/account"])
+		}
+	})
+
+	t.Run("not stored", func(t *testing.T) {
+		send(http.MethodGet, "/dynamic", "100.100.100.1", nil)
+		send(http.MethodGet, "/dynamic", "100.100.100.1", nil)
+		if hits["/dynamic"] != 2 {
+			t.Errorf("backend hits = %d, want 2", hits["/dynamic"])
+		}
+		if got := send(http.MethodPost, "/app.js", "100.100.100.1", nil).Header().Get(HeaderCacheStatus); got != CacheBypass {
+			t.Errorf("POST status = %q, want %q", got, CacheBypass)
+		}
+	})
+}
+
+func TestServeHTTP_CacheDisk(t *testing.T) {
+	hits := 0
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		w.Header().Set("Cache-Control", "public, max-age=3600")
+		w.Write([]byte("thumbnail"))
+	}))
+	defer backend.Close()
+
+	backendURL, _ := url.Parse(backend.URL)
+	opts := Options{Cache: &CacheOptions{DiskDir: t.TempDir(), DiskSize: 1 << 20}}
+
+	send := func(p *Proxy) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "https://app.example.ts.net/thumb.jpg", nil))
+		return w
+	}
+
+	send(NewWithOptions(backendURL, nil, slog.Default(), opts))
+
+	// A new proxy, as after a restart, finds the response on disk
+	w := send(NewWithOptions(backendURL, nil, slog.Default(), opts))
+	if got := w.Header().Get(HeaderCacheStatus); got != CacheHit || w.Body.String() != "thumbnail" {
+		t.Errorf("got %q (%s), want a hit from disk", w.Body.String(), got)
+	}
+	if hits != 1 {
+		t.Errorf("backend hits = %d, want 1", hits)
+	}
+}
+
+func TestDiskStore_ConcurrentPut(t *testing.T) {
+	dir := t.TempDir()
+	s, err := newDiskStore(dir, 1<<24)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Writers for the same key must never publish a mix of bodies
+	var wg sync.WaitGroup
+	for i := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			body := bytes.Repeat([]byte{byte('a' + i)}, 256<<10)
+			for range 5 {
+				s.put("key", &cachedResponse{Status: http.StatusOK, Body: body})
+			}
+		}()
+	}
+	wg.Wait()
+
+	got := s.get("key")
+	if got == nil {
+		t.Fatal("expected stored response")
+	}
+	if len(got.Body) != 256<<10 || bytes.Count(got.Body, got.Body[:1]) != len(got.Body) {
+		t.Errorf("stored body is truncated or mixed (%d bytes)", len(got.Body))
+	}
+
+	entries, _ := os.ReadDir(dir)
+	for _, entry := range entries {
+		if filepath.Ext(entry.Name()) == ".tmp" {
+			t.Errorf("temporary file %s left behind", entry.Name())
+		}
+	}
+}
+
+func TestCachePartition(t *testing.T) {
+	p := NewWithOptions(&url.URL{Scheme: "http", Host: "localhost"}, nil, slog.Default(), Options{})
+
+	partition := func(whois *apitype.WhoIsResponse) string {
+		req := httptest.NewRequest(http.MethodGet, "https://app.example.ts.net/", nil)
+		if whois != nil {
+			req = req.WithContext(context.WithValue(req.Context(), whoisKey{}, whois))
+		}
+		return p.cachePartition(req)
+	}
+
+	user := partition(&apitype.WhoIsResponse{
+		UserProfile: &tailcfg.UserProfile{LoginName: "builder"},
+		Node:        &tailcfg.Node{ComputedName: "laptop"},
+	})
+	node := partition(&apitype.WhoIsResponse{
+		UserProfile: &tailcfg.UserProfile{LoginName: "tagged-devices"},
+		Node:        &tailcfg.Node{ComputedName: "builder", Tags: []string{"tag:ci"}},
+	})
+
+	if user != "user:builder" {
+		t.Errorf("user partition = %q, want %q", user, "user:builder")
+	}
+	if node != "node:builder" {
+		t.Errorf("tagged node partition = %q, want %q", node, "node:builder")
+	}
+	if got := partition(nil); got != "" {
+		t.Errorf("anonymous partition = %q, want none", got)
+	}
+}
+
+func TestMemoryStore_Eviction(t *testing.T) {
+	s := newMemoryStore(100)
+	entry := func() *cachedResponse { return &cachedResponse{Body: make([]byte, 40)} }
+
+	s.put("a", entry())
+	s.put("b", entry())
+	s.get("a")
+	s.put("c", entry())
+
+	if s.get("b") != nil {
+		t.Error("least recently used entry was not evicted")
+	}
+	if s.get("a") == nil || s.get("c") == nil {
+		t.Error("recent entries were evicted")
+	}
+
+	s.put("huge", &cachedResponse{Body: make([]byte, 200)})
+	if s.get("huge") != nil {
+		t.Error("entry larger than the store was kept")
+	}
+}
+
+// flakyBackend drops the connection for the first failures requests, as a
+// restarting container would
+func flakyBackend(t *testing.T, failures int32) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var calls atomic.Int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) <= failures {
+			conn, _, err := http.NewResponseController(w).Hijack()
+			if err != nil {
+				t.Errorf("hijack failed: %v", err)
+				return
+			}
+			conn.Close()
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		w.Write(body)
+	}))
+	t.Cleanup(backend.Close)
+	return backend, &calls
+}
+
+func TestRetryBackoff(t *testing.T) {
+	tr := newRetryTransport(http.DefaultTransport, "test", Retry{Attempts: 10, Backoff: time.Second})
+
+	tests := []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{0, time.Second},
+		{1, 2 * time.Second},
+		{3, 8 * time.Second},
+		{4, MaxRetryBackoff},
+		{70, MaxRetryBackoff},
+	}
+	for _, tt := range tests {
+		if got := tr.backoff(tt.attempt); got != tt.want {
+			t.Errorf("backoff(%d) = %v, want %v", tt.attempt, got, tt.want)
+		}
+	}
+
+	tr = newRetryTransport(http.DefaultTransport, "test", Retry{Backoff: time.Minute})
+	if got := tr.backoff(0); got != MaxRetryBackoff {
+		t.Errorf("backoff(0) = %v, want %v for a backoff above the cap", got, MaxRetryBackoff)
+	}
+}
+
+func TestServeHTTP_Retry(t *testing.T) {
+	tests := []struct {
+		name       string
+		method     string
+		body       string
+		header     http.Header
+		maxBody    int64
+		wantStatus int
+		wantCalls  int32
+	}{
+		{"get", http.MethodGet, "", nil, 0, http.StatusOK, 3},
+		{"put resends body", http.MethodPut, "payload", nil, 0, http.StatusOK, 3},
+		{"post not retried", http.MethodPost, "payload", nil, 0, http.StatusBadGateway, 1},
+		{"post with idempotency key", http.MethodPost, "payload", http.Header{"Idempotency-Key": {"abc"}}, 0, http.StatusOK, 3},
+		{"body over limit", http.MethodPut, "payload", nil, 4, http.StatusBadGateway, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend, calls := flakyBackend(t, 2)
+			backendURL, _ := url.Parse(backend.URL)
+			p := NewWithOptions(backendURL, nil, slog.Default(), Options{
+				Name:  "retry-test",
+				Retry: &Retry{Attempts: 2, Backoff: time.Millisecond, MaxBody: tt.maxBody},
+			})
+
+			req := httptest.NewRequest(tt.method, "https://app.example.ts.net/", strings.NewReader(tt.body))
+			for k, v := range tt.header {
+				req.Header[k] = v
+			}
+			w := httptest.NewRecorder()
+			p.ServeHTTP(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("StatusCode = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if got := calls.Load(); got != tt.wantCalls {
+				t.Errorf("backend calls = %d, want %d", got, tt.wantCalls)
+			}
+			if tt.wantStatus == http.StatusOK && w.Body.String() != tt.body {
+				t.Errorf("body = %q, want %q", w.Body.String(), tt.body)
+			}
+		})
+	}
+}
+
+func TestServeHTTP_CircuitBreaker(t *testing.T) {
+	backend, calls := flakyBackend(t, 3)
+	backendURL, _ := url.Parse(backend.URL)
+	p := NewWithOptions(backendURL, nil, slog.Default(), Options{
+		Name:           "breaker-test",
+		CircuitBreaker: &CircuitBreaker{Failures: 2, Cooldown: time.Minute},
+	})
+	b := p.handler.(*httputil.ReverseProxy).Transport.(*breakerTransport).breaker
+	now := time.Now()
+	b.now = func() time.Time { return now }
+
+	send := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "https://app.example.ts.net/", nil))
+		return w
+	}
+
+	send()
+	send()
+	if got := circuitOpenGauge.Value("breaker-test"); got != 1 {
+		t.Fatalf("circuit gauge = %v, want 1", got)
+	}
+
+	w := send()
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("open circuit StatusCode = %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+	if got := w.Header().Get("Retry-After"); got != "60" {
+		t.Errorf("Retry-After = %q, want %q", got, "60")
+	}
+	if got := calls.Load(); got != 2 {
+		t.Errorf("backend calls = %d, want 2", got)
+	}
+
+	// The probe after the cooldown fails, reopening the circuit
+	now = now.Add(time.Minute)
+	if w := send(); w.Code != http.StatusBadGateway {
+		t.Errorf("failed probe StatusCode = %d, want %d", w.Code, http.StatusBadGateway)
+	}
+	if w := send(); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("reopened StatusCode = %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+
+	now = now.Add(time.Minute)
+	if w := send(); w.Code != http.StatusOK {
+		t.Errorf("successful probe StatusCode = %d, want %d", w.Code, http.StatusOK)
+	}
+	if got := circuitOpenGauge.Value("breaker-test"); got != 0 {
+		t.Errorf("circuit gauge = %v, want 0", got)
+	}
+}
+
+func TestServeHTTP_MaxBodySize(t *testing.T) {
+	var calls atomic.Int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		io.Copy(io.Discard, r.Body)
+	}))
+	defer backend.Close()
+
+	backendURL, _ := url.Parse(backend.URL)
+	p := NewWithOptions(backendURL, nil, slog.Default(), Options{MaxBodySize: 8})
+
+	tests := []struct {
+		name          string
+		body          string
+		chunked       bool
+		wantStatus    int
+		wantForwarded bool
+	}{
+		{"within limit", "12345678", false, http.StatusOK, true},
+		{"declared too large", "123456789", false, http.StatusRequestEntityTooLarge, false},
+		{"streamed too large", strings.Repeat("x", 1024), true, http.StatusRequestEntityTooLarge, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := calls.Load()
+			req := httptest.NewRequest(http.MethodPost, "https://app.example.ts.net/upload", strings.NewReader(tt.body))
+			if tt.chunked {
+				req.ContentLength = -1
+			}
+			w := httptest.NewRecorder()
+			p.ServeHTTP(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("StatusCode = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if !tt.wantForwarded && calls.Load() != before {
+				t.Error("oversized request reached the container")
+			}
+		})
+	}
+
+	t.Run("connection closed after the limit", func(t *testing.T) {
+		srv := httptest.NewServer(p)
+		defer srv.Close()
+
+		req, _ := http.NewRequest(http.MethodPost, srv.URL+"/upload", io.NopCloser(strings.NewReader(strings.Repeat("x", 1024))))
+		resp, err := srv.Client().Do(req)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusRequestEntityTooLarge {
+			t.Errorf("StatusCode = %d, want %d", resp.StatusCode, http.StatusRequestEntityTooLarge)
+		}
+		if !resp.Close {
+			t.Error("expected the server to close the connection")
+		}
+	})
+}
+
+func TestServeHTTP_Maintenance(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("app"))
+	}))
+	defer backend.Close()
+
+	backendURL, _ := url.Parse(backend.URL)
+	p := NewWithOptions(backendURL, nil, slog.Default(), Options{
+		Name:        "maintenance-test",
+		Maintenance: &Maintenance{Message: "Upgrading the database.", Allow: []string{"alice@example.com", "tag:ops", "build-runner"}},
+	})
+
+	callers := map[string]*apitype.WhoIsResponse{
+		"alice": {UserProfile: &tailcfg.UserProfile{LoginName: "alice@example.com"}, Node: &tailcfg.Node{ComputedName: "laptop"}},
+		"bob":   {UserProfile: &tailcfg.UserProfile{LoginName: "bob@example.com"}, Node: &tailcfg.Node{ComputedName: "desktop"}},
+		"ops":   {UserProfile: &tailcfg.UserProfile{LoginName: "tagged-devices"}, Node: &tailcfg.Node{ComputedName: "monitor", Tags: []string{"tag:ops"}}},
+		"ci":    {UserProfile: &tailcfg.UserProfile{LoginName: "tagged-devices"}, Node: &tailcfg.Node{ComputedName: "build-runner", Tags: []string{"tag:ci"}}},
+	}
+	send := func(caller string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "https://wiki.example.ts.net/", nil)
+		if whois, ok := callers[caller]; ok {
+			req = req.WithContext(context.WithValue(req.Context(), whoisKey{}, whois))
+		}
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, req)
+		return w
+	}
+
+	for caller, want := range map[string]int{
+		"alice":     http.StatusOK,
+		"ops":       http.StatusOK,
+		"ci":        http.StatusOK,
+		"bob":       http.StatusServiceUnavailable,
+		"anonymous": http.StatusServiceUnavailable,
+	} {
+		if got := send(caller).Code; got != want {
+			t.Errorf("%s StatusCode = %d, want %d", caller, got, want)
+		}
+	}
+
+	w := send("bob")
+	if !strings.Contains(w.Body.String(), MaintenanceTitle) || !strings.Contains(w.Body.String(), "Upgrading the database.") {
+		t.Errorf("maintenance page missing title or message: %s", w.Body.String())
+	}
+	if got := maintenanceGauge.Value("maintenance-test"); got != 1 {
+		t.Errorf("maintenance gauge = %v, want 1", got)
+	}
+
+	p.SetMaintenance(nil)
+	if got := send("bob").Code; got != http.StatusOK {
+		t.Errorf("after maintenance StatusCode = %d, want %d", got, http.StatusOK)
+	}
+}
@@ -0,0 +1,157 @@
+package proxy
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jasonwu/dovetail/internal/errorpage"
+	"golang.org/x/time/rate"
+	"tailscale.com/client/tailscale/apitype"
+)
+
+// Rate limit keys
+const (
+	RateLimitByUser = "user"
+	RateLimitByNode = "node"
+)
+
+// limiterIdleTimeout is how long an identity's bucket is kept after its
+// last request, at least. Buckets that take longer to refill are kept
+// until they're full again.
+const limiterIdleTimeout = 10 * time.Minute
+
+// RateLimit allows Requests per Per for each caller, with bursts of up to
+// Burst requests. By selects whether callers are tailnet users or nodes.
+type RateLimit struct {
+	Requests int
+	Per      time.Duration
+	Burst    int
+	By       string
+}
+
+type limiter struct {
+	limit       rate.Limit
+	burst       int
+	by          string
+	idleTimeout time.Duration
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+type bucket struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+func newLimiter(rl RateLimit) *limiter {
+	burst := rl.Burst
+	if burst <= 0 {
+		burst = rl.Requests
+	}
+
+	limit := rate.Limit(float64(rl.Requests) / rl.Per.Seconds())
+
+	// Dropping a bucket before it has refilled would hand the caller a
+	// full one early
+	refill := time.Duration(float64(burst) / float64(limit) * float64(time.Second))
+
+	return &limiter{
+		limit:       limit,
+		burst:       burst,
+		by:          rl.By,
+		idleTimeout: max(limiterIdleTimeout, refill),
+		buckets:     make(map[string]*bucket),
+		now:         time.Now,
+	}
+}
+
+// allow reports whether the caller identified by key may proceed, and if
+// not, how long until it may
+func (l *limiter) allow(key string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.sweep(now)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{limiter: rate.NewLimiter(l.limit, l.burst)}
+		l.buckets[key] = b
+	}
+	b.lastSeen = now
+
+	res := b.limiter.ReserveN(now, 1)
+	if delay := res.DelayFrom(now); delay > 0 {
+		res.CancelAt(now)
+		return false, delay
+	}
+	return true, 0
+}
+
+// sweep drops buckets for callers that have gone quiet so the map doesn't
+// grow without bound
+func (l *limiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+
+	for key, b := range l.buckets {
+		if now.Sub(b.lastSeen) > l.idleTimeout {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// key identifies the caller for rate limiting. Tagged devices share a
+// placeholder user, so they're always keyed by node. Callers without a
+// tailnet identity (e.g. Funnel traffic) are keyed by remote IP.
+func (l *limiter) key(whois *apitype.WhoIsResponse, r *http.Request) string {
+	if whois != nil {
+		if whois.Node != nil && (l.by == RateLimitByNode || whois.Node.IsTagged()) {
+			return "node:" + string(whois.Node.StableID)
+		}
+		if whois.UserProfile != nil {
+			return "user:" + whois.UserProfile.LoginName
+		}
+		if whois.Node != nil {
+			return "node:" + string(whois.Node.StableID)
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+func (p *Proxy) checkRateLimit(w http.ResponseWriter, r *http.Request) bool {
+	if p.limiter == nil {
+		return true
+	}
+
+	key := p.limiter.key(p.whois(r), r)
+	ok, delay := p.limiter.allow(key)
+	if ok {
+		return true
+	}
+
+	rateLimitedTotal.Inc(p.name)
+	p.logger.Debug("rate limit exceeded", "caller", key, "retry_after", delay)
+
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+	p.errorPages.Render(w, r, errorpage.Page{
+		Status:  http.StatusTooManyRequests,
+		Service: p.name,
+	})
+	return false
+}
@@ -0,0 +1,271 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Retry defaults
+const (
+	DefaultRetryBackoff = 100 * time.Millisecond
+	DefaultRetryMaxBody = 1 << 20
+)
+
+// MaxRetryBackoff caps the doubling wait between retries
+const MaxRetryBackoff = 10 * time.Second
+
+// DefaultBreakerCooldown is how long an open circuit rejects requests
+// before letting a probe through
+const DefaultBreakerCooldown = 30 * time.Second
+
+// Retry resends idempotent requests that failed to reach the container,
+// up to Attempts more times. The wait starts at Backoff and doubles on
+// each attempt, up to MaxRetryBackoff. Request bodies up to MaxBody bytes
+// are buffered so they can be resent; larger requests are tried once.
+type Retry struct {
+	Attempts int
+	Backoff  time.Duration
+	MaxBody  int64
+}
+
+// CircuitBreaker stops sending requests to the container after Failures
+// consecutive connection failures. Requests are answered with 503 until
+// Cooldown has passed, then a single probe decides whether to close the
+// circuit again.
+type CircuitBreaker struct {
+	Failures int
+	Cooldown time.Duration
+}
+
+// retryTransport retries requests that failed before the container could
+// have processed them
+type retryTransport struct {
+	next  http.RoundTripper
+	name  string
+	retry Retry
+}
+
+func newRetryTransport(next http.RoundTripper, name string, retry Retry) *retryTransport {
+	if retry.Backoff <= 0 {
+		retry.Backoff = DefaultRetryBackoff
+	}
+	if retry.MaxBody <= 0 {
+		retry.MaxBody = DefaultRetryMaxBody
+	}
+
+	return &retryTransport{next: next, name: name, retry: retry}
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !idempotent(req) || isUpgrade(req) {
+		return t.next.RoundTrip(req)
+	}
+
+	var body []byte
+	if req.Body != nil && req.Body != http.NoBody {
+		if req.ContentLength > t.retry.MaxBody {
+			return t.next.RoundTrip(req)
+		}
+
+		buf, err := io.ReadAll(io.LimitReader(req.Body, t.retry.MaxBody+1))
+		if err != nil {
+			req.Body.Close()
+			return nil, err
+		}
+		if int64(len(buf)) > t.retry.MaxBody {
+			// Too large to keep; send what was read followed by the rest
+			out := req.Clone(req.Context())
+			out.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(buf), req.Body), req.Body}
+			return t.next.RoundTrip(out)
+		}
+		req.Body.Close()
+		body = buf
+	}
+
+	for attempt := 0; ; attempt++ {
+		out := req
+		if body != nil {
+			out = req.Clone(req.Context())
+			out.Body = io.NopCloser(bytes.NewReader(body))
+		}
+
+		resp, err := t.next.RoundTrip(out)
+		if err == nil || attempt >= t.retry.Attempts || !retryableError(err) {
+			return resp, err
+		}
+
+		retriesTotal.Inc(t.name)
+		select {
+		case <-req.Context().Done():
+			return nil, err
+		case <-time.After(t.backoff(attempt)):
+		}
+	}
+}
+
+// backoff returns the wait after the given attempt, doubling from Backoff
+// without exceeding MaxRetryBackoff
+func (t *retryTransport) backoff(attempt int) time.Duration {
+	d := t.retry.Backoff
+	for range attempt {
+		if d >= MaxRetryBackoff/2 {
+			return MaxRetryBackoff
+		}
+		d *= 2
+	}
+	return min(d, MaxRetryBackoff)
+}
+
+// idempotent reports whether a request can safely be sent twice
+func idempotent(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return req.Header.Get("Idempotency-Key") != "" || req.Header.Get("X-Idempotency-Key") != ""
+}
+
+// retryableError reports whether err means the connection failed, as when
+// the container is restarting, rather than the request timing out
+func retryableError(err error) bool {
+	var open *circuitOpenError
+	if errors.As(err, &open) {
+		return false
+	}
+
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return true
+	}
+	return errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// circuitOpenError is returned instead of contacting a failing container
+type circuitOpenError struct {
+	retryAfter time.Duration
+}
+
+func (e *circuitOpenError) Error() string {
+	return "circuit breaker open"
+}
+
+// retryAfterHeader formats a wait as whole seconds, rounded up
+func retryAfterHeader(d time.Duration) string {
+	return strconv.Itoa(int((d + time.Second - 1) / time.Second))
+}
+
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+// breaker tracks consecutive connection failures to one container
+type breaker struct {
+	name     string
+	failures int
+	cooldown time.Duration
+
+	mu       sync.Mutex
+	state    circuitState
+	failed   int
+	openedAt time.Time
+	probing  bool
+	now      func() time.Time
+}
+
+func newBreaker(name string, cb CircuitBreaker) *breaker {
+	cooldown := cb.Cooldown
+	if cooldown <= 0 {
+		cooldown = DefaultBreakerCooldown
+	}
+	return &breaker{
+		name:     name,
+		failures: cb.Failures,
+		cooldown: cooldown,
+		now:      time.Now,
+	}
+}
+
+// allow reports whether a request may be sent, or how long until the
+// circuit will let a probe through
+func (b *breaker) allow() (time.Duration, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case circuitOpen:
+		if wait := b.openedAt.Add(b.cooldown).Sub(b.now()); wait > 0 {
+			return wait, false
+		}
+		b.state = circuitHalfOpen
+		b.probing = true
+		return 0, true
+	case circuitHalfOpen:
+		if b.probing {
+			return b.cooldown, false
+		}
+		b.probing = true
+	}
+	return 0, true
+}
+
+func (b *breaker) record(success bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.probing = false
+	if success {
+		b.failed = 0
+		if b.state != circuitClosed {
+			b.state = circuitClosed
+			circuitOpenGauge.Set(0, b.name)
+		}
+		return
+	}
+
+	b.failed++
+	if b.state == circuitHalfOpen || b.failed >= b.failures {
+		b.state = circuitOpen
+		b.openedAt = b.now()
+		circuitOpenGauge.Set(1, b.name)
+	}
+}
+
+// breakerTransport fails fast while the circuit is open
+type breakerTransport struct {
+	next    http.RoundTripper
+	breaker *breaker
+}
+
+func (t *breakerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	wait, ok := t.breaker.allow()
+	if !ok {
+		return nil, &circuitOpenError{retryAfter: wait}
+	}
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil && req.Context().Err() != nil {
+		// The client gave up; that says nothing about the container.
+		// Release a half-open probe without changing the state.
+		t.breaker.mu.Lock()
+		t.breaker.probing = false
+		t.breaker.mu.Unlock()
+		return resp, err
+	}
+	t.breaker.record(err == nil)
+	return resp, err
+}
@@ -0,0 +1,108 @@
+package proxy
+
+import (
+	"container/list"
+	"net"
+	"sync"
+	"time"
+
+	"tailscale.com/client/tailscale/apitype"
+)
+
+// DefaultWhoIsCacheSize bounds the number of cached callers per service
+const DefaultWhoIsCacheSize = 1024
+
+// whoisCache is a size-bounded LRU of WhoIs results keyed by caller IP.
+// A tailnet IP maps to one node, so results are shared across that node's
+// connections until the TTL expires or the netmap changes.
+type whoisCache struct {
+	ttl     time.Duration
+	maxSize int
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+	now     func() time.Time
+}
+
+type whoisEntry struct {
+	key     string
+	whois   *apitype.WhoIsResponse
+	expires time.Time
+}
+
+func newWhoIsCache(ttl time.Duration, maxSize int) *whoisCache {
+	return &whoisCache{
+		ttl:     ttl,
+		maxSize: maxSize,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+		now:     time.Now,
+	}
+}
+
+func cacheKey(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return remoteAddr
+	}
+	return host
+}
+
+func (c *whoisCache) get(remoteAddr string) (*apitype.WhoIsResponse, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[cacheKey(remoteAddr)]
+	if !ok {
+		return nil, false
+	}
+
+	entry := elem.Value.(*whoisEntry)
+	if c.now().After(entry.expires) {
+		c.lru.Remove(elem)
+		delete(c.entries, entry.key)
+		return nil, false
+	}
+
+	c.lru.MoveToFront(elem)
+	return entry.whois, true
+}
+
+func (c *whoisCache) put(remoteAddr string, whois *apitype.WhoIsResponse) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := cacheKey(remoteAddr)
+	expires := c.now().Add(c.ttl)
+
+	if elem, ok := c.entries[key]; ok {
+		entry := elem.Value.(*whoisEntry)
+		entry.whois = whois
+		entry.expires = expires
+		c.lru.MoveToFront(elem)
+		return
+	}
+
+	c.entries[key] = c.lru.PushFront(&whoisEntry{key: key, whois: whois, expires: expires})
+
+	for c.lru.Len() > c.maxSize {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*whoisEntry).key)
+	}
+}
+
+func (c *whoisCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries = make(map[string]*list.Element)
+	c.lru.Init()
+}
+
+func (c *whoisCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
@@ -0,0 +1,29 @@
+package service
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+
+	"github.com/jasonwu/dovetail/internal/metrics"
+	"github.com/jasonwu/dovetail/internal/proxy"
+	"tailscale.com/ipn"
+)
+
+var funnelExposed = metrics.NewGaugeVec(
+	"dovetail_funnel_exposed",
+	"Set to 1 for each service that is publicly reachable over Tailscale Funnel.",
+	"service",
+)
+
+// funnelConnContext tags requests on connections relayed by Tailscale Funnel
+// so the proxy can treat them as public traffic.
+func funnelConnContext(ctx context.Context, c net.Conn) context.Context {
+	if tc, ok := c.(*tls.Conn); ok {
+		c = tc.NetConn()
+	}
+	if _, ok := c.(*ipn.FunnelConn); ok {
+		return proxy.WithFunnel(ctx)
+	}
+	return ctx
+}
@@ -0,0 +1,37 @@
+package service
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"testing"
+
+	"github.com/jasonwu/dovetail/internal/proxy"
+	"tailscale.com/ipn"
+)
+
+func TestFunnelConnContext(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	tests := []struct {
+		name string
+		conn net.Conn
+		want bool
+	}{
+		{"plain tailnet conn", server, false},
+		{"tls tailnet conn", tls.Server(server, &tls.Config{}), false},
+		{"funnel conn", &ipn.FunnelConn{Conn: server}, true},
+		{"tls funnel conn", tls.Server(&ipn.FunnelConn{Conn: server}, &tls.Config{}), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := funnelConnContext(context.Background(), tt.conn)
+			if got := proxy.IsFunnel(ctx); got != tt.want {
+				t.Errorf("IsFunnel() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,29 @@
+package service
+
+import (
+	"net/http"
+	"net/url"
+)
+
+// Plain HTTP listener modes
+const (
+	HTTPModeOff      = "off"
+	HTTPModeRedirect = "redirect"
+	HTTPModeServe    = "serve"
+)
+
+// redirectToHTTPS sends plain HTTP requests to the same path on the node's
+// full HTTPS name, so MagicDNS short names like http://webapp resolve to a
+// URL the certificate is valid for.
+func redirectToHTTPS(domain string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		target := url.URL{
+			Scheme:   "https",
+			Host:     domain,
+			Path:     r.URL.Path,
+			RawPath:  r.URL.RawPath,
+			RawQuery: r.URL.RawQuery,
+		}
+		http.Redirect(w, r, target.String(), http.StatusPermanentRedirect)
+	})
+}
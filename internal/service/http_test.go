@@ -0,0 +1,38 @@
+package service
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRedirectToHTTPS(t *testing.T) {
+	handler := redirectToHTTPS("webapp.tail1234.ts.net")
+
+	tests := []struct {
+		name   string
+		method string
+		target string
+		want   string
+	}{
+		{"root", http.MethodGet, "http://webapp/", "https://webapp.tail1234.ts.net/"},
+		{"path and query", http.MethodGet, "http://webapp/photos/1?size=full", "https://webapp.tail1234.ts.net/photos/1?size=full"},
+		{"escaped path", http.MethodGet, "http://webapp/a%2Fb", "https://webapp.tail1234.ts.net/a%2Fb"},
+		{"post keeps method", http.MethodPost, "http://100.64.0.1/api", "https://webapp.tail1234.ts.net/api"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.target, nil)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+
+			if w.Code != http.StatusPermanentRedirect {
+				t.Errorf("StatusCode = %d, want %d", w.Code, http.StatusPermanentRedirect)
+			}
+			if got := w.Header().Get("Location"); got != tt.want {
+				t.Errorf("Location = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,111 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/jasonwu/dovetail/internal/proxy"
+)
+
+// ErrServiceNotFound is returned for a service name that isn't running
+var ErrServiceNotFound = errors.New("service not found")
+
+// ErrMaintenanceUnsupported is returned for redirect and static services,
+// which answer requests themselves and can't be put into maintenance
+var ErrMaintenanceUnsupported = errors.New("maintenance mode is only supported for proxied services")
+
+// MaintenanceState is the admin API representation of a service's
+// maintenance mode
+type MaintenanceState struct {
+	Service string   `json:"service"`
+	Enabled bool     `json:"enabled"`
+	Message string   `json:"message,omitempty"`
+	Allow   []string `json:"allow,omitempty"`
+}
+
+// SetMaintenance puts a running service into maintenance mode, or takes it
+// out with nil. The mode is kept if the service's container is recreated.
+func (m *Manager) SetMaintenance(name string, mode *proxy.Maintenance) error {
+	m.mu.Lock()
+	id, ok := m.names[name]
+	if !ok {
+		m.mu.Unlock()
+		return ErrServiceNotFound
+	}
+	if m.selfServed[name] {
+		m.mu.Unlock()
+		return ErrMaintenanceUnsupported
+	}
+	m.maintenance[name] = mode
+	svc := m.services[id]
+	m.mu.Unlock()
+
+	svc.SetMaintenance(mode)
+	m.logger.Info("maintenance mode changed", "name", name, "enabled", mode != nil)
+	return nil
+}
+
+// Maintenance returns a running service's maintenance mode, nil when it's
+// serving normally
+func (m *Manager) Maintenance(name string) (*proxy.Maintenance, error) {
+	m.mu.RLock()
+	id, ok := m.names[name]
+	if !ok {
+		m.mu.RUnlock()
+		return nil, ErrServiceNotFound
+	}
+	svc := m.services[id]
+	m.mu.RUnlock()
+
+	return svc.Maintenance(), nil
+}
+
+// MaintenanceHandler serves GET and PUT of a MaintenanceState for the
+// service named by the {name} path wildcard
+func (m *Manager) MaintenanceHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPut:
+			var state MaintenanceState
+			if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&state); err != nil {
+				http.Error(w, "invalid request body: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			var mode *proxy.Maintenance
+			if state.Enabled {
+				mode = &proxy.Maintenance{Message: state.Message, Allow: state.Allow}
+			}
+			if err := m.SetMaintenance(name, mode); err != nil {
+				status := http.StatusNotFound
+				if errors.Is(err, ErrMaintenanceUnsupported) {
+					status = http.StatusConflict
+				}
+				http.Error(w, err.Error(), status)
+				return
+			}
+		default:
+			w.Header().Set("Allow", "GET, PUT")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		mode, err := m.Maintenance(name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		state := MaintenanceState{Service: name, Enabled: mode != nil}
+		if mode != nil {
+			state.Message = mode.Message
+			state.Allow = mode.Allow
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(state)
+	})
+}
@@ -0,0 +1,147 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/jasonwu/dovetail/internal/config"
+	"github.com/jasonwu/dovetail/internal/docker"
+	"github.com/jasonwu/dovetail/internal/proxy"
+)
+
+func TestMaintenance_Labels(t *testing.T) {
+	var got *ServiceConfig
+	factory := func(cfg *ServiceConfig, logger *slog.Logger) (ServiceInterface, error) {
+		got = cfg
+		return &mockService{name: cfg.Name}, nil
+	}
+	m := NewManagerWithFactory(&config.Config{StateDir: "/tmp/test"}, slog.Default(), factory)
+
+	m.HandleEvent(context.Background(), docker.ContainerEvent{
+		Type:        docker.EventStart,
+		ContainerID: "container123456789",
+		Config: &docker.ServiceConfig{
+			Name: "wiki", Port: 80, IP: "172.17.0.2",
+			Maintenance:        true,
+			MaintenanceMessage: "Upgrading to v2",
+			MaintenanceAllow:   []string{"tag:ops"},
+		},
+	})
+
+	if got.Maintenance == nil {
+		t.Fatal("expected service to start in maintenance")
+	}
+	if got.Maintenance.Message != "Upgrading to v2" || strings.Join(got.Maintenance.Allow, ",") != "tag:ops" {
+		t.Errorf("Maintenance = %+v", got.Maintenance)
+	}
+}
+
+func TestMaintenanceHandler(t *testing.T) {
+	var svc *mockService
+	var started *ServiceConfig
+	factory := func(cfg *ServiceConfig, logger *slog.Logger) (ServiceInterface, error) {
+		started = cfg
+		svc = &mockService{name: cfg.Name, maintenance: cfg.Maintenance}
+		return svc, nil
+	}
+	m := NewManagerWithFactory(&config.Config{StateDir: "/tmp/test"}, slog.Default(), factory)
+	start := func(id string) {
+		m.HandleEvent(context.Background(), docker.ContainerEvent{
+			Type:        docker.EventStart,
+			ContainerID: id,
+			Config:      &docker.ServiceConfig{Name: "wiki", Port: 80, IP: "172.17.0.2"},
+		})
+	}
+	start("container123456789")
+
+	mux := http.NewServeMux()
+	mux.Handle("/services/{name}/maintenance", m.MaintenanceHandler())
+	send := func(method, name, body string) (*httptest.ResponseRecorder, MaintenanceState) {
+		req := httptest.NewRequest(method, "/services/"+name+"/maintenance", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+
+		var state MaintenanceState
+		if w.Code == http.StatusOK {
+			if err := json.Unmarshal(w.Body.Bytes(), &state); err != nil {
+				t.Fatalf("invalid response: %v", err)
+			}
+		}
+		return w, state
+	}
+
+	if _, state := send(http.MethodGet, "wiki", ""); state.Enabled {
+		t.Error("expected maintenance to be off initially")
+	}
+
+	w, state := send(http.MethodPut, "wiki", `{"enabled":true,"message":"Back soon","allow":["alice@example.com"]}`)
+	if w.Code != http.StatusOK || !state.Enabled || state.Message != "Back soon" {
+		t.Fatalf("PUT = %d %+v", w.Code, state)
+	}
+	if svc.maintenance == nil || svc.maintenance.Allow[0] != "alice@example.com" {
+		t.Errorf("service maintenance = %+v", svc.maintenance)
+	}
+
+	// A recreated container keeps the runtime mode
+	m.HandleEvent(context.Background(), docker.ContainerEvent{Type: docker.EventStop, ContainerID: "container123456789"})
+	start("container987654321")
+	if started.Maintenance == nil || started.Maintenance.Message != "Back soon" {
+		t.Errorf("recreated service Maintenance = %+v", started.Maintenance)
+	}
+
+	if _, state := send(http.MethodPut, "wiki", `{"enabled":false}`); state.Enabled || svc.maintenance != nil {
+		t.Error("expected maintenance to be turned off")
+	}
+
+	if w, _ := send(http.MethodGet, "missing", ""); w.Code != http.StatusNotFound {
+		t.Errorf("unknown service StatusCode = %d, want %d", w.Code, http.StatusNotFound)
+	}
+	if w, _ := send(http.MethodPut, "wiki", `{`); w.Code != http.StatusBadRequest {
+		t.Errorf("invalid body StatusCode = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	if w, _ := send(http.MethodDelete, "wiki", ""); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("DELETE StatusCode = %d, want %d", w.Code, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestSetMaintenance_Static(t *testing.T) {
+	svcs := make(map[string]*mockService)
+	factory := func(cfg *ServiceConfig, logger *slog.Logger) (ServiceInterface, error) {
+		svcs[cfg.Name] = &mockService{name: cfg.Name}
+		return svcs[cfg.Name], nil
+	}
+	m := NewManagerWithFactory(&config.Config{StateDir: "/tmp/test"}, slog.Default(), factory)
+	m.StartServices(context.Background(), []config.StaticService{
+		{Name: "nas", Kind: config.KindProxy, Target: "http://192.168.1.10"},
+		{Name: "docs", Kind: config.KindRedirect, RedirectTo: "https://wiki.example.com", RedirectStatus: 302},
+		{Name: "status", Kind: config.KindStatic, Root: "/srv/status"},
+	})
+
+	mode := &proxy.Maintenance{Message: "Back soon"}
+	for _, name := range []string{"docs", "status"} {
+		if err := m.SetMaintenance(name, mode); !errors.Is(err, ErrMaintenanceUnsupported) {
+			t.Errorf("SetMaintenance(%q) error = %v, want %v", name, err, ErrMaintenanceUnsupported)
+		}
+		if svcs[name].maintenance != nil {
+			t.Errorf("%s maintenance = %+v, want nil", name, svcs[name].maintenance)
+		}
+	}
+	if err := m.SetMaintenance("nas", mode); err != nil || svcs["nas"].maintenance != mode {
+		t.Errorf("SetMaintenance(nas) error = %v, maintenance = %+v", err, svcs["nas"].maintenance)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/services/{name}/maintenance", m.MaintenanceHandler())
+	req := httptest.NewRequest(http.MethodPut, "/services/status/maintenance", strings.NewReader(`{"enabled":true}`))
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	if w.Code != http.StatusConflict {
+		t.Errorf("PUT static StatusCode = %d, want %d", w.Code, http.StatusConflict)
+	}
+}
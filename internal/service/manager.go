@@ -4,10 +4,20 @@ import (
 	"context"
 	"fmt"
 	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/jasonwu/dovetail/internal/config"
 	"github.com/jasonwu/dovetail/internal/docker"
+	"github.com/jasonwu/dovetail/internal/errorpage"
+	"github.com/jasonwu/dovetail/internal/identity"
+	"github.com/jasonwu/dovetail/internal/proxy"
 )
 
 // ServiceInterface abstracts Service operations for testing
@@ -15,6 +25,8 @@ type ServiceInterface interface {
 	Start(ctx context.Context) error
 	Stop() error
 	UpdateTarget(ip string, port int) error
+	SetMaintenance(m *proxy.Maintenance)
+	Maintenance() *proxy.Maintenance
 	Name() string
 }
 
@@ -33,16 +45,22 @@ type Manager struct {
 	mu             sync.RWMutex
 	logger         *slog.Logger
 	serviceFactory ServiceFactory
+	errorPages     *errorpage.Renderer
+	identitySigner *identity.Signer
+
+	// maintenance holds modes set at runtime by service name. They
+	// outlive the container, so a recreated container keeps its mode
+	// until dovetail restarts. A nil entry forces maintenance off.
+	maintenance map[string]*proxy.Maintenance
+
+	// selfServed holds the names of services file entries that answer
+	// redirects or serve files themselves, which have no proxy to put
+	// into maintenance
+	selfServed map[string]bool
 }
 
 func NewManager(cfg *config.Config, logger *slog.Logger) *Manager {
-	return &Manager{
-		config:         cfg,
-		services:       make(map[string]ServiceInterface),
-		names:          make(map[string]string),
-		logger:         logger,
-		serviceFactory: DefaultServiceFactory,
-	}
+	return NewManagerWithFactory(cfg, logger, DefaultServiceFactory)
 }
 
 // NewManagerWithFactory creates a Manager with a custom ServiceFactory (for testing)
@@ -53,6 +71,9 @@ func NewManagerWithFactory(cfg *config.Config, logger *slog.Logger, factory Serv
 		names:          make(map[string]string),
 		logger:         logger,
 		serviceFactory: factory,
+		errorPages:     errorpage.Default(),
+		maintenance:    make(map[string]*proxy.Maintenance),
+		selfServed:     make(map[string]bool),
 	}
 }
 
@@ -71,6 +92,14 @@ func (m *Manager) handleStart(ctx context.Context, event docker.ContainerEvent)
 		return
 	}
 
+	if m.reserved(cfg.Name) {
+		m.logger.Error("service name is reserved for the OIDC provider",
+			"name", cfg.Name,
+			"container", event.ContainerID[:12],
+		)
+		return
+	}
+
 	m.mu.Lock()
 
 	// Check for duplicate service name
@@ -78,7 +107,7 @@ func (m *Manager) handleStart(ctx context.Context, event docker.ContainerEvent)
 		m.mu.Unlock()
 		m.logger.Error("duplicate service name",
 			"name", cfg.Name,
-			"existing_container", existingID[:12],
+			"existing_container", shortID(existingID),
 			"new_container", event.ContainerID[:12],
 		)
 		return
@@ -94,6 +123,7 @@ func (m *Manager) handleStart(ctx context.Context, event docker.ContainerEvent)
 		return
 	}
 
+	maintenance := m.maintenanceFor(cfg)
 	m.mu.Unlock()
 
 	// Create and start new service
@@ -103,6 +133,44 @@ func (m *Manager) handleStart(ctx context.Context, event docker.ContainerEvent)
 		Port:     cfg.Port,
 		StateDir: m.config.StateDir,
 		AuthKey:  m.config.AuthKey,
+
+		Socket:             cfg.Socket,
+		Scheme:             cfg.Scheme,
+		Protocol:           cfg.Protocol,
+		InsecureSkipVerify: cfg.TLSInsecureSkipVerify,
+		CAFile:             cfg.TLSCAFile,
+		ServerName:         cfg.TLSServerName,
+		PreserveHost:       cfg.PreserveHost,
+		Compression:        cfg.Compression,
+		Cache:              cacheOptions(cfg),
+
+		RequestHeaders:  headerRules(cfg.RequestHeaders),
+		ResponseHeaders: headerRules(cfg.ResponseHeaders),
+		SecurityHeaders: stringOr(cfg.SecurityHeaders, m.config.SecurityHeaders),
+
+		ReadHeaderTimeout: durationOr(cfg.ReadHeaderTimeout, m.config.ReadHeaderTimeout),
+		ReadTimeout:       durationOr(cfg.ReadTimeout, m.config.ReadTimeout),
+		WriteTimeout:      durationOr(cfg.WriteTimeout, m.config.WriteTimeout),
+		IdleTimeout:       durationOr(cfg.IdleTimeout, m.config.IdleTimeout),
+
+		Maintenance:    maintenance,
+		MaxBodySize:    sizeOr(cfg.MaxBodySize, m.config.MaxBodySize),
+		MaxHeaderBytes: sizeOr(cfg.MaxHeaderBytes, m.config.MaxHeaderBytes),
+
+		HTTPMode:    cfg.HTTP,
+		Funnel:      cfg.Funnel,
+		FunnelPaths: cfg.FunnelPaths,
+
+		RateLimit:      rateLimit(cfg),
+		Retry:          retry(cfg),
+		CircuitBreaker: circuitBreaker(cfg),
+		WhoIsCacheTTL:  m.config.WhoIsCacheTTL,
+
+		IdentityHeaders: proxy.IdentityHeaders(cfg.HeadersPreset, cfg.HeadersMap),
+		LegacyHeaders:   boolOr(cfg.HeadersLegacy, m.config.LegacyIdentityHeaders),
+		IdentitySigner:  m.signerFor(cfg),
+
+		ErrorPages: m.errorPages,
 	}, m.logger)
 	if err != nil {
 		m.logger.Error("failed to create service",
@@ -127,13 +195,301 @@ func (m *Manager) handleStart(ctx context.Context, event docker.ContainerEvent)
 	m.names[cfg.Name] = event.ContainerID
 	m.mu.Unlock()
 
+	target := cfg.Scheme + "://" + net.JoinHostPort(cfg.IP, strconv.Itoa(cfg.Port))
+	if cfg.Socket != "" {
+		target = "unix:" + cfg.Socket
+	}
 	m.logger.Info("service created",
 		"name", cfg.Name,
 		"container", event.ContainerID[:12],
-		"target", fmt.Sprintf("%s:%d", cfg.IP, cfg.Port),
+		"target", target,
 	)
 }
 
+// servicesFileID prefixes the IDs of services from the services file, which
+// share the maps keyed by container ID
+const servicesFileID = "services-file:"
+
+// StartServices starts the services defined in the services file. They
+// run until Shutdown and take precedence over containers with the same name.
+func (m *Manager) StartServices(ctx context.Context, services []config.StaticService) {
+	for _, def := range services {
+		id := servicesFileID + def.Name
+
+		if m.reserved(def.Name) {
+			m.logger.Error("service name is reserved for the OIDC provider", "name", def.Name)
+			continue
+		}
+
+		m.mu.Lock()
+		if existingID, exists := m.names[def.Name]; exists {
+			m.mu.Unlock()
+			m.logger.Error("duplicate service name",
+				"name", def.Name,
+				"existing_container", shortID(existingID),
+			)
+			continue
+		}
+		m.mu.Unlock()
+
+		cfg, err := m.staticServiceConfig(def)
+		if err != nil {
+			m.logger.Error("failed to create service", "name", def.Name, "error", err)
+			continue
+		}
+
+		svc, err := m.serviceFactory(cfg, m.logger)
+		if err != nil {
+			m.logger.Error("failed to create service", "name", def.Name, "error", err)
+			continue
+		}
+
+		if err := svc.Start(ctx); err != nil {
+			m.logger.Error("failed to start service", "name", def.Name, "error", err)
+			continue
+		}
+
+		m.mu.Lock()
+		m.services[id] = svc
+		m.names[def.Name] = id
+		if def.Kind != config.KindProxy {
+			m.selfServed[def.Name] = true
+		}
+		m.mu.Unlock()
+
+		m.logger.Info("service created", "name", def.Name, "kind", def.Kind)
+	}
+}
+
+// reserved reports whether a name is taken by the OIDC provider's node,
+// whose state lives in the same directory a service of that name would use
+func (m *Manager) reserved(name string) bool {
+	return m.config.OIDCHostname != "" && strings.EqualFold(name, m.config.OIDCHostname)
+}
+
+// staticServiceConfig converts a services file entry, using the global
+// defaults for everything the file can't set
+func (m *Manager) staticServiceConfig(def config.StaticService) (*ServiceConfig, error) {
+	cfg := &ServiceConfig{
+		Name:     def.Name,
+		StateDir: m.config.StateDir,
+		AuthKey:  m.config.AuthKey,
+
+		SecurityHeaders: m.config.SecurityHeaders,
+
+		ReadHeaderTimeout: m.config.ReadHeaderTimeout,
+		ReadTimeout:       m.config.ReadTimeout,
+		WriteTimeout:      m.config.WriteTimeout,
+		IdleTimeout:       m.config.IdleTimeout,
+
+		MaxBodySize:    m.config.MaxBodySize,
+		MaxHeaderBytes: m.config.MaxHeaderBytes,
+
+		HTTPMode: def.HTTP,
+		Funnel:   def.Funnel,
+
+		WhoIsCacheTTL: m.config.WhoIsCacheTTL,
+		LegacyHeaders: m.config.LegacyIdentityHeaders,
+
+		ErrorPages: m.errorPages,
+	}
+
+	switch def.Kind {
+	case config.KindRedirect:
+		cfg.Redirect = &Redirect{
+			To:           def.RedirectTo,
+			Status:       def.RedirectStatus,
+			PreservePath: def.PreservePath,
+		}
+	case config.KindStatic:
+		cfg.StaticRoot = def.Root
+	default:
+		cfg.Socket = def.Socket
+		target, err := url.Parse(def.Target)
+		if err != nil {
+			return nil, fmt.Errorf("invalid target: %w", err)
+		}
+		cfg.Scheme = target.Scheme
+		cfg.TargetIP = target.Hostname()
+		if cfg.Port, err = strconv.Atoi(target.Port()); err != nil {
+			cfg.Port = 80
+			if target.Scheme == "https" {
+				cfg.Port = 443
+			}
+		}
+	}
+
+	return cfg, nil
+}
+
+// shortID abbreviates a container ID for logging. IDs of services from the
+// services file are returned whole.
+func shortID(id string) string {
+	if len(id) < 12 || strings.HasPrefix(id, servicesFileID) {
+		return id
+	}
+	return id[:12]
+}
+
+// SetErrorPages sets the renderer for error pages of services started
+// afterwards. The built-in pages are used until then.
+func (m *Manager) SetErrorPages(errorPages *errorpage.Renderer) {
+	m.errorPages = errorPages
+}
+
+// SetIdentitySigner sets the key used to sign identity assertions for
+// services that opt in with the identity JWT label. Without it, the key is
+// loaded or created in the state directory when the first one starts.
+func (m *Manager) SetIdentitySigner(signer *identity.Signer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.identitySigner = signer
+}
+
+// IdentitySigner returns the identity signing key, nil while no service
+// has needed one
+func (m *Manager) IdentitySigner() *identity.Signer {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.identitySigner
+}
+
+// JWKSHandler serves the identity key set, or 404 while no service has
+// needed a key
+func (m *Manager) JWKSHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		signer := m.IdentitySigner()
+		if signer == nil {
+			http.NotFound(w, r)
+			return
+		}
+		signer.JWKSHandler().ServeHTTP(w, r)
+	})
+}
+
+// signerFor returns the identity signer if the container asked for signed
+// assertions, loading or creating the key on first use
+func (m *Manager) signerFor(cfg *docker.ServiceConfig) *identity.Signer {
+	if !cfg.IdentityJWT {
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.identitySigner == nil {
+		signer, err := identity.LoadOrCreate(filepath.Join(m.config.StateDir, identity.KeyFile))
+		if err != nil {
+			m.logger.Warn("identity JWT requested but no signing key is available", "name", cfg.Name, "error", err)
+			return nil
+		}
+		m.identitySigner = signer
+	}
+	return m.identitySigner
+}
+
+// rateLimit converts the container's rate limit labels, if any
+func rateLimit(cfg *docker.ServiceConfig) *proxy.RateLimit {
+	if cfg.RateLimitRequests == 0 {
+		return nil
+	}
+	return &proxy.RateLimit{
+		Requests: cfg.RateLimitRequests,
+		Per:      cfg.RateLimitPer,
+		Burst:    cfg.RateLimitBurst,
+		By:       cfg.RateLimitBy,
+	}
+}
+
+func cacheOptions(cfg *docker.ServiceConfig) *proxy.CacheOptions {
+	if !cfg.Cache {
+		return nil
+	}
+	return &proxy.CacheOptions{
+		MemorySize: cfg.CacheMemory,
+		DiskSize:   cfg.CacheDisk,
+	}
+}
+
+// maintenanceFor returns the runtime maintenance mode if one was set,
+// otherwise the one from labels. m.mu must be held.
+func (m *Manager) maintenanceFor(cfg *docker.ServiceConfig) *proxy.Maintenance {
+	if mode, ok := m.maintenance[cfg.Name]; ok {
+		return mode
+	}
+	if !cfg.Maintenance {
+		return nil
+	}
+	return &proxy.Maintenance{
+		Message: cfg.MaintenanceMessage,
+		Allow:   cfg.MaintenanceAllow,
+	}
+}
+
+func retry(cfg *docker.ServiceConfig) *proxy.Retry {
+	if cfg.RetryAttempts == 0 {
+		return nil
+	}
+	return &proxy.Retry{
+		Attempts: cfg.RetryAttempts,
+		Backoff:  cfg.RetryBackoff,
+		MaxBody:  cfg.RetryMaxBody,
+	}
+}
+
+func circuitBreaker(cfg *docker.ServiceConfig) *proxy.CircuitBreaker {
+	if cfg.BreakerFailures == 0 {
+		return nil
+	}
+	return &proxy.CircuitBreaker{
+		Failures: cfg.BreakerFailures,
+		Cooldown: cfg.BreakerCooldown,
+	}
+}
+
+// durationOr returns the label override if set, otherwise the default
+func durationOr(override *time.Duration, def time.Duration) time.Duration {
+	if override != nil {
+		return *override
+	}
+	return def
+}
+
+// headerRules converts the container's header edits, if any
+func headerRules(rules docker.HeaderRules) *proxy.HeaderRules {
+	if len(rules.Set) == 0 && len(rules.Add) == 0 && len(rules.Remove) == 0 {
+		return nil
+	}
+	return &proxy.HeaderRules{
+		Set:    rules.Set,
+		Add:    rules.Add,
+		Remove: rules.Remove,
+	}
+}
+
+// sizeOr returns the label override if set, otherwise the default
+func sizeOr(override *int64, def int64) int64 {
+	if override != nil {
+		return *override
+	}
+	return def
+}
+
+// stringOr returns the label override if set, otherwise the default
+func stringOr(override, def string) string {
+	if override != "" {
+		return override
+	}
+	return def
+}
+
+// boolOr returns the label override if set, otherwise the default
+func boolOr(override *bool, def bool) bool {
+	if override != nil {
+		return *override
+	}
+	return def
+}
+
 func (m *Manager) handleStop(event docker.ContainerEvent) {
 	m.mu.Lock()
 	svc, exists := m.services[event.ContainerID]
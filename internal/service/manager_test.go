@@ -4,12 +4,20 @@ import (
 	"context"
 	"errors"
 	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"sync"
 	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/jasonwu/dovetail/internal/config"
 	"github.com/jasonwu/dovetail/internal/docker"
+	"github.com/jasonwu/dovetail/internal/errorpage"
+	"github.com/jasonwu/dovetail/internal/identity"
+	"github.com/jasonwu/dovetail/internal/proxy"
 )
 
 // mockService implements ServiceInterface for testing
@@ -23,6 +31,7 @@ type mockService struct {
 	updatePort   int
 	updateCalled bool
 	updateErr    error
+	maintenance  *proxy.Maintenance
 }
 
 func (m *mockService) Start(ctx context.Context) error {
@@ -42,6 +51,14 @@ func (m *mockService) UpdateTarget(ip string, port int) error {
 	return m.updateErr
 }
 
+func (m *mockService) SetMaintenance(mode *proxy.Maintenance) {
+	m.maintenance = mode
+}
+
+func (m *mockService) Maintenance() *proxy.Maintenance {
+	return m.maintenance
+}
+
 func (m *mockService) Name() string {
 	return m.name
 }
@@ -202,6 +219,34 @@ func TestHandleEvent_Start_DuplicateName(t *testing.T) {
 	}
 }
 
+func TestHandleEvent_Start_OIDCHostname(t *testing.T) {
+	cfg := &config.Config{
+		AuthKey:      "test-key",
+		StateDir:     "/tmp/test",
+		OIDCHostname: "idp",
+	}
+
+	callCount := 0
+	factory := func(cfg *ServiceConfig, logger *slog.Logger) (ServiceInterface, error) {
+		callCount++
+		return &mockService{name: cfg.Name}, nil
+	}
+
+	m := NewManagerWithFactory(cfg, slog.Default(), factory)
+	m.HandleEvent(context.Background(), docker.ContainerEvent{
+		Type:        docker.EventStart,
+		ContainerID: "container111111111",
+		Config:      &docker.ServiceConfig{Name: "idp", Port: 8080, IP: "172.17.0.2"},
+	})
+	m.StartServices(context.Background(), []config.StaticService{
+		{Name: "IDP", Kind: config.KindRedirect, RedirectTo: "https://example.com", RedirectStatus: 302},
+	})
+
+	if callCount != 0 || m.ServiceCount() != 0 {
+		t.Errorf("factory called %d times, ServiceCount() = %d, want the OIDC hostname to be rejected", callCount, m.ServiceCount())
+	}
+}
+
 func TestHandleEvent_Start_ExistingContainer(t *testing.T) {
 	cfg := &config.Config{
 		AuthKey:  "test-key",
@@ -503,6 +548,8 @@ func (t *trackingMockService) Stop() error {
 	return nil
 }
 func (t *trackingMockService) UpdateTarget(ip string, port int) error { return nil }
+func (t *trackingMockService) SetMaintenance(m *proxy.Maintenance)    {}
+func (t *trackingMockService) Maintenance() *proxy.Maintenance        { return nil }
 func (t *trackingMockService) Name() string                           { return t.name }
 
 func TestServiceCount(t *testing.T) {
@@ -541,3 +588,222 @@ func TestServiceCount(t *testing.T) {
 		}
 	}
 }
+
+func TestHandleEvent_Start_Timeouts(t *testing.T) {
+	cfg := &config.Config{
+		AuthKey:      "test-key",
+		StateDir:     "/tmp/test",
+		ReadTimeout:  30 * time.Second,
+		WriteTimeout: 30 * time.Second,
+		IdleTimeout:  2 * time.Minute,
+	}
+	logger := slog.Default()
+
+	var got *ServiceConfig
+	factory := func(cfg *ServiceConfig, logger *slog.Logger) (ServiceInterface, error) {
+		got = cfg
+		return &mockService{name: cfg.Name}, nil
+	}
+
+	m := NewManagerWithFactory(cfg, logger, factory)
+
+	unlimited := time.Duration(0)
+	readTimeout := 10 * time.Minute
+	event := docker.ContainerEvent{
+		Type:        docker.EventStart,
+		ContainerID: "container123456789",
+		Config: &docker.ServiceConfig{
+			Name:         "immich",
+			Port:         2283,
+			IP:           "172.17.0.2",
+			ReadTimeout:  &readTimeout,
+			WriteTimeout: &unlimited,
+		},
+	}
+
+	m.HandleEvent(context.Background(), event)
+
+	if got == nil {
+		t.Fatal("factory was not called")
+	}
+	if got.ReadTimeout != readTimeout {
+		t.Errorf("ReadTimeout = %v, want %v", got.ReadTimeout, readTimeout)
+	}
+	if got.WriteTimeout != 0 {
+		t.Errorf("WriteTimeout = %v, want 0 (unlimited)", got.WriteTimeout)
+	}
+	if got.IdleTimeout != 2*time.Minute {
+		t.Errorf("IdleTimeout = %v, want %v (config default)", got.IdleTimeout, 2*time.Minute)
+	}
+}
+
+func TestHandleEvent_Start_IdentityJWT(t *testing.T) {
+	cfg := &config.Config{
+		AuthKey:  "test-key",
+		StateDir: "/tmp/test",
+	}
+	logger := slog.Default()
+
+	got := make(map[string]*ServiceConfig)
+	factory := func(cfg *ServiceConfig, logger *slog.Logger) (ServiceInterface, error) {
+		got[cfg.Name] = cfg
+		return &mockService{name: cfg.Name}, nil
+	}
+
+	m := NewManagerWithFactory(cfg, logger, factory)
+
+	signer, err := identity.LoadOrCreate(filepath.Join(t.TempDir(), identity.KeyFile))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	m.SetIdentitySigner(signer)
+
+	m.HandleEvent(context.Background(), docker.ContainerEvent{
+		Type:        docker.EventStart,
+		ContainerID: "container123456789",
+		Config:      &docker.ServiceConfig{Name: "signed", Port: 80, IP: "172.17.0.2", IdentityJWT: true},
+	})
+	m.HandleEvent(context.Background(), docker.ContainerEvent{
+		Type:        docker.EventStart,
+		ContainerID: "container987654321",
+		Config:      &docker.ServiceConfig{Name: "plain", Port: 80, IP: "172.17.0.3"},
+	})
+
+	if got["signed"] == nil || got["signed"].IdentitySigner != signer {
+		t.Error("expected opted-in service to receive the identity signer")
+	}
+	if got["plain"] == nil || got["plain"].IdentitySigner != nil {
+		t.Error("expected service without the label to have no identity signer")
+	}
+}
+
+func TestHandleEvent_Start_IdentityJWT_CreatesKey(t *testing.T) {
+	stateDir := t.TempDir()
+	cfg := &config.Config{
+		AuthKey:  "test-key",
+		StateDir: stateDir,
+	}
+	logger := slog.Default()
+
+	factory := func(cfg *ServiceConfig, logger *slog.Logger) (ServiceInterface, error) {
+		return &mockService{name: cfg.Name}, nil
+	}
+
+	m := NewManagerWithFactory(cfg, logger, factory)
+	keyPath := filepath.Join(stateDir, identity.KeyFile)
+
+	m.HandleEvent(context.Background(), docker.ContainerEvent{
+		Type:        docker.EventStart,
+		ContainerID: "container987654321",
+		Config:      &docker.ServiceConfig{Name: "plain", Port: 80, IP: "172.17.0.3"},
+	})
+	if _, err := os.Stat(keyPath); !os.IsNotExist(err) {
+		t.Fatalf("expected no signing key without an opted-in service, stat error: %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	m.JWKSHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, identity.JWKSPath, nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("JWKS status = %d, want %d before a key exists", rec.Code, http.StatusNotFound)
+	}
+
+	m.HandleEvent(context.Background(), docker.ContainerEvent{
+		Type:        docker.EventStart,
+		ContainerID: "container123456789",
+		Config:      &docker.ServiceConfig{Name: "signed", Port: 80, IP: "172.17.0.2", IdentityJWT: true},
+	})
+	if _, err := os.Stat(keyPath); err != nil {
+		t.Fatalf("expected signing key to be created on first use: %v", err)
+	}
+	if m.IdentitySigner() == nil {
+		t.Fatal("expected manager to keep the created signer")
+	}
+
+	rec = httptest.NewRecorder()
+	m.JWKSHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, identity.JWKSPath, nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("JWKS status = %d, want %d", rec.Code, http.StatusOK)
+	}
+}
+
+func TestStartServices(t *testing.T) {
+	cfg := &config.Config{
+		AuthKey:     "test-key",
+		StateDir:    "/tmp/test",
+		ReadTimeout: 30 * time.Second,
+	}
+	logger := slog.Default()
+
+	got := make(map[string]*ServiceConfig)
+	factory := func(cfg *ServiceConfig, logger *slog.Logger) (ServiceInterface, error) {
+		got[cfg.Name] = cfg
+		return &mockService{name: cfg.Name}, nil
+	}
+
+	m := NewManagerWithFactory(cfg, logger, factory)
+	m.StartServices(context.Background(), []config.StaticService{
+		{Name: "nas", Kind: config.KindProxy, Target: "https://192.168.1.10"},
+		{Name: "docs", Kind: config.KindRedirect, RedirectTo: "https://wiki.example.com", RedirectStatus: 301, PreservePath: true},
+		{Name: "status", Kind: config.KindStatic, Root: "/srv/status"},
+	})
+
+	if m.ServiceCount() != 3 {
+		t.Fatalf("ServiceCount() = %d, want 3", m.ServiceCount())
+	}
+
+	nas := got["nas"]
+	if nas.Scheme != "https" || nas.TargetIP != "192.168.1.10" || nas.Port != 443 {
+		t.Errorf("nas target = %s://%s:%d, want https://192.168.1.10:443", nas.Scheme, nas.TargetIP, nas.Port)
+	}
+	if nas.ReadTimeout != 30*time.Second {
+		t.Errorf("ReadTimeout = %v, want config default", nas.ReadTimeout)
+	}
+
+	want := Redirect{To: "https://wiki.example.com", Status: 301, PreservePath: true}
+	if got["docs"].Redirect == nil || *got["docs"].Redirect != want {
+		t.Errorf("docs Redirect = %+v, want %+v", got["docs"].Redirect, want)
+	}
+	if got["status"].StaticRoot != "/srv/status" {
+		t.Errorf("status StaticRoot = %q, want /srv/status", got["status"].StaticRoot)
+	}
+
+	// A container can't take over a name from the services file
+	m.HandleEvent(context.Background(), docker.ContainerEvent{
+		Type:        docker.EventStart,
+		ContainerID: "container123456789",
+		Config:      &docker.ServiceConfig{Name: "docs", Port: 80, IP: "172.17.0.2"},
+	})
+	if got["docs"].Redirect == nil || m.ServiceCount() != 3 {
+		t.Error("expected container with a services file name to be rejected")
+	}
+}
+
+func TestSetErrorPages(t *testing.T) {
+	cfg := &config.Config{
+		AuthKey:  "test-key",
+		StateDir: "/tmp/test",
+	}
+
+	var got *ServiceConfig
+	factory := func(cfg *ServiceConfig, logger *slog.Logger) (ServiceInterface, error) {
+		got = cfg
+		return &mockService{name: cfg.Name}, nil
+	}
+
+	m := NewManagerWithFactory(cfg, slog.Default(), factory)
+	if m.errorPages == nil {
+		t.Fatal("expected built-in error pages by default")
+	}
+
+	errorPages := errorpage.Default()
+	m.SetErrorPages(errorPages)
+	m.HandleEvent(context.Background(), docker.ContainerEvent{
+		Type:        docker.EventStart,
+		ContainerID: "container123456789",
+		Config:      &docker.ServiceConfig{Name: "wiki", Port: 80, IP: "172.17.0.2"},
+	})
+
+	if got == nil || got.ErrorPages != errorPages {
+		t.Error("expected service to receive the configured error pages")
+	}
+}
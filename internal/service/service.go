@@ -2,25 +2,44 @@ package service
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"log/slog"
+	"net"
 	"net/http"
 	"net/url"
+	"os"
 	"path/filepath"
+	"strconv"
+	"sync"
 	"time"
 
+	"github.com/jasonwu/dovetail/internal/errorpage"
+	"github.com/jasonwu/dovetail/internal/identity"
 	"github.com/jasonwu/dovetail/internal/proxy"
+	"tailscale.com/client/local"
+	"tailscale.com/ipn"
 	"tailscale.com/tsnet"
 )
 
 type Service struct {
-	name      string
-	server    *tsnet.Server
-	proxy     *proxy.Proxy
-	targetURL *url.URL
-	cancel    context.CancelFunc
-	logger    *slog.Logger
-	done      chan struct{}
+	name           string
+	server         *tsnet.Server
+	proxy          *proxy.Proxy
+	handler        http.Handler
+	targetURL      *url.URL
+	scheme         string
+	socket         string
+	proxyOpts      proxy.Options
+	timeouts       timeouts
+	maxHeaderBytes int
+	httpMode       string
+	funnel         bool
+	domain         string
+	cancel         context.CancelFunc
+	logger         *slog.Logger
+	done           chan struct{}
 }
 
 type ServiceConfig struct {
@@ -29,14 +48,130 @@ type ServiceConfig struct {
 	Port     int
 	StateDir string
 	AuthKey  string
+
+	// Redirect or StaticRoot replace the proxy: the service answers
+	// every request itself and the target is unused
+	Redirect   *Redirect
+	StaticRoot string
+
+	// Upstream connection settings. Scheme defaults to http and Protocol
+	// to proxy.ProtocolHTTP. Socket connects to a Unix socket instead of
+	// TargetIP and Port.
+	Socket             string
+	Scheme             string
+	Protocol           string
+	InsecureSkipVerify bool
+	CAFile             string
+	ServerName         string
+
+	// PreserveHost forwards the client's Host header to the container
+	PreserveHost bool
+
+	// Compression lists response encodings in order of preference. Empty
+	// disables compression.
+	Compression []string
+
+	// Cache enables the response cache. Its disk store is kept under
+	// StateDir. Nil disables caching.
+	Cache *proxy.CacheOptions
+
+	// Header edits and the security header profile
+	RequestHeaders  *proxy.HeaderRules
+	ResponseHeaders *proxy.HeaderRules
+	SecurityHeaders string
+
+	// HTTP server timeouts. Zero means unlimited.
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+
+	// Maintenance starts the service in maintenance mode. Nil serves
+	// normally.
+	Maintenance *proxy.Maintenance
+
+	// MaxBodySize rejects larger request bodies with 413; zero means
+	// unlimited. MaxHeaderBytes bounds the request headers; zero uses the
+	// net/http default.
+	MaxBodySize    int64
+	MaxHeaderBytes int64
+
+	// HTTPMode controls the plain HTTP listener on :80. Defaults to
+	// HTTPModeOff.
+	HTTPMode string
+
+	// Funnel exposes the service to the public internet. FunnelPaths
+	// optionally limits which path prefixes are public.
+	Funnel      bool
+	FunnelPaths []string
+
+	// RateLimit throttles callers per tailnet identity. Nil disables it.
+	RateLimit *proxy.RateLimit
+
+	// Retry and CircuitBreaker handle a container that can't be reached.
+	// Nil disables them.
+	Retry          *proxy.Retry
+	CircuitBreaker *proxy.CircuitBreaker
+
+	// WhoIsCacheTTL caches caller identities. Zero disables the cache.
+	WhoIsCacheTTL time.Duration
+
+	// IdentityHeaders maps extra header names to identity fields, and
+	// LegacyHeaders restores the original X-Tailscale-* values
+	IdentityHeaders map[string]string
+	LegacyHeaders   bool
+
+	// IdentitySigner signs identity assertions for the backend. Nil
+	// disables them.
+	IdentitySigner *identity.Signer
+
+	// ErrorPages renders error responses. Nil uses the built-in pages.
+	ErrorPages *errorpage.Renderer
+}
+
+type timeouts struct {
+	readHeader time.Duration
+	read       time.Duration
+	write      time.Duration
+	idle       time.Duration
 }
 
 func New(cfg *ServiceConfig, logger *slog.Logger) (*Service, error) {
-	targetURL, err := url.Parse(fmt.Sprintf("http://%s:%d", cfg.TargetIP, cfg.Port))
+	scheme := cfg.Scheme
+	if scheme == "" {
+		scheme = "http"
+	}
+
+	targetURL, err := url.Parse(scheme + "://" + net.JoinHostPort(cfg.TargetIP, strconv.Itoa(cfg.Port)))
+	if cfg.Socket != "" {
+		// Only the scheme and the Host header matter over a socket
+		targetURL, err = url.Parse(scheme + "://localhost")
+	}
 	if err != nil {
 		return nil, fmt.Errorf("invalid target URL: %w", err)
 	}
 
+	tlsConfig, err := upstreamTLSConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	var handler http.Handler
+	switch {
+	case cfg.Redirect != nil:
+		handler, err = redirectHandler(cfg.Redirect)
+	case cfg.StaticRoot != "":
+		handler, err = staticHandler(cfg.StaticRoot)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	httpMode := cfg.HTTPMode
+	if httpMode == "" {
+		httpMode = HTTPModeOff
+	}
+
 	server := &tsnet.Server{
 		Hostname:  cfg.Name,
 		Dir:       filepath.Join(cfg.StateDir, cfg.Name),
@@ -45,12 +180,54 @@ func New(cfg *ServiceConfig, logger *slog.Logger) (*Service, error) {
 		Logf:      func(format string, args ...any) { logger.Debug(fmt.Sprintf(format, args...)) },
 	}
 
+	var cache *proxy.CacheOptions
+	if cfg.Cache != nil {
+		opts := *cfg.Cache
+		opts.DiskDir = filepath.Join(cfg.StateDir, "cache", cfg.Name)
+		cache = &opts
+	}
+
 	return &Service{
 		name:      cfg.Name,
 		server:    server,
+		handler:   handler,
 		targetURL: targetURL,
-		logger:    logger.With("service", cfg.Name),
-		done:      make(chan struct{}),
+		scheme:    scheme,
+		socket:    cfg.Socket,
+		proxyOpts: proxy.Options{
+			Name:            cfg.Name,
+			Socket:          cfg.Socket,
+			TLSConfig:       tlsConfig,
+			Protocol:        cfg.Protocol,
+			FunnelPaths:     cfg.FunnelPaths,
+			RateLimit:       cfg.RateLimit,
+			Retry:           cfg.Retry,
+			CircuitBreaker:  cfg.CircuitBreaker,
+			WhoIsCacheTTL:   cfg.WhoIsCacheTTL,
+			PreserveHost:    cfg.PreserveHost,
+			Compression:     cfg.Compression,
+			Cache:           cache,
+			RequestHeaders:  cfg.RequestHeaders,
+			ResponseHeaders: cfg.ResponseHeaders,
+			SecurityHeaders: cfg.SecurityHeaders,
+			IdentityHeaders: cfg.IdentityHeaders,
+			LegacyHeaders:   cfg.LegacyHeaders,
+			IdentitySigner:  cfg.IdentitySigner,
+			ErrorPages:      cfg.ErrorPages,
+			MaxBodySize:     cfg.MaxBodySize,
+			Maintenance:     cfg.Maintenance,
+		},
+		timeouts: timeouts{
+			readHeader: cfg.ReadHeaderTimeout,
+			read:       cfg.ReadTimeout,
+			write:      cfg.WriteTimeout,
+			idle:       cfg.IdleTimeout,
+		},
+		maxHeaderBytes: int(cfg.MaxHeaderBytes),
+		httpMode:       httpMode,
+		funnel:         cfg.Funnel,
+		logger:         logger.With("service", cfg.Name),
+		done:           make(chan struct{}),
 	}, nil
 }
 
@@ -59,6 +236,7 @@ func (s *Service) Start(ctx context.Context) error {
 
 	// Start the tsnet server
 	if err := s.server.Start(); err != nil {
+		s.cancel()
 		return fmt.Errorf("failed to start tsnet server: %w", err)
 	}
 
@@ -66,32 +244,78 @@ func (s *Service) Start(ctx context.Context) error {
 	lc, err := s.server.LocalClient()
 	if err != nil {
 		s.server.Close()
+		s.cancel()
 		return fmt.Errorf("failed to get local client: %w", err)
 	}
 
-	// Create proxy with identity injection
-	s.proxy = proxy.New(s.targetURL, lc, s.logger)
+	// Create proxy with identity injection, unless the service serves
+	// redirects or files itself
+	handler := s.handler
+	if handler == nil {
+		s.proxy = proxy.NewWithOptions(s.targetURL, lc, s.logger, s.proxyOpts)
+		handler = exemptStreaming(s.proxy)
+	}
 
 	// Listen for HTTPS connections
-	ln, err := s.server.ListenTLS("tcp", ":443")
+	ln, err := s.listenTLS(ctx, lc)
 	if err != nil {
 		s.server.Close()
+		s.cancel()
 		return fmt.Errorf("failed to listen on TLS: %w", err)
 	}
 
-	httpServer := &http.Server{
-		Handler:      s.proxy,
-		ReadTimeout:  30 * time.Second,
-		WriteTimeout: 30 * time.Second,
-		IdleTimeout:  120 * time.Second,
+	httpsServer := s.newHTTPServer(handler)
+	servers := map[*http.Server]net.Listener{
+		httpsServer: ln,
+	}
+
+	if s.funnel {
+		httpsServer.ConnContext = funnelConnContext
+		funnelExposed.Set(1, s.name)
+		s.logger.Warn("SERVICE IS PUBLICLY EXPOSED TO THE INTERNET VIA TAILSCALE FUNNEL",
+			"url", "https://"+s.domain,
+			"paths", s.proxyOpts.FunnelPaths,
+		)
+	}
+
+	// Optionally listen for plain HTTP on :80
+	if s.httpMode != HTTPModeOff {
+		plainLn, err := s.server.Listen("tcp", ":80")
+		if err != nil {
+			ln.Close()
+			s.server.Close()
+			s.cancel()
+			return fmt.Errorf("failed to listen on :80: %w", err)
+		}
+
+		plainHandler := handler
+		if s.httpMode == HTTPModeRedirect {
+			plainHandler = redirectToHTTPS(s.domain)
+		}
+		servers[s.newHTTPServer(plainHandler)] = plainLn
+	}
+
+	// Only start watching once nothing can fail, so an error above
+	// doesn't leave the watcher running
+	if s.proxy != nil && s.proxyOpts.WhoIsCacheTTL > 0 {
+		go s.watchNetMap(ctx, lc)
 	}
 
 	// Start serving in background
+	var wg sync.WaitGroup
+	for httpServer, ln := range servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := httpServer.Serve(ln); err != nil && err != http.ErrServerClosed {
+				s.logger.Error("http server error", "error", err)
+			}
+		}()
+	}
+
 	go func() {
-		defer close(s.done)
-		if err := httpServer.Serve(ln); err != nil && err != http.ErrServerClosed {
-			s.logger.Error("http server error", "error", err)
-		}
+		wg.Wait()
+		close(s.done)
 	}()
 
 	// Handle shutdown
@@ -99,13 +323,81 @@ func (s *Service) Start(ctx context.Context) error {
 		<-ctx.Done()
 		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 		defer cancel()
-		httpServer.Shutdown(shutdownCtx)
+		for httpServer := range servers {
+			httpServer.Shutdown(shutdownCtx)
+		}
 	}()
 
-	s.logger.Info("service started", "hostname", s.name)
+	s.logger.Info("service started", "hostname", s.name, "domain", s.domain, "http", s.httpMode)
 	return nil
 }
 
+// watchNetMap invalidates cached caller identities whenever the netmap
+// changes, so renamed nodes or retagged devices are picked up immediately
+func (s *Service) watchNetMap(ctx context.Context, lc *local.Client) {
+	watcher, err := lc.WatchIPNBus(ctx, ipn.NotifyRateLimit)
+	if err != nil {
+		s.logger.Warn("failed to watch netmap, relying on whois cache TTL", "error", err)
+		return
+	}
+	defer watcher.Close()
+
+	for {
+		n, err := watcher.Next()
+		if err != nil {
+			if ctx.Err() == nil {
+				s.logger.Debug("netmap watch ended", "error", err)
+			}
+			return
+		}
+		if n.NetMap != nil {
+			s.proxy.InvalidateIdentityCache()
+		}
+	}
+}
+
+func (s *Service) newHTTPServer(handler http.Handler) *http.Server {
+	return &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: s.timeouts.readHeader,
+		ReadTimeout:       s.timeouts.read,
+		WriteTimeout:      s.timeouts.write,
+		IdleTimeout:       s.timeouts.idle,
+		MaxHeaderBytes:    s.maxHeaderBytes,
+	}
+}
+
+// listenTLS listens on :443 like tsnet's ListenTLS, but advertises HTTP/2
+// via ALPN so gRPC clients and multiplexed browsers can use it. It also
+// records the node's full domain name.
+func (s *Service) listenTLS(ctx context.Context, lc *local.Client) (net.Listener, error) {
+	st, err := s.server.Up(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(st.CertDomains) == 0 {
+		return nil, fmt.Errorf("HTTPS is not enabled for the tailnet")
+	}
+	s.domain = st.CertDomains[0]
+
+	tlsConfig := &tls.Config{
+		GetCertificate: lc.GetCertificate,
+		NextProtos:     []string{"h2", "http/1.1"},
+	}
+
+	// A funnel listener accepts both tailnet and public connections
+	if s.funnel {
+		return s.server.ListenFunnel("tcp", ":443", tsnet.FunnelTLSConfig(tlsConfig))
+	}
+
+	ln, err := s.server.Listen("tcp", ":443")
+	if err != nil {
+		return nil, err
+	}
+
+	return tls.NewListener(ln, tlsConfig), nil
+}
+
 func (s *Service) Stop() error {
 	if s.cancel != nil {
 		s.cancel()
@@ -118,6 +410,10 @@ func (s *Service) Stop() error {
 		s.logger.Warn("timeout waiting for http server to stop")
 	}
 
+	if s.funnel {
+		funnelExposed.Delete(s.name)
+	}
+
 	if err := s.server.Close(); err != nil {
 		return fmt.Errorf("failed to close tsnet server: %w", err)
 	}
@@ -127,7 +423,12 @@ func (s *Service) Stop() error {
 }
 
 func (s *Service) UpdateTarget(ip string, port int) error {
-	targetURL, err := url.Parse(fmt.Sprintf("http://%s:%d", ip, port))
+	if s.socket != "" {
+		// The socket path doesn't change with the container's address
+		return nil
+	}
+
+	targetURL, err := url.Parse(s.scheme + "://" + net.JoinHostPort(ip, strconv.Itoa(port)))
 	if err != nil {
 		return fmt.Errorf("invalid target URL: %w", err)
 	}
@@ -141,6 +442,53 @@ func (s *Service) UpdateTarget(ip string, port int) error {
 	return nil
 }
 
+// SetMaintenance puts the service into maintenance mode, or takes it out
+// with nil
+func (s *Service) SetMaintenance(m *proxy.Maintenance) {
+	if s.proxy == nil {
+		s.proxyOpts.Maintenance = m
+		return
+	}
+	s.proxy.SetMaintenance(m)
+}
+
+// Maintenance returns the maintenance settings, or nil when serving
+// normally
+func (s *Service) Maintenance() *proxy.Maintenance {
+	if s.proxy == nil {
+		return s.proxyOpts.Maintenance
+	}
+	return s.proxy.Maintenance()
+}
+
 func (s *Service) Name() string {
 	return s.name
 }
+
+// upstreamTLSConfig builds the TLS settings used to connect to https
+// upstreams. It returns nil when the defaults are sufficient.
+func upstreamTLSConfig(cfg *ServiceConfig) (*tls.Config, error) {
+	if !cfg.InsecureSkipVerify && cfg.CAFile == "" && cfg.ServerName == "" {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+		ServerName:         cfg.ServerName,
+	}
+
+	if cfg.CAFile != "" {
+		pem, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA file: %w", err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA file %s", cfg.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	return tlsConfig, nil
+}
@@ -0,0 +1,30 @@
+package service
+
+import (
+	"log/slog"
+	"testing"
+)
+
+func TestNew_IPv6Target(t *testing.T) {
+	svc, err := New(&ServiceConfig{
+		Name:     "ipv6",
+		TargetIP: "fd00::5",
+		Port:     8080,
+		AuthKey:  "test-key",
+		StateDir: t.TempDir(),
+	}, slog.Default())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if got := svc.targetURL.Host; got != "[fd00::5]:8080" {
+		t.Errorf("target host = %q, want %q", got, "[fd00::5]:8080")
+	}
+
+	if err := svc.UpdateTarget("fd00::6", 9090); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := svc.targetURL.Host; got != "[fd00::6]:9090" {
+		t.Errorf("updated target host = %q, want %q", got, "[fd00::6]:9090")
+	}
+}
@@ -0,0 +1,100 @@
+package service
+
+import (
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+)
+
+// Redirect makes a service answer every request with a redirect instead of
+// proxying it
+type Redirect struct {
+	// To is the absolute URL clients are sent to
+	To string
+
+	// Status is the redirect status code. Defaults to 302.
+	Status int
+
+	// PreservePath appends the request path and query to To
+	PreservePath bool
+}
+
+// redirectHandler sends every request to r.To
+func redirectHandler(r *Redirect) (http.Handler, error) {
+	target, err := url.Parse(r.To)
+	if err != nil || !target.IsAbs() {
+		return nil, fmt.Errorf("invalid redirect URL %q", r.To)
+	}
+
+	status := r.Status
+	if status == 0 {
+		status = http.StatusFound
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		location := target
+		if r.PreservePath {
+			location = target.JoinPath(req.URL.Path)
+			if req.URL.RawQuery != "" {
+				location.RawQuery = req.URL.RawQuery
+			}
+		}
+		http.Redirect(w, req, location.String(), status)
+	}), nil
+}
+
+// staticHandler serves the files under root, or root itself for every
+// request when it's a single file
+func staticHandler(root string) (http.Handler, error) {
+	info, err := os.Stat(root)
+	if err != nil {
+		return nil, fmt.Errorf("invalid static root: %w", err)
+	}
+
+	if info.IsDir() {
+		return http.FileServer(staticFS{http.Dir(root)}), nil
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFile(w, r, root)
+	}), nil
+}
+
+// staticFS keeps a static service from exposing more than its pages: files
+// and directories whose names start with a dot (.git, .env) don't exist,
+// and neither do directories without an index.html, so nothing is listed
+type staticFS struct {
+	http.FileSystem
+}
+
+func (s staticFS) Open(name string) (http.File, error) {
+	for _, part := range strings.Split(name, "/") {
+		if strings.HasPrefix(part, ".") {
+			return nil, fs.ErrNotExist
+		}
+	}
+
+	f, err := s.FileSystem.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if info.IsDir() {
+		index, err := s.FileSystem.Open(path.Join(name, "index.html"))
+		if err != nil {
+			f.Close()
+			return nil, fs.ErrNotExist
+		}
+		index.Close()
+	}
+	return f, nil
+}
@@ -0,0 +1,109 @@
+package service
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRedirectHandler(t *testing.T) {
+	tests := []struct {
+		name     string
+		redirect Redirect
+		target   string
+		status   int
+		want     string
+	}{
+		{"default status", Redirect{To: "https://wiki.example.com/docs"}, "/anything?x=1", http.StatusFound, "https://wiki.example.com/docs"},
+		{"permanent", Redirect{To: "https://wiki.example.com/", Status: http.StatusMovedPermanently}, "/", http.StatusMovedPermanently, "https://wiki.example.com/"},
+		{"preserve path", Redirect{To: "https://wiki.example.com/docs", PreservePath: true}, "/guide/intro?lang=en", http.StatusFound, "https://wiki.example.com/docs/guide/intro?lang=en"},
+		{"preserve root", Redirect{To: "https://wiki.example.com", PreservePath: true}, "/", http.StatusFound, "https://wiki.example.com/"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler, err := redirectHandler(&tt.redirect)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.target, nil))
+
+			if w.Code != tt.status {
+				t.Errorf("StatusCode = %d, want %d", w.Code, tt.status)
+			}
+			if got := w.Header().Get("Location"); got != tt.want {
+				t.Errorf("Location = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := redirectHandler(&Redirect{To: "/relative"}); err == nil {
+		t.Error("expected error for relative redirect URL")
+	}
+}
+
+func TestStaticHandler(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "index.html"), []byte("<h1>status</h1>"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "style.css"), []byte("body{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	handler, err := staticHandler(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for path, want := range map[string]string{"/": "<h1>status</h1>", "/style.css": "body{}"} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != http.StatusOK || w.Body.String() != want {
+			t.Errorf("GET %s = %d %q, want 200 %q", path, w.Code, w.Body.String(), want)
+		}
+	}
+
+	// Dotfiles and directories without an index aren't exposed
+	for _, file := range []string{".env", ".git/config", "assets/logo.svg"} {
+		path := filepath.Join(dir, file)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte("secret"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for path, want := range map[string]int{
+		"/.env":            http.StatusNotFound,
+		"/.git/config":     http.StatusNotFound,
+		"/.git/":           http.StatusNotFound,
+		"/assets/":         http.StatusNotFound,
+		"/assets/logo.svg": http.StatusOK,
+	} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != want {
+			t.Errorf("GET %s = %d, want %d", path, w.Code, want)
+		}
+	}
+
+	// A single file is served for every path
+	handler, err = staticHandler(filepath.Join(dir, "style.css"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/some/page", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "body{}" {
+		t.Errorf("GET /some/page = %d %q, want 200 %q", w.Code, w.Body.String(), "body{}")
+	}
+
+	if _, err := staticHandler(filepath.Join(dir, "missing")); err == nil {
+		t.Error("expected error for missing root")
+	}
+}
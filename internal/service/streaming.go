@@ -0,0 +1,33 @@
+package service
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// exemptStreaming clears the connection deadlines for long-lived requests
+// (WebSocket upgrades, server-sent events and gRPC streams) so the server's
+// read and write timeouts only apply to ordinary request/response traffic.
+func exemptStreaming(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isStreaming(r) {
+			rc := http.NewResponseController(w)
+			// Errors mean the writer doesn't support deadlines, in which
+			// case the server timeouts can't be lifted anyway.
+			_ = rc.SetReadDeadline(time.Time{})
+			_ = rc.SetWriteDeadline(time.Time{})
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func isStreaming(r *http.Request) bool {
+	if strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		return true
+	}
+	if strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		return true
+	}
+	return strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc")
+}
@@ -0,0 +1,209 @@
+package service
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jasonwu/dovetail/internal/config"
+	"github.com/jasonwu/dovetail/internal/docker"
+	"github.com/jasonwu/dovetail/internal/proxy"
+)
+
+func TestIsStreaming(t *testing.T) {
+	tests := []struct {
+		name   string
+		header http.Header
+		want   bool
+	}{
+		{"plain request", http.Header{}, false},
+		{"websocket upgrade", http.Header{"Upgrade": {"WebSocket"}}, true},
+		{"server-sent events", http.Header{"Accept": {"text/event-stream"}}, true},
+		{"grpc", http.Header{"Content-Type": {"application/grpc+proto"}}, true},
+		{"json", http.Header{"Accept": {"application/json"}}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header = tt.header
+			if got := isStreaming(req); got != tt.want {
+				t.Errorf("isStreaming() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExemptStreaming(t *testing.T) {
+	slow := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		time.Sleep(200 * time.Millisecond)
+		w.Write([]byte("data: done\n\n"))
+	})
+
+	server := httptest.NewUnstartedServer(exemptStreaming(slow))
+	server.Config.WriteTimeout = 50 * time.Millisecond
+	server.Start()
+	defer server.Close()
+
+	get := func(accept string) (string, error) {
+		req, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+		req.Header.Set("Accept", accept)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		return string(body), err
+	}
+
+	t.Run("event stream outlives write timeout", func(t *testing.T) {
+		body, err := get("text/event-stream")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if body != "data: done\n\n" {
+			t.Errorf("body = %q, want %q", body, "data: done\n\n")
+		}
+	})
+
+	t.Run("ordinary request still times out", func(t *testing.T) {
+		body, err := get("text/html")
+		if err == nil && body == "data: done\n\n" {
+			t.Error("expected write timeout to cut off the response")
+		}
+	})
+}
+
+func TestService_LimitLabels(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/download":
+			// A slow download, not a stream the timeouts are lifted for
+			w.Write([]byte("part 1\n"))
+			w.(http.Flusher).Flush()
+			time.Sleep(300 * time.Millisecond)
+			w.Write([]byte("part 2\n"))
+		case "/upload":
+			n, _ := io.Copy(io.Discard, r.Body)
+			w.Write([]byte(strconv.FormatInt(n, 10)))
+		}
+	}))
+	defer backend.Close()
+
+	backendURL, _ := url.Parse(backend.URL)
+	host, portStr, _ := net.SplitHostPort(backendURL.Host)
+	port, _ := strconv.Atoi(portStr)
+
+	// Service defaults far below what the backend needs
+	cfg := &config.Config{
+		AuthKey:      "test-key",
+		StateDir:     t.TempDir(),
+		WriteTimeout: 100 * time.Millisecond,
+		MaxBodySize:  1024,
+	}
+
+	built := make(map[string]*Service)
+	factory := func(cfg *ServiceConfig, logger *slog.Logger) (ServiceInterface, error) {
+		svc, err := New(cfg, logger)
+		if err != nil {
+			return nil, err
+		}
+		built[cfg.Name] = svc
+		return &mockService{name: cfg.Name}, nil
+	}
+	m := NewManagerWithFactory(cfg, slog.Default(), factory)
+
+	writeTimeout := 2 * time.Second
+	maxBodySize := int64(1 << 20)
+	m.HandleEvent(context.Background(), docker.ContainerEvent{
+		Type:        docker.EventStart,
+		ContainerID: "container123456789",
+		Config:      &docker.ServiceConfig{Name: "defaults", Port: port, IP: host},
+	})
+	m.HandleEvent(context.Background(), docker.ContainerEvent{
+		Type:        docker.EventStart,
+		ContainerID: "container987654321",
+		Config: &docker.ServiceConfig{
+			Name:         "raised",
+			Port:         port,
+			IP:           host,
+			WriteTimeout: &writeTimeout,
+			MaxBodySize:  &maxBodySize,
+		},
+	})
+
+	// Serve each service's proxy the way Start does, without tsnet
+	serve := func(name string) *httptest.Server {
+		svc := built[name]
+		if svc == nil {
+			t.Fatalf("service %q was not created", name)
+		}
+		p := proxy.NewWithOptions(svc.targetURL, nil, slog.Default(), svc.proxyOpts)
+		server := httptest.NewUnstartedServer(nil)
+		server.Config = svc.newHTTPServer(exemptStreaming(p))
+		server.Start()
+		t.Cleanup(server.Close)
+		return server
+	}
+	defaults := serve("defaults")
+	raised := serve("raised")
+
+	download := func(server *httptest.Server) (string, error) {
+		resp, err := http.Get(server.URL + "/download")
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		return string(body), err
+	}
+	upload := func(server *httptest.Server, size int) (int, string) {
+		resp, err := http.Post(server.URL+"/upload", "application/octet-stream", strings.NewReader(strings.Repeat("x", size)))
+		if err != nil {
+			t.Fatalf("upload failed: %v", err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	t.Run("slow response outlives raised write timeout", func(t *testing.T) {
+		body, err := download(raised)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if body != "part 1\npart 2\n" {
+			t.Errorf("body = %q, want the full response", body)
+		}
+	})
+
+	t.Run("slow response cut off by default write timeout", func(t *testing.T) {
+		body, err := download(defaults)
+		if err == nil && body == "part 1\npart 2\n" {
+			t.Error("expected write timeout to cut off the response")
+		}
+	})
+
+	t.Run("large upload accepted under raised limit", func(t *testing.T) {
+		status, body := upload(raised, 64*1024)
+		if status != http.StatusOK || body != "65536" {
+			t.Errorf("got %d %q, want 200 with the whole body forwarded", status, body)
+		}
+	})
+
+	t.Run("large upload rejected by default limit", func(t *testing.T) {
+		if status, _ := upload(defaults, 64*1024); status != http.StatusRequestEntityTooLarge {
+			t.Errorf("StatusCode = %d, want %d", status, http.StatusRequestEntityTooLarge)
+		}
+	})
+}